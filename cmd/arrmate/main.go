@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/alecthomas/kong"
 	"github.com/jrudio/go-plex-client"
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"jeremyrossi.com/go/arrmate/server"
 	"os"
+	"sort"
+	"strings"
+	"time"
 	"zombiezen.com/go/sqlite/shell"
 )
 
@@ -27,54 +32,109 @@ type grammer struct {
 			} `cmd:"" help:"config interacts with sql config store and gets all keys"`
 		}
 	*/
-	CS       string `name:"connectstring" default:"./arrmate.sqlite"`
-	LogLevel string `name:"logging.level" default:"warn"`
-	Server   struct {
-	} `cmd`
+	CS         string `name:"connectstring" default:"./arrmate.sqlite" env:"ARRMATE_CONNECTSTRING"`
+	LogLevel   string `name:"logging.level" default:"warn" env:"ARRMATE_LOGGING_LEVEL"`
+	ConfigFile string `name:"config-file" help:"YAML or TOML config file layered over the config table" env:"ARRMATE_CONFIG_FILE"`
+	Server     struct {
+	} `cmd:""`
 	Config struct {
 		Get struct {
+			Guild  string   `name:"guild" help:"resolve guild:<id>:key before key"`
+			Reveal bool     `name:"reveal" help:"show secrets instead of masking them"`
 			Values []string `arg:""`
-		} `cmd`
+		} `cmd:""`
 		Set struct {
+			Guild  string            `name:"guild" help:"set the per guild override guild:<id>:key"`
 			Values map[string]string `arg:""`
-		} `cmd`
+		} `cmd:""`
 		List struct {
-		} `cmd`
+			Guild   string `name:"guild" help:"list the config as resolved for a guild"`
+			Reveal  bool   `name:"reveal" help:"show secrets instead of masking them"`
+			All     bool   `name:"all" help:"include known keys that are not set"`
+			Sources bool   `name:"sources" help:"show where each value came from: env, file, db or default"`
+		} `cmd:""`
+		Describe struct {
+			Keys []string `arg:"" optional:"" help:"keys to describe, all known keys when empty"`
+		} `cmd:"" help:"describe the known config keys"`
+		Encrypt struct {
+		} `cmd:"" help:"encrypt secrets still stored in plaintext"`
+		Export struct {
+			Format string `name:"format" enum:"json,yaml" default:"yaml" help:"json or yaml"`
+			Redact bool   `name:"redact" help:"mask secrets instead of exporting them decrypted"`
+			Output string `name:"output" short:"o" help:"file to write, stdout when empty"`
+		} `cmd:"" help:"export the config table"`
+		Import struct {
+			File   string `arg:"" type:"existingfile" help:"json or yaml file written by config export"`
+			DryRun bool   `name:"dry-run" help:"only show what would change"`
+		} `cmd:"" help:"import a config export in a single transaction"`
+		History struct {
+			Key   string `arg:"" optional:"" help:"only show changes to key"`
+			Limit int    `name:"limit" default:"50" help:"number of changes to show"`
+		} `cmd:"" help:"show recent config changes, newest first"`
+		Rollback struct {
+			Key string `arg:""`
+			To  int64  `name:"to" help:"restore the value set by this history id instead of undoing the last change"`
+		} `cmd:"" help:"undo the last change to a key"`
 		Shell struct {
-		} `cmd`
-	} `cmd`
+		} `cmd:""`
+	} `cmd:""`
 	Plex struct {
 		Test struct {
-		} `cmd`
+		} `cmd:""`
 		Search struct {
 			Value string `arg:""`
-		} `cmd`
-	} `cmd`
+		} `cmd:""`
+	} `cmd:""`
 	Sonarr struct {
 		Search struct {
 			Value string `arg:""`
-		} `cmd`
-	} `cmd`
+		} `cmd:""`
+	} `cmd:""`
+	Stats struct {
+	} `cmd:"" help:"print library stats as json"`
+	Cleanup struct {
+		Plan struct {
+		} `cmd:"" help:"list the cleanup candidates without deleting anything"`
+	} `cmd:""`
 }
 
 func (c *grammer) ConnectString() string {
 	return c.CS
 }
 
+func (c *grammer) ConfigFileName() string {
+	return c.ConfigFile
+}
+
 func (c *grammer) LoggingLevel() string {
 	return c.LogLevel
 }
 
-func (g *grammer) SetupClient() (*server.ArrServer, error) {
+func (g *grammer) setupLogging() error {
 	l, err := zerolog.ParseLevel(g.LoggingLevel())
 	if err != nil {
-		return nil, err
+		return err
 	}
 	zerolog.SetGlobalLevel(l)
+	return nil
+}
+
+func (g *grammer) SetupClient() (*server.ArrServer, error) {
+	if err := g.setupLogging(); err != nil {
+		return nil, err
+	}
 	return server.NewClient(g)
 
 }
 
+// SetupDB opens only the database, for commands that do not need plex.
+func (g *grammer) SetupDB() (*server.ArrServer, error) {
+	if err := g.setupLogging(); err != nil {
+		return nil, err
+	}
+	return server.NewDBClient(g)
+}
+
 func HandlePlexSearch(g *grammer) error {
 	ac, err := g.SetupClient()
 	if err != nil {
@@ -125,7 +185,7 @@ func HandlePlexTest(g *grammer) error {
 	if err != nil {
 		return err
 	}
-	result, err := ac.PlexConn.Test()
+	result, err := ac.PlexConn().Test()
 	if err != nil {
 		return err
 	}
@@ -141,32 +201,41 @@ func HandlePlexTest(g *grammer) error {
 }
 
 func HandleConfigSet(g *grammer) error {
-	ac, err := g.SetupClient()
+	ac, err := g.SetupDB()
 	if err != nil {
 		return err
 	}
 
 	for k, v := range g.Config.Set.Values {
+		if g.Config.Set.Guild != "" {
+			k = server.GuildKey(g.Config.Set.Guild, k)
+		}
 		err := ac.DB.ConfigSet(k, v)
 		if err != nil {
 			return err
 		}
+		if found, _, source := ac.DB.Overlay.Get(k); found {
+			fmt.Printf("warning: %s is overridden by %s\n", k, ac.DB.Overlay.DescribeSource(k, source))
+		}
 	}
 	return nil
 }
 
 func HandleConfigGet(g *grammer) error {
-	ac, err := g.SetupClient()
+	ac, err := g.SetupDB()
 	if err != nil {
 		return err
 	}
 	//defer db.Close()
 
 	for _, k := range g.Config.Get.Values {
-		found, v, _ := ac.DB.ConfigGet(k)
+		found, v, err := ac.DB.ConfigGetGuild(g.Config.Get.Guild, k)
 		if err != nil {
 			return err
 		}
+		if !g.Config.Get.Reveal {
+			v = server.MaskSecret(k, v)
+		}
 		if found {
 			fmt.Printf("%s=%s\n", k, v)
 		} else {
@@ -177,28 +246,215 @@ func HandleConfigGet(g *grammer) error {
 }
 
 func HandleConfigList(g *grammer) error {
-	ac, err := g.SetupClient()
+	ac, err := g.SetupDB()
 	if err != nil {
 		return err
 	}
 	//defer db.Close()
 
-	keys, _ := ac.DB.ConfigList()
+	keys, err := ac.DB.ConfigList()
+	if err != nil {
+		return err
+	}
+	keys = append(keys, ac.DB.Overlay.Keys()...)
+	if g.Config.List.All {
+		for _, ck := range server.ConfigKeys() {
+			keys = append(keys, ck.Key)
+		}
+	}
+	keys = guildKeys(g.Config.List.Guild, keys)
 	for _, k := range keys {
-		found, v, _ := ac.DB.ConfigGet(k)
+		found, v, source, err := ac.DB.ConfigResolve(g.Config.List.Guild, k)
 		if err != nil {
 			return err
 		}
-		if found {
-			fmt.Printf("%s=%s\n", k, v)
-		} else {
+		if !g.Config.List.Reveal {
+			v = server.MaskSecret(k, v)
+		}
+		switch {
+		case !found:
 			fmt.Printf("%s=\n", k)
+		case g.Config.List.Sources:
+			fmt.Printf("%s=%s (%s)\n", k, v, ac.DB.Overlay.DescribeSource(k, source))
+		case source == server.ConfigSourceDefault:
+			fmt.Printf("%s=%s (default)\n", k, v)
+		default:
+			fmt.Printf("%s=%s\n", k, v)
+		}
+	}
+	return nil
+}
+
+func HandleConfigDescribe(g *grammer) error {
+	keys := []*server.ConfigKey{}
+	if len(g.Config.Describe.Keys) == 0 {
+		keys = server.ConfigKeys()
+	}
+	for _, k := range g.Config.Describe.Keys {
+		ck, err := server.LookupConfigKey(k)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, ck)
+	}
+	for _, ck := range keys {
+		fmt.Println(ck.Key)
+		fmt.Printf("    type: %s\n", ck.Type)
+		if ck.Default != "" {
+			fmt.Printf("    default: %s\n", ck.Default)
+		}
+		if ck.Guild {
+			fmt.Println("    guild override: yes")
 		}
+		if server.IsSensitiveKey(ck.Key) {
+			fmt.Println("    secret: yes")
+		}
+		fmt.Printf("    %s\n", ck.Description)
 	}
 	return nil
 }
+
+func HandleConfigEncrypt(g *grammer) error {
+	ac, err := g.SetupDB()
+	if err != nil {
+		return err
+	}
+
+	changed, err := ac.DB.EncryptSecrets()
+	for _, k := range changed {
+		fmt.Printf("encrypted %s\n", k)
+	}
+	return err
+}
+
+func HandleConfigExport(g *grammer) error {
+	ac, err := g.SetupDB()
+	if err != nil {
+		return err
+	}
+
+	values, err := ac.DB.ConfigExport(g.Config.Export.Redact)
+	if err != nil {
+		return err
+	}
+	b, err := server.MarshalConfig(values, g.Config.Export.Format)
+	if err != nil {
+		return err
+	}
+	if g.Config.Export.Output == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(g.Config.Export.Output, b, 0600)
+}
+
+func HandleConfigImport(g *grammer) error {
+	ac, err := g.SetupDB()
+	if err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(g.Config.Import.File)
+	if err != nil {
+		return err
+	}
+	values, redacted, err := server.ParseConfigImport(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", g.Config.Import.File, err)
+	}
+	changes, err := ac.DB.ConfigDiff(values)
+	if err != nil {
+		return err
+	}
+	missing, err := ac.DB.ConfigMissing(values, redacted)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		fmt.Printf("not in %s, left unchanged:\n", g.Config.Import.File)
+		for _, c := range missing {
+			fmt.Println(c)
+		}
+	}
+	if len(changes) == 0 {
+		fmt.Println("config is up to date")
+		return nil
+	}
+	if len(missing) > 0 {
+		fmt.Println("changes:")
+	}
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+	if g.Config.Import.DryRun {
+		return nil
+	}
+	if err = ac.DB.ConfigImport(server.CLIActor(), changes); err != nil {
+		return err
+	}
+	fmt.Printf("imported %d keys\n", len(changes))
+	return nil
+}
+
+func HandleConfigHistory(g *grammer) error {
+	ac, err := g.SetupDB()
+	if err != nil {
+		return err
+	}
+
+	history, err := ac.DB.ConfigHistoryList(g.Config.History.Key, g.Config.History.Limit)
+	if err != nil {
+		return err
+	}
+	for _, h := range history {
+		fmt.Println(h)
+	}
+	return nil
+}
+
+func HandleConfigRollback(g *grammer) error {
+	ac, err := g.SetupDB()
+	if err != nil {
+		return err
+	}
+
+	h, err := ac.DB.ConfigRollback(server.CLIActor(), g.Config.Rollback.Key, g.Config.Rollback.To)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		fmt.Printf("%s is already unset\n", g.Config.Rollback.Key)
+		return nil
+	}
+	fmt.Println(h)
+	return nil
+}
+
+// guildKeys returns the sorted unique keys visible to a guild with the
+// guild:<id>: prefix removed, overrides for other guilds are dropped.  An
+// empty guildID keeps every key as it is.
+func guildKeys(guildID string, keys []string) []string {
+	prefix := server.GuildKey(guildID, "")
+	seen := map[string]bool{}
+	results := []string{}
+	for _, k := range keys {
+		if guildID != "" && strings.HasPrefix(k, "guild:") {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			k = strings.TrimPrefix(k, prefix)
+		}
+		if !seen[k] {
+			seen[k] = true
+			results = append(results, k)
+		}
+	}
+	sort.Strings(results)
+	return results
+}
+
 func HandleConfigShell(g *grammer) error {
-	ac, err := g.SetupClient()
+	ac, err := g.SetupDB()
 	if err != nil {
 		return err
 	}
@@ -213,6 +469,41 @@ func HandleConfigShell(g *grammer) error {
 	return nil
 }
 
+func HandleStats(g *grammer) error {
+	ac, err := g.SetupDB()
+	if err != nil {
+		return err
+	}
+	if err := ac.SetupPlex(); err != nil {
+		log.Warn().Err(err).Msg("Plex counts are unavailable")
+	}
+
+	stats, err := ac.Stats()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func HandleCleanupPlan(g *grammer) error {
+	ac, err := g.SetupDB()
+	if err != nil {
+		return err
+	}
+
+	candidates, err := ac.CleanupPlan(time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Println(server.CleanupText(candidates))
+	return nil
+}
+
 func HandleStarrSonarrSearch(g *grammer) error {
 	_, err := g.SetupClient()
 	if err != nil {
@@ -251,6 +542,18 @@ func main() {
 		err = HandleConfigGet(g)
 	case "config list":
 		err = HandleConfigList(g)
+	case "config describe", "config describe <keys>":
+		err = HandleConfigDescribe(g)
+	case "config encrypt":
+		err = HandleConfigEncrypt(g)
+	case "config export":
+		err = HandleConfigExport(g)
+	case "config import <file>":
+		err = HandleConfigImport(g)
+	case "config history", "config history <key>":
+		err = HandleConfigHistory(g)
+	case "config rollback <key>":
+		err = HandleConfigRollback(g)
 	case "config shell":
 		err = HandleConfigShell(g)
 	case "plex test":
@@ -259,6 +562,10 @@ func main() {
 		err = HandlePlexSearch(g)
 	case "sonarr search <value>":
 		err = HandleStarrSonarrSearch(g)
+	case "stats":
+		err = HandleStats(g)
+	case "cleanup plan":
+		err = HandleCleanupPlan(g)
 	case "server":
 		err = StartServer(g)
 	}
@@ -0,0 +1,179 @@
+// Package chart draws simple bar charts as PNG images in pure Go so they can
+// be rendered headless and attached to discord messages.
+package chart
+
+import (
+	"fmt"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"strconv"
+)
+
+var (
+	background = color.RGBA{0x2f, 0x31, 0x36, 0xff}
+	foreground = color.RGBA{0xdc, 0xdd, 0xde, 0xff}
+	grid       = color.RGBA{0x40, 0x44, 0x4b, 0xff}
+	barColor   = color.RGBA{0x58, 0x65, 0xf2, 0xff}
+)
+
+const (
+	padding    = 16
+	lineHeight = 16
+	barWidth   = 24
+	barGap     = 8
+	barHeight  = 18
+	plotHeight = 240
+	plotWidth  = 360
+)
+
+// Bar is one labelled value of a chart.
+type Bar struct {
+	Label string
+	Value float64
+}
+
+// BarChart is a bar chart, vertical bars by default.  Horizontal suits long
+// labels like paths and genres.  Format renders values, whole numbers when
+// nil.
+type BarChart struct {
+	Title      string
+	Bars       []Bar
+	Horizontal bool
+	Format     func(v float64) string
+}
+
+func (c *BarChart) format(v float64) string {
+	if c.Format != nil {
+		return c.Format(v)
+	}
+	return strconv.FormatFloat(v, 'f', 0, 64)
+}
+
+func (c *BarChart) max() float64 {
+	max := 0.0
+	for _, b := range c.Bars {
+		if b.Value > max {
+			max = b.Value
+		}
+	}
+	return max
+}
+
+// Image draws the chart.
+func (c *BarChart) Image() image.Image {
+	if c.Horizontal {
+		return c.horizontal()
+	}
+	return c.vertical()
+}
+
+// Render writes the chart as a PNG.
+func (c *BarChart) Render(w io.Writer) error {
+	if err := png.Encode(w, c.Image()); err != nil {
+		return fmt.Errorf("encoding chart %q: %w", c.Title, err)
+	}
+	return nil
+}
+
+// vertical puts labels under the bars, every label is drawn when they fit
+// and only some of them otherwise.
+func (c *BarChart) vertical() image.Image {
+	labelWidth := 0
+	for _, b := range c.Bars {
+		labelWidth = maxInt(labelWidth, textWidth(b.Label))
+	}
+	step := 1
+	for step*(barWidth+barGap) < labelWidth+barGap {
+		step++
+	}
+	width := maxInt(2*padding+len(c.Bars)*(barWidth+barGap)+maxInt(labelWidth-barWidth, 0), 2*padding+textWidth(c.Title))
+	height := padding + lineHeight + plotHeight + 2*lineHeight + padding
+	img := canvas(width, height)
+	text(img, padding, padding+lineHeight-4, c.Title)
+
+	base := padding + lineHeight + plotHeight + lineHeight/2
+	line(img, padding, base, width-padding, base)
+	max := c.max()
+	for i, b := range c.Bars {
+		x := padding + i*(barWidth+barGap)
+		h := 0
+		if max > 0 {
+			h = int(b.Value / max * float64(plotHeight-lineHeight))
+		}
+		draw.Draw(img, image.Rect(x, base-h, x+barWidth, base), image.NewUniform(barColor), image.Point{}, draw.Src)
+		if b.Value > 0 {
+			v := c.format(b.Value)
+			text(img, x+(barWidth-textWidth(v))/2, base-h-4, v)
+		}
+		if i%step == 0 {
+			text(img, x, base+lineHeight, b.Label)
+		}
+	}
+	return img
+}
+
+// horizontal puts labels left of the bars with the value at their end.
+func (c *BarChart) horizontal() image.Image {
+	labelWidth, valueWidth := 0, 0
+	for _, b := range c.Bars {
+		labelWidth = maxInt(labelWidth, textWidth(b.Label))
+		valueWidth = maxInt(valueWidth, textWidth(c.format(b.Value)))
+	}
+	width := maxInt(2*padding+labelWidth+barGap+plotWidth+barGap+valueWidth, 2*padding+textWidth(c.Title))
+	height := padding + 2*lineHeight + len(c.Bars)*(barHeight+barGap) + padding
+	img := canvas(width, height)
+	text(img, padding, padding+lineHeight-4, c.Title)
+
+	left := padding + labelWidth + barGap
+	top := padding + 2*lineHeight
+	line(img, left, top, left, height-padding)
+	max := c.max()
+	for i, b := range c.Bars {
+		y := top + i*(barHeight+barGap)
+		w := 0
+		if max > 0 {
+			w = int(b.Value / max * float64(plotWidth))
+		}
+		draw.Draw(img, image.Rect(left, y, left+w, y+barHeight), image.NewUniform(barColor), image.Point{}, draw.Src)
+		text(img, padding, y+barHeight-5, b.Label)
+		text(img, left+w+barGap, y+barHeight-5, c.format(b.Value))
+	}
+	return img
+}
+
+func canvas(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	return img
+}
+
+func line(img *image.RGBA, x0, y0, x1, y1 int) {
+	draw.Draw(img, image.Rect(x0, y0, maxInt(x1, x0+1), maxInt(y1, y0+1)), image.NewUniform(grid), image.Point{}, draw.Src)
+}
+
+func text(img *image.RGBA, x, y int, s string) {
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(foreground),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(s)
+}
+
+func textWidth(s string) int {
+	return font.MeasureString(basicfont.Face7x13, s).Round()
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,42 @@
+package chart
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBarChart_Render(t *testing.T) {
+	for _, c := range []*BarChart{
+		{Title: "Added per month", Bars: []Bar{{"2022-01", 3}, {"2022-02", 0}, {"2022-03", 12}}},
+		{Title: "Disk usage", Horizontal: true, Bars: []Bar{{"/tv", 2048}, {"/movies", 1024}},
+			Format: func(v float64) string { return "big" }},
+		{Title: "Empty"},
+	} {
+		var b bytes.Buffer
+		assert.NoError(t, c.Render(&b), c.Title)
+		img, err := png.Decode(&b)
+		assert.NoError(t, err, c.Title)
+		assert.True(t, img.Bounds().Dx() > 2*padding, c.Title)
+		assert.True(t, img.Bounds().Dy() > 2*padding, c.Title)
+	}
+}
+
+func TestBarChart_Bars(t *testing.T) {
+	c := &BarChart{Title: "t", Bars: []Bar{{"a", 1}, {"b", 2}}}
+	img := c.Image()
+	base := padding + lineHeight + plotHeight + lineHeight/2
+
+	tallest := padding + 1*(barWidth+barGap) + barWidth/2
+	r, g, b, _ := img.At(tallest, base-(plotHeight-lineHeight)+1).RGBA()
+	br, bg, bb, _ := barColor.RGBA()
+	assert.Equal(t, []uint32{br, bg, bb}, []uint32{r, g, b}, "the largest value fills the plot")
+
+	half := padding + barWidth/2
+	r, g, b, _ = img.At(half, base-(plotHeight-lineHeight)+1).RGBA()
+	assert.NotEqual(t, []uint32{br, bg, bb}, []uint32{r, g, b}, "half the value is half the height")
+	r, g, b, _ = img.At(half, base-(plotHeight-lineHeight)/2+1).RGBA()
+	assert.Equal(t, []uint32{br, bg, bb}, []uint32{r, g, b})
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	"jeremyrossi.com/go/arrmate/server/chart"
+	"strings"
+	"time"
+)
+
+const chartUsage = "usage: !chart <name> or !chart all"
+
+// StatsChart builds a chart from the database.
+type StatsChart struct {
+	Name  string
+	Help  string
+	Build func(d *DB, now time.Time) (*chart.BarChart, error)
+}
+
+// StatsCharts are the charts !chart can draw.
+var StatsCharts = []*StatsChart{
+	{Name: "added", Help: "series and movies added per month over the last year", Build: addedChart},
+	{Name: "disk", Help: "size on disk by root folder", Build: diskChart},
+	{Name: "genres", Help: "series and movies of the top genres", Build: genresChart},
+	{Name: "streams", Help: "plex plays per day over the last 30 days", Build: streamsChart},
+}
+
+// streamsDays is how many days the streams chart covers.
+const streamsDays = 30
+
+// LookupStatsChart returns the chart called name or nil.
+func LookupStatsChart(name string) *StatsChart {
+	for _, c := range StatsCharts {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// chartSince is the first month of the charts over the last year.
+func chartSince(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -11, 0)
+}
+
+// MonthBars has a bar for every month from since to now, months without
+// a count are 0.
+func MonthBars(counts []NamedCount, since, now time.Time) []chart.Bar {
+	byMonth := map[string]float64{}
+	for _, c := range counts {
+		byMonth[c.Name] = float64(c.Count)
+	}
+	results := []chart.Bar{}
+	for m := time.Date(since.Year(), since.Month(), 1, 0, 0, 0, 0, time.UTC); !m.After(now); m = m.AddDate(0, 1, 0) {
+		month := m.Format("2006-01")
+		results = append(results, chart.Bar{Label: month, Value: byMonth[month]})
+	}
+	return results
+}
+
+// DayBars has a bar for every day from since to now, days without a count
+// are 0.  Labels are the day of the month, the title carries the range.
+func DayBars(counts []NamedCount, since, now time.Time) []chart.Bar {
+	byDay := map[string]float64{}
+	for _, c := range counts {
+		byDay[c.Name] = float64(c.Count)
+	}
+	results := []chart.Bar{}
+	for d := time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, time.UTC); !d.After(now); d = d.AddDate(0, 0, 1) {
+		results = append(results, chart.Bar{Label: d.Format("02"), Value: byDay[d.Format("2006-01-02")]})
+	}
+	return results
+}
+
+func addedChart(d *DB, now time.Time) (*chart.BarChart, error) {
+	since := chartSince(now)
+	stats, err := d.LibraryStats(statsTop, since)
+	if err != nil {
+		return nil, err
+	}
+	return &chart.BarChart{Title: "Added per month", Bars: MonthBars(stats.AddedByMonth, since, now)}, nil
+}
+
+func diskChart(d *DB, now time.Time) (*chart.BarChart, error) {
+	stats, err := d.LibraryStats(statsTop, now)
+	if err != nil {
+		return nil, err
+	}
+	c := &chart.BarChart{
+		Title:      "Size on disk by root folder",
+		Horizontal: true,
+		Format:     func(v float64) string { return HumanSize(int64(v)) },
+	}
+	for _, f := range stats.RootFolders {
+		c.Bars = append(c.Bars, chart.Bar{Label: f.Path, Value: float64(f.Size)})
+	}
+	return c, nil
+}
+
+func streamsChart(d *DB, now time.Time) (*chart.BarChart, error) {
+	now = now.UTC()
+	since := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1-streamsDays)
+	counts, err := d.PlaysPerDay(since)
+	if err != nil {
+		return nil, err
+	}
+	title := fmt.Sprintf("Plex plays per day %s to %s", since.Format("2006-01-02"), now.Format("2006-01-02"))
+	return &chart.BarChart{Title: title, Bars: DayBars(counts, since, now)}, nil
+}
+
+func genresChart(d *DB, now time.Time) (*chart.BarChart, error) {
+	stats, err := d.LibraryStats(statsTop, now)
+	if err != nil {
+		return nil, err
+	}
+	c := &chart.BarChart{Title: "Top genres", Horizontal: true}
+	for _, g := range stats.TopGenres {
+		c.Bars = append(c.Bars, chart.Bar{Label: g.Name, Value: float64(g.Count)})
+	}
+	return c, nil
+}
+
+// RenderStatsChart draws a chart as a discord attachment.
+func (d *DB) RenderStatsChart(c *StatsChart, now time.Time) (*discordgo.File, error) {
+	bc, err := c.Build(d, now)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := bc.Render(&b); err != nil {
+		return nil, err
+	}
+	return &discordgo.File{Name: c.Name + ".png", ContentType: "image/png", Reader: &b}, nil
+}
+
+// HandleChart attaches a chart of the library, !chart all attaches every
+// chart and !chart alone lists them.
+func (srv *ArrServer) HandleChart(s *discordgo.Session, m *discordgo.MessageCreate) {
+	name := strings.TrimSpace(strings.TrimPrefix(m.Content, "!chart"))
+	charts := []*StatsChart{}
+	switch {
+	case name == "all":
+		charts = StatsCharts
+	case LookupStatsChart(name) != nil:
+		charts = append(charts, LookupStatsChart(name))
+	default:
+		lines := []string{chartUsage}
+		for _, c := range StatsCharts {
+			lines = append(lines, fmt.Sprintf("  %s - %s", c.Name, c.Help))
+		}
+		s.ChannelMessageSend(m.ChannelID, strings.Join(lines, "\n"))
+		return
+	}
+
+	files := []*discordgo.File{}
+	for _, c := range charts {
+		f, err := srv.DB.RenderStatsChart(c, time.Now())
+		if err != nil {
+			log.Error().Err(err).Str("chart", c.Name).Msg("Rendering chart failed")
+			s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+			return
+		}
+		files = append(files, f)
+	}
+	if _, err := s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{Files: files}); err != nil {
+		log.Error().Err(err).Msg("Sending chart failed")
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golift.io/starr/radarr"
+	"jeremyrossi.com/go/arrmate/server/chart"
+)
+
+func TestMonthBars(t *testing.T) {
+	now := time.Date(2022, 3, 15, 0, 0, 0, 0, time.UTC)
+	bars := MonthBars([]NamedCount{{"2022-02", 4}}, time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC), now)
+	assert.Equal(t, []chart.Bar{{Label: "2021-12"}, {Label: "2022-01"}, {Label: "2022-02", Value: 4}, {Label: "2022-03"}}, bars)
+}
+
+func TestDB_RenderStatsChart(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	now := time.Now()
+	assert.NoError(t, db.CacheRadarr([]*radarr.Movie{
+		{ID: 1, Title: "Heat", Genres: []string{"Crime"}, Path: "/movies/Heat", SizeOnDisk: 1 << 30, Added: now},
+	}))
+
+	for _, c := range StatsCharts {
+		f, err := db.RenderStatsChart(c, now)
+		assert.NoError(t, err, c.Name)
+		assert.Equal(t, c.Name+".png", f.Name)
+		_, err = png.Decode(f.Reader)
+		assert.NoError(t, err, c.Name)
+	}
+	assert.Nil(t, LookupStatsChart("nope"))
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// MediaCleanup deletes the files of a movie or series and unmonitors it so
+// they are not downloaded again.
+const MediaCleanup = "cleanup"
+
+// CleanupOptions limits which movies and series are cleanup candidates.
+type CleanupOptions struct {
+	// Since is the last day an item may have been added or watched.
+	Since time.Time
+	// RequestedSince is the last day an item may have been requested.
+	RequestedSince time.Time
+	// MinSize is the smallest size on disk in bytes.
+	MinSize int64
+}
+
+// CleanupCandidate is a movie or series worth deleting to free disk space.
+type CleanupCandidate struct {
+	App         string
+	ID          int64
+	Title       string
+	Year        int64
+	Size        int64
+	Added       time.Time
+	LastWatched time.Time
+	// Score ranks candidates, the size in GiB times the months since the
+	// item was last added or watched.
+	Score float64
+}
+
+// LastActive is when the item was last watched, or added when it never was.
+func (c *CleanupCandidate) LastActive() time.Time {
+	if c.LastWatched.After(c.Added) {
+		return c.LastWatched
+	}
+	return c.Added
+}
+
+// String formats the candidate for discord and the cli.
+func (c *CleanupCandidate) String() string {
+	last := "never watched"
+	if !c.LastWatched.IsZero() {
+		last = "last watched " + c.LastWatched.Format("2006-01-02")
+	}
+	return fmt.Sprintf("%s: %s (%d) id=%d, %.1f GiB, added %s, %s",
+		c.App, c.Title, c.Year, c.ID, float64(c.Size)/(1<<30), c.Added.Format("2006-01-02"), last)
+}
+
+// CleanupText numbers the candidates and totals the space they use.
+func CleanupText(candidates []*CleanupCandidate) string {
+	if len(candidates) == 0 {
+		return "No cleanup candidates"
+	}
+	var total int64
+	lines := make([]string, len(candidates))
+	for i, c := range candidates {
+		total += c.Size
+		lines[i] = fmt.Sprintf("%d. %s", i+1, c)
+	}
+	return fmt.Sprintf("Cleanup candidates: %d, %.1f GiB\n%s", len(candidates), float64(total)/(1<<30), strings.Join(lines, "\n"))
+}
+
+// CleanupCandidates returns the radarr movies and sonarr series on plex that
+// are at least opts.MinSize, were added and last watched before opts.Since
+// and nobody requested since opts.RequestedSince, best candidates first.
+// Items not matched to plex are left out as their plays are unknown.
+func (d *DB) CleanupCandidates(opts CleanupOptions, now time.Time) ([]*CleanupCandidate, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	results := []*CleanupCandidate{}
+	err = sqlitex.Execute(conn, `SELECT a.app, a.id, a.title, a.year, a.size_on_disk, a.added, h.last FROM (
+			SELECT 'radarr' AS app, id, title, year, size_on_disk, added, tmdb_id AS external_id, 'movie' AS kind FROM radarr
+			UNION ALL
+			SELECT 'sonarr', id, title, year, size_on_disk, added, tvdb_id, 'series' FROM sonarr) a
+		JOIN plex_map m ON m.app = a.app AND m.item_id = a.id
+		LEFT JOIN (SELECT item_key, max(viewed_at) AS last FROM plex_history GROUP BY item_key) h ON h.item_key = m.rating_key
+		WHERE a.size_on_disk >= max(?3, 1) AND a.added < date(?1, 'unixepoch') AND coalesce(h.last, 0) < ?1
+			AND NOT EXISTS (SELECT 1 FROM media_requests r WHERE r.kind = a.kind AND r.external_id = a.external_id AND r.created_at >= ?2)`, &sqlitex.ExecOptions{
+		Args: []interface{}{opts.Since.Unix(), opts.RequestedSince.Unix(), opts.MinSize},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			c := &CleanupCandidate{
+				App:   stmt.ColumnText(0),
+				ID:    stmt.ColumnInt64(1),
+				Title: stmt.ColumnText(2),
+				Year:  stmt.ColumnInt64(3),
+				Size:  stmt.ColumnInt64(4),
+			}
+			c.Added, _ = time.ParseInLocation("2006-01-02", stmt.ColumnText(5), now.Location())
+			if stmt.ColumnType(6) != sqlite.TypeNull {
+				c.LastWatched = time.Unix(stmt.ColumnInt64(6), 0)
+			}
+			months := now.Sub(c.LastActive()).Hours() / (24 * 30)
+			c.Score = float64(c.Size) / (1 << 30) * math.Max(months, 0)
+			results = append(results, c)
+			return nil
+		},
+	})
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Title < results[j].Title
+	})
+	return results, err
+}
+
+// CleanupPlan returns the best cleanup.max_items candidates using the
+// cleanup config keys.
+func (srv *ArrServer) CleanupPlan(now time.Time) ([]*CleanupCandidate, error) {
+	months, err := srv.DB.ConfigInt("cleanup.unwatched_months")
+	if err != nil {
+		return nil, err
+	}
+	requestMonths, err := srv.DB.ConfigInt("cleanup.request_months")
+	if err != nil {
+		return nil, err
+	}
+	minGB, err := srv.DB.ConfigInt("cleanup.min_size_gb")
+	if err != nil {
+		return nil, err
+	}
+	limit, err := srv.DB.ConfigInt("cleanup.max_items")
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := srv.DB.CleanupCandidates(CleanupOptions{
+		Since:          now.AddDate(0, -int(months), 0),
+		RequestedSince: now.AddDate(0, -int(requestMonths), 0),
+		MinSize:        minGB << 30,
+	}, now)
+	if err != nil {
+		return nil, err
+	}
+	if limit >= 0 && int64(len(candidates)) > limit {
+		candidates = candidates[:limit]
+	}
+	return candidates, nil
+}
+
+// ClearCachedSeriesFiles marks the cached episodes of a series as
+// unmonitored without files, and has them synced again.
+func (d *DB) ClearCachedSeriesFiles(seriesID int64) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	doUpdate := func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+		err = sqlitex.Execute(conn, "UPDATE sonarr_episodes SET has_file = 0, monitored = 0, quality = NULL, size = NULL WHERE series_id = ?;", &sqlitex.ExecOptions{
+			Args: []interface{}{seriesID},
+		})
+		if err != nil {
+			return err
+		}
+		return sqlitex.Execute(conn, "DELETE FROM sonarr_episode_sync WHERE series_id = ?;", &sqlitex.ExecOptions{
+			Args: []interface{}{seriesID},
+		})
+	}
+	return doUpdate()
+}
+
+// cleanupMovie deletes the file of a movie and unmonitors it.
+func (srv *ArrServer) cleanupMovie(id int64) error {
+	r, err := srv.NewRadarr("")
+	if err != nil {
+		return err
+	}
+	movie, err := r.GetMovieByID(id)
+	if err != nil {
+		return err
+	}
+	movie.Monitored = false
+	if err := r.UpdateMovie(id, movie); err != nil {
+		return err
+	}
+	if movie.MovieFile != nil && movie.MovieFile.ID > 0 {
+		if _, err := r.Delete(context.TODO(), "v3/moviefile/"+strconv.FormatInt(movie.MovieFile.ID, 10), nil); err != nil {
+			return fmt.Errorf("api.Delete(moviefile): %w", err)
+		}
+	}
+	if movie, err = r.GetMovieByID(id); err != nil {
+		return err
+	}
+	return srv.DB.UpdateCachedMovie(movie)
+}
+
+// cleanupSeries deletes the episode files of a series and unmonitors it and
+// its seasons.
+func (srv *ArrServer) cleanupSeries(id int64) error {
+	sc, err := srv.NewSonarr("")
+	if err != nil {
+		return err
+	}
+	series, err := sc.GetSeriesByID(id)
+	if err != nil {
+		return err
+	}
+	series.Monitored = false
+	for _, s := range series.Seasons {
+		s.Monitored = false
+	}
+	if err := sc.UpdateSeries(id, series); err != nil {
+		return err
+	}
+	files, err := sc.GetSeriesEpisodeFiles(id)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := sc.DeleteEpisodeFile(f.ID); err != nil {
+			return err
+		}
+	}
+	if series, err = sc.GetSeriesByID(id); err != nil {
+		return err
+	}
+	if err := srv.DB.UpdateCachedSeries(series); err != nil {
+		return err
+	}
+	return srv.DB.ClearCachedSeriesFiles(id)
+}
+
+// Discord allows 5 buttons in a row and 5 rows in a message.
+const (
+	discordRowButtons   = 5
+	discordMessageRows  = 5
+	cleanupMessageItems = discordRowButtons * discordMessageRows
+)
+
+// CleanupButtons are the messages of buttons numbered like CleanupText, each
+// asks to confirm deleting the files of its item and unmonitoring it.
+func CleanupButtons(userID string, candidates []*CleanupCandidate) []*discordgo.MessageSend {
+	results := []*discordgo.MessageSend{}
+	for start := 0; start < len(candidates); start += cleanupMessageItems {
+		end := start + cleanupMessageItems
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		rows := []discordgo.MessageComponent{}
+		var row discordgo.ActionsRow
+		for i := start; i < end; i++ {
+			c := candidates[i]
+			a := &MediaAction{UserID: userID, App: c.App, Action: MediaCleanup, ID: c.ID, Season: -1}
+			row.Components = append(row.Components, discordgo.Button{Label: strconv.Itoa(i + 1), Style: discordgo.DangerButton, CustomID: a.AskID()})
+			if len(row.Components) == discordRowButtons || i == end-1 {
+				rows = append(rows, row)
+				row = discordgo.ActionsRow{}
+			}
+		}
+		results = append(results, &discordgo.MessageSend{
+			Content:    fmt.Sprintf("Clean up %d-%d:", start+1, end),
+			Components: rows,
+		})
+	}
+	return results
+}
+
+// HandleCleanup lists the cleanup candidates followed by numbered buttons
+// that ask to delete the files of an item and unmonitor it, only the admin
+// who asked may press them.  The cleanup works on the global instances so
+// it needs a global admin.
+func (srv *ArrServer) HandleCleanup(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if !srv.IsGlobalAdmin(m) {
+		s.ChannelMessageSend(m.ChannelID, "Only global admins can clean up media")
+		return
+	}
+	candidates, err := srv.CleanupPlan(time.Now())
+	if err != nil {
+		log.Error().Err(err).Msg("Planning cleanup failed")
+		s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+		return
+	}
+	for _, msg := range ChunkMessage(CleanupText(candidates), discordMessageLimit) {
+		s.ChannelMessageSend(m.ChannelID, msg)
+	}
+	for _, msg := range CleanupButtons(m.Author.ID, candidates) {
+		if _, err := s.ChannelMessageSendComplex(m.ChannelID, msg); err != nil {
+			log.Error().Err(err).Msg("Sending cleanup buttons failed")
+			return
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"golift.io/starr/radarr"
+	"golift.io/starr/sonarr"
+)
+
+func TestArrServer_CleanupPlan(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	added := time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC)
+	gib := int64(1 << 30)
+
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := &ArrServer{DB: db}
+
+	assert.NoError(t, db.CacheRadarr([]*radarr.Movie{
+		{ID: 1, Title: "Alien", Year: 1979, TmdbID: 348, SizeOnDisk: 40 * gib, Added: added},
+		{ID: 2, Title: "Heat", Year: 1995, TmdbID: 949, SizeOnDisk: 20 * gib, Added: added},
+		{ID: 3, Title: "Dune", Year: 2021, TmdbID: 438631, SizeOnDisk: 30 * gib, Added: added},
+		{ID: 4, Title: "Up", Year: 2009, TmdbID: 14160, SizeOnDisk: 10 * gib, Added: added},
+		{ID: 5, Title: "Short", Year: 2020, TmdbID: 5, SizeOnDisk: gib / 10, Added: added},
+		{ID: 6, Title: "Offline", Year: 2020, TmdbID: 6, SizeOnDisk: 90 * gib, Added: added},
+	}))
+	assert.NoError(t, db.CacheSonarr([]*sonarr.Series{
+		{ID: 1, Title: "The Wire", Year: 2002, TvdbID: 79126, Added: added, Statistics: &sonarr.Statistics{SizeOnDisk: 100 * gib}},
+		{ID: 2, Title: "Lost", Year: 2004, TvdbID: 73739, Added: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), Statistics: &sonarr.Statistics{SizeOnDisk: 50 * gib}},
+		{ID: 3, Title: "Severance", Year: 2022, TvdbID: 371980, Added: now.Add(-10 * day), Statistics: &sonarr.Statistics{SizeOnDisk: 10 * gib}},
+	}))
+	assert.NoError(t, db.CachePlexItems([]*PlexItem{
+		{RatingKey: "10", Type: "movie", Title: "Alien", TmdbID: 348},
+		{RatingKey: "11", Type: "movie", Title: "Heat", TmdbID: 949},
+		{RatingKey: "12", Type: "movie", Title: "Dune", TmdbID: 438631},
+		{RatingKey: "13", Type: "movie", Title: "Up", TmdbID: 14160},
+		{RatingKey: "14", Type: "movie", Title: "Short", TmdbID: 5},
+		{RatingKey: "20", Type: "show", Title: "The Wire", TvdbID: 79126},
+		{RatingKey: "21", Type: "show", Title: "Lost", TvdbID: 73739},
+		{RatingKey: "22", Type: "show", Title: "Severance", TvdbID: 371980},
+	}, "abc123"))
+	assert.NoError(t, db.RebuildPlexMap())
+	assert.NoError(t, db.RecordPlexHistory(map[int64]string{1: "jeremy"}, []*PlexPlay{
+		{HistoryKey: "1", AccountID: 1, RatingKey: "11", ItemKey: "11", Type: "movie", Title: "Heat", ViewedAt: now.Add(-400 * day)},
+		{HistoryKey: "2", AccountID: 1, RatingKey: "12", ItemKey: "12", Type: "movie", Title: "Dune", ViewedAt: now.Add(-10 * day)},
+		{HistoryKey: "3", AccountID: 1, RatingKey: "30", ItemKey: "20", Type: "episode", Title: "The Target", ShowTitle: "The Wire", ViewedAt: now.Add(-2 * day)},
+	}))
+	assert.NoError(t, db.RequestAdd(&MediaRequest{UserID: "42", Kind: QuotaKindMovie, Title: "Up", ExternalID: 14160, CreatedAt: now.Add(-30 * day)}))
+	assert.NoError(t, db.RequestAdd(&MediaRequest{UserID: "42", Kind: QuotaKindSeries, Title: "Lost", ExternalID: 73739, CreatedAt: now.AddDate(-1, 0, 0)}))
+
+	candidates, err := srv.CleanupPlan(now)
+	assert.NoError(t, err)
+	titles := []string{}
+	for _, c := range candidates {
+		titles = append(titles, c.Title)
+	}
+	assert.Equal(t, []string{"Alien", "Lost", "Heat"}, titles, "watched, requested, small, new and unmatched items are left out")
+	assert.Equal(t, "radarr: Heat (1995) id=2, 20.0 GiB, added 2019-01-02, last watched "+now.Add(-400*day).Format("2006-01-02"), candidates[2].String())
+	assert.Equal(t, "Cleanup candidates: 3, 110.0 GiB\n"+
+		"1. radarr: Alien (1979) id=1, 40.0 GiB, added 2019-01-02, never watched\n"+
+		"2. sonarr: Lost (2004) id=2, 50.0 GiB, added 2023-01-01, never watched\n"+
+		"3. "+candidates[2].String(), CleanupText(candidates))
+
+	assert.NoError(t, db.ConfigSet("cleanup.max_items", "1"))
+	assert.NoError(t, db.ConfigSet("cleanup.unwatched_months", "3"))
+	candidates, err = srv.CleanupPlan(now)
+	assert.NoError(t, err)
+	assert.Len(t, candidates, 1)
+	assert.Equal(t, "Alien", candidates[0].Title)
+	assert.Equal(t, "No cleanup candidates", CleanupText(nil))
+}
+
+func TestCleanupButtons(t *testing.T) {
+	candidates := []*CleanupCandidate{}
+	for i := 1; i <= 27; i++ {
+		candidates = append(candidates, &CleanupCandidate{App: "radarr", ID: int64(i)})
+	}
+	msgs := CleanupButtons("42", candidates)
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, "Clean up 1-25:", msgs[0].Content)
+	assert.Len(t, msgs[0].Components, 5)
+	for _, row := range msgs[0].Components {
+		assert.Len(t, row.(discordgo.ActionsRow).Components, 5)
+	}
+	assert.Equal(t, "Clean up 26-27:", msgs[1].Content)
+	assert.Len(t, msgs[1].Components, 1)
+	last := msgs[1].Components[0].(discordgo.ActionsRow).Components[1].(discordgo.Button)
+	assert.Equal(t, "27", last.Label)
+
+	a, err := ParseMediaActionID(last.CustomID)
+	assert.NoError(t, err)
+	assert.Equal(t, &MediaAction{UserID: "42", App: "radarr", Action: MediaCleanup, ID: 27, Season: -1}, a)
+	content, components := a.Prompt("Alien (1979)")
+	assert.Equal(t, "Confirm: delete the files of Alien (1979) and unmonitor it in radarr?", content)
+	buttons := components[0].(discordgo.ActionsRow).Components
+	assert.Equal(t, a.CustomID(), buttons[0].(discordgo.Button).CustomID, "the ask button leads to the confirm prompt")
+	assert.Equal(t, mediaCancelPrefix+"42", buttons[1].(discordgo.Button).CustomID)
+
+	assert.Empty(t, CleanupButtons("42", nil))
+}
+
+func TestArrServer_RunMediaAction_Cleanup(t *testing.T) {
+	movie := &radarr.Movie{ID: 3, Title: "Alien", Year: 1979, Monitored: true, HasFile: true, SizeOnDisk: 1 << 30, MovieFile: &radarr.MovieFile{ID: 9}}
+	series := &sonarr.Series{ID: 7, Title: "The Wire", Year: 2002, Monitored: true, Seasons: []*sonarr.Season{
+		{SeasonNumber: 1, Monitored: true},
+	}}
+	files := []*sonarr.EpisodeFile{{ID: 5, SeriesID: 7}, {ID: 6, SeriesID: 7}}
+	deleted := []string{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v3/movie/3":
+			json.NewEncoder(w).Encode(movie)
+		case "PUT /api/v3/movie/3":
+			json.NewDecoder(r.Body).Decode(movie)
+			json.NewEncoder(w).Encode(movie)
+		case "DELETE /api/v3/moviefile/9":
+			deleted = append(deleted, r.URL.Path)
+			movie.HasFile, movie.SizeOnDisk, movie.MovieFile = false, 0, nil
+		case "GET /api/v3/series/7":
+			json.NewEncoder(w).Encode(series)
+		case "PUT /api/v3/series/7":
+			json.NewDecoder(r.Body).Decode(series)
+			json.NewEncoder(w).Encode(series)
+		case "GET /api/v3/episodeFile":
+			assert.Equal(t, "7", r.URL.Query().Get("seriesId"))
+			json.NewEncoder(w).Encode(files)
+		case "DELETE /api/v3/episodeFile/5", "DELETE /api/v3/episodeFile/6":
+			deleted = append(deleted, r.URL.Path)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := &ArrServer{DB: db}
+	for _, app := range []string{"sonarr", "radarr"} {
+		assert.NoError(t, db.ConfigSet("starr."+app+".url", api.URL))
+		assert.NoError(t, db.ConfigSet("starr."+app+".token", "token"))
+	}
+	assert.NoError(t, db.CacheRadarr([]*radarr.Movie{movie}))
+	assert.NoError(t, db.CacheSonarr([]*sonarr.Series{series}))
+	assert.NoError(t, db.CacheSonarrEpisodes(7, "fingerprint", []*sonarr.Episode{
+		{ID: 1, SeasonNumber: 1, EpisodeNumber: 1, Monitored: true, HasFile: true, EpisodeFileID: 5},
+	}, files))
+
+	a, err := ParseMediaActionID((&MediaAction{UserID: "42", App: "radarr", Action: MediaCleanup, ID: 3, Season: -1}).CustomID())
+	assert.NoError(t, err)
+	assert.Equal(t, "delete the files of Alien (1979) and unmonitor it in radarr", a.Describe("Alien (1979)"))
+	assert.NoError(t, srv.RunMediaAction(a))
+	assert.False(t, movie.Monitored)
+	result, err := db.QueryReadOnly("SELECT monitored, size_on_disk FROM radarr WHERE id = 3", sqlTimeout, sqlMaxRows)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"0", "0"}}, result.Rows, "the cache is updated without a sync")
+
+	assert.NoError(t, srv.RunMediaAction(&MediaAction{App: "sonarr", Action: MediaCleanup, ID: 7, Season: -1}))
+	assert.False(t, series.Monitored)
+	assert.False(t, series.Seasons[0].Monitored)
+	assert.Equal(t, []string{"/api/v3/moviefile/9", "/api/v3/episodeFile/5", "/api/v3/episodeFile/6"}, deleted)
+	result, err = db.QueryReadOnly("SELECT has_file, monitored FROM sonarr_episodes WHERE series_id = 7", sqlTimeout, sqlMaxRows)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"0", "0"}}, result.Rows)
+}
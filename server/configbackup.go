@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// ConfigChange is one key an import would add or change.
+type ConfigChange struct {
+	Key    string
+	Old    string
+	New    string
+	Exists bool
+	// Missing is set for keys in the config table that the import does not
+	// have, they are left as is.
+	Missing bool
+}
+
+// String formats the change for a diff, secrets are masked.
+func (c ConfigChange) String() string {
+	if c.Missing {
+		return fmt.Sprintf("- %s=%s", c.Key, MaskSecret(c.Key, c.Old))
+	}
+	if !c.Exists {
+		return fmt.Sprintf("+ %s=%s", c.Key, MaskSecret(c.Key, c.New))
+	}
+	return fmt.Sprintf("~ %s=%s -> %s", c.Key, MaskSecret(c.Key, c.Old), MaskSecret(c.Key, c.New))
+}
+
+// ConfigExport returns every value stored in the config table with secrets
+// decrypted, or replaced by a mask when redact is set.  Values from the
+// environment or a config file are not part of the export.
+func (d *DB) ConfigExport(redact bool) (map[string]string, error) {
+	var err error
+	var s *sqlite.Stmt
+
+	// Get Conn
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	keys, err := d.RawConfigList(s, conn)
+	if err != nil {
+		return nil, err
+	}
+	results := map[string]string{}
+	for _, k := range keys {
+		_, v, err := d.RawConfigGet(s, conn, k)
+		if err != nil {
+			return nil, err
+		}
+		if redact {
+			results[k] = MaskSecret(k, v)
+			continue
+		}
+		if results[k], err = d.OpenSecret(k, v); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// MarshalConfig encodes an export as json or yaml.
+func MarshalConfig(values map[string]string, format string) ([]byte, error) {
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	case "yaml":
+		return yaml.Marshal(values)
+	}
+	return nil, fmt.Errorf("unknown config format %q, use json or yaml", format)
+}
+
+// ParseConfigImport reads an export, json is read as yaml.  Nested maps in
+// the layout of a --config-file are flattened the same way.  Every key is
+// checked against ConfigSchema, redacted secrets are dropped and returned
+// as their own sorted list.
+func ParseConfigImport(b []byte) (map[string]string, []string, error) {
+	doc := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, nil, err
+	}
+	results := map[string]string{}
+	redacted := []string{}
+	for k, v := range flattenConfig("", doc) {
+		if v == secretMask && IsSensitiveKey(k) {
+			redacted = append(redacted, k)
+			continue
+		}
+		if err := ValidateConfig(k, v); err != nil {
+			return nil, nil, err
+		}
+		results[k] = v
+	}
+	sort.Strings(redacted)
+	return results, redacted, nil
+}
+
+// ConfigDiff compares values with the config table and returns the keys that
+// would be added or changed, sorted by key.
+func (d *DB) ConfigDiff(values map[string]string) ([]ConfigChange, error) {
+	var err error
+	var s *sqlite.Stmt
+
+	// Get Conn
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	results := []ConfigChange{}
+	for k, v := range values {
+		found, old, err := d.configGetOpen(s, conn, k)
+		if err != nil {
+			return nil, err
+		}
+		if found && old == v {
+			continue
+		}
+		results = append(results, ConfigChange{Key: k, Old: old, New: v, Exists: found})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	return results, nil
+}
+
+// ConfigMissing returns the keys in the config table that are neither in
+// values nor redacted, sorted by key.  An import leaves them as is.
+func (d *DB) ConfigMissing(values map[string]string, redacted []string) ([]ConfigChange, error) {
+	var err error
+	var s *sqlite.Stmt
+
+	// Get Conn
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	skip := map[string]bool{}
+	for _, k := range redacted {
+		skip[k] = true
+	}
+	keys, err := d.RawConfigList(s, conn)
+	if err != nil {
+		return nil, err
+	}
+	results := []ConfigChange{}
+	for _, k := range keys {
+		if _, ok := values[k]; ok || skip[k] {
+			continue
+		}
+		_, old, err := d.configGetOpen(s, conn, k)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, ConfigChange{Key: k, Old: old, Exists: true, Missing: true})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	return results, nil
+}
+
+// ConfigImport applies changes in a single transaction, nothing is stored
+// if any of them fails.  Each change is recorded in config_history with
+// actor.
+func (d *DB) ConfigImport(actor string, changes []ConfigChange) (err error) {
+	var s *sqlite.Stmt
+
+	// Get Conn
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	defer sqlitex.Save(conn)(&err)
+	for _, c := range changes {
+		var v string
+		if v, err = d.SealSecret(c.Key, c.New); err != nil {
+			return err
+		}
+		if _, err = d.rawConfigRecord(s, conn, actor, c.Key, v, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
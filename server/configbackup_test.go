@@ -0,0 +1,75 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_ConfigExportImport(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	box, err := NewSecretBox(make([]byte, 32))
+	assert.NoError(t, err)
+	db.Secrets = box
+
+	assert.NoError(t, db.ConfigSet("plex.url", "http://old:32400"))
+	assert.NoError(t, db.ConfigSet("plex.token", "plex-secret"))
+	assert.NoError(t, db.ConfigSet(GuildKey("1234", "starr.radarr.url"), "http://guild:7878/"))
+
+	values, err := db.ConfigExport(false)
+	assert.NoError(t, err)
+	assert.Equal(t, "plex-secret", values["plex.token"], "export decrypts secrets")
+
+	redacted, err := db.ConfigExport(true)
+	assert.NoError(t, err)
+	assert.Equal(t, secretMask, redacted["plex.token"])
+	assert.Equal(t, "http://old:32400", redacted["plex.url"])
+
+	for _, format := range []string{"json", "yaml"} {
+		b, err := MarshalConfig(values, format)
+		assert.NoError(t, err)
+		parsed, redactedKeys, err := ParseConfigImport(b)
+		assert.NoError(t, err)
+		assert.Equal(t, values, parsed, "%s export round trips", format)
+		assert.Empty(t, redactedKeys)
+	}
+	_, err = MarshalConfig(values, "toml")
+	assert.Error(t, err)
+
+	parsed, redactedKeys, err := ParseConfigImport([]byte("plex.token: \"********\"\nplex.url: http://new:32400\nstarr:\n  sonarr:\n    url: http://sonarr:8989/\n"))
+	assert.NoError(t, err)
+	assert.NotContains(t, parsed, "plex.token", "redacted secrets are not imported")
+	assert.Equal(t, []string{"plex.token"}, redactedKeys)
+
+	missing, err := db.ConfigMissing(parsed, redactedKeys)
+	assert.NoError(t, err)
+	assert.Equal(t, []ConfigChange{
+		{Key: GuildKey("1234", "starr.radarr.url"), Old: "http://guild:7878/", Exists: true, Missing: true},
+	}, missing, "redacted secrets are not missing")
+	assert.Equal(t, "- guild:1234:starr.radarr.url=http://guild:7878/", missing[0].String())
+
+	changes, err := db.ConfigDiff(parsed)
+	assert.NoError(t, err)
+	assert.Equal(t, []ConfigChange{
+		{Key: "plex.url", Old: "http://old:32400", New: "http://new:32400", Exists: true},
+		{Key: "starr.sonarr.url", New: "http://sonarr:8989/"},
+	}, changes)
+	assert.Equal(t, "~ plex.url=http://old:32400 -> http://new:32400", changes[0].String())
+
+	assert.NoError(t, db.ConfigImport(CLIActor(), changes))
+	changes, err = db.ConfigDiff(parsed)
+	assert.NoError(t, err)
+	assert.Empty(t, changes, "nothing left to import")
+
+	found, v, err := db.ConfigGet("plex.token")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "plex-secret", v)
+
+	_, _, err = ParseConfigImport([]byte("plex.ulr: http://new:32400\n"))
+	assert.ErrorContains(t, err, "unknown config key")
+}
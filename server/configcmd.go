@@ -0,0 +1,165 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+)
+
+const configUsage = "usage: !config list | !config get <key> | !config set <key> <value> | !config delete <key>"
+
+// discordMessageLimit is the longest message discord accepts.
+const discordMessageLimit = 2000
+
+// HandleConfig lets admins manage config from discord.  In a guild channel it
+// works on the overrides of that guild, in a direct message on the global
+// keys.  Replies are sent as a direct message with secrets masked, and a
+// message setting a secret in a guild channel is deleted.
+func (srv *ArrServer) HandleConfig(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if !srv.IsAdmin(m) {
+		s.ChannelMessageSend(m.ChannelID, "Only admins can manage config")
+		return
+	}
+	args := strings.Fields(strings.TrimPrefix(m.Content, "!config"))
+
+	reply, err := srv.ConfigCommand(m.GuildID, DiscordActor(m.Author.ID), args)
+	if err != nil {
+		log.Warn().Err(err).Str("user", m.Author.ID).Msg("Problem with config command")
+		reply = "Error: " + err.Error()
+	}
+
+	if m.GuildID != "" && len(args) > 1 && args[0] == "set" && IsSensitiveKey(args[1]) {
+		if err := s.ChannelMessageDelete(m.ChannelID, m.ID); err != nil {
+			log.Warn().Err(err).Str("channel", m.ChannelID).Msg("Deleting config message with a secret failed")
+		}
+	}
+
+	dm, err := s.UserChannelCreate(m.Author.ID)
+	if err != nil {
+		log.Error().Err(err).Str("user", m.Author.ID).Msg("Opening direct message failed")
+		return
+	}
+	for _, msg := range ChunkMessage(reply, discordMessageLimit) {
+		if _, err := s.ChannelMessageSend(dm.ID, msg); err != nil {
+			log.Error().Err(err).Str("user", m.Author.ID).Msg("Sending config reply failed")
+			return
+		}
+	}
+	if m.GuildID != "" {
+		s.MessageReactionAdd(m.ChannelID, m.ID, "✅")
+	}
+}
+
+// ConfigCommand runs a !config command for a guild, an empty guildID works on
+// the global keys, and returns the reply.
+func (srv *ArrServer) ConfigCommand(guildID, actor string, args []string) (string, error) {
+	if len(args) == 0 {
+		return configUsage, nil
+	}
+	key := func(k string) string {
+		if guildID == "" {
+			return k
+		}
+		return GuildKey(guildID, k)
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		return srv.configListReply(guildID)
+	case args[0] == "get" && len(args) == 2:
+		// Keys without a guild override resolve to the global value
+		if _, err := LookupConfigKey(args[1]); err != nil {
+			return "", err
+		}
+		found, v, source, err := srv.DB.ConfigResolve(guildID, args[1])
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return args[1] + " is not set", nil
+		}
+		return fmt.Sprintf("%s=%s (%s)", args[1], MaskSecret(args[1], v), source), nil
+	case args[0] == "set" && len(args) >= 3:
+		v := strings.Join(args[2:], " ")
+		if err := srv.DB.ConfigSetAs(actor, key(args[1]), v); err != nil {
+			return "", err
+		}
+		reply := fmt.Sprintf("%s set to %s", key(args[1]), MaskSecret(args[1], v))
+		if found, _, source := srv.DB.Overlay.Get(key(args[1])); found {
+			reply += fmt.Sprintf(", it is overridden by %s", srv.DB.Overlay.DescribeSource(key(args[1]), source))
+		}
+		return reply, nil
+	case args[0] == "delete" && len(args) == 2:
+		if _, err := LookupConfigKey(key(args[1])); err != nil {
+			return "", err
+		}
+		if err := srv.DB.ConfigDeleteAs(actor, key(args[1])); err != nil {
+			return "", err
+		}
+		return key(args[1]) + " deleted", nil
+	}
+	return configUsage, nil
+}
+
+// configListReply lists the overrides of a guild, or the global keys when
+// guildID is empty.
+func (srv *ArrServer) configListReply(guildID string) (string, error) {
+	keys, err := srv.DB.ConfigList()
+	if err != nil {
+		return "", err
+	}
+	prefix := GuildKey(guildID, "")
+	lines := []string{}
+	for _, k := range keys {
+		if guildID == "" && BaseKey(k) != k {
+			continue
+		}
+		if guildID != "" && !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		_, v, err := srv.DB.ConfigGet(k)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, fmt.Sprintf("%s=%s", strings.TrimPrefix(k, prefix), MaskSecret(k, v)))
+	}
+	if len(lines) == 0 {
+		if guildID != "" {
+			return "No config overrides for this guild", nil
+		}
+		return "No config set", nil
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n"), nil
+}
+
+// ChunkMessage splits text on line breaks into messages no longer than max,
+// single lines longer than max are cut.
+func ChunkMessage(text string, max int) []string {
+	results := []string{}
+	var b strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		for len(line) > max {
+			if b.Len() > 0 {
+				results = append(results, b.String())
+				b.Reset()
+			}
+			results = append(results, line[:max])
+			line = line[max:]
+		}
+		if b.Len() > 0 && b.Len()+1+len(line) > max {
+			results = append(results, b.String())
+			b.Reset()
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(line)
+	}
+	if b.Len() > 0 {
+		results = append(results, b.String())
+	}
+	return results
+}
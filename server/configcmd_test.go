@@ -0,0 +1,74 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArrServer_ConfigCommand(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := &ArrServer{DB: db}
+	actor := DiscordActor("42")
+
+	reply, err := srv.ConfigCommand("", actor, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, configUsage, reply)
+
+	reply, err = srv.ConfigCommand("", actor, []string{"set", "plex.token", "secret-token"})
+	assert.NoError(t, err)
+	assert.Equal(t, "plex.token set to "+secretMask, reply)
+
+	_, err = srv.ConfigCommand("", actor, []string{"set", "starr.radarr.url", "http://global:7878/"})
+	assert.NoError(t, err)
+	_, err = srv.ConfigCommand("1234", actor, []string{"set", "starr.radarr.url", "http://guild:7878/"})
+	assert.NoError(t, err)
+	_, err = srv.ConfigCommand("1234", actor, []string{"set", "plex.token", "guild-token"})
+	assert.ErrorContains(t, err, "can not be overridden per guild", "guilds can only set guild keys")
+
+	reply, err = srv.ConfigCommand("", actor, []string{"get", "plex.token"})
+	assert.NoError(t, err)
+	assert.Equal(t, "plex.token="+secretMask+" (db)", reply)
+
+	reply, err = srv.ConfigCommand("1234", actor, []string{"get", "starr.radarr.url"})
+	assert.NoError(t, err)
+	assert.Equal(t, "starr.radarr.url=http://guild:7878/ (db)", reply)
+
+	reply, err = srv.ConfigCommand("1234", actor, []string{"get", "plex.token"})
+	assert.NoError(t, err)
+	assert.Equal(t, "plex.token="+secretMask+" (db)", reply, "guilds can read global only keys")
+	_, err = srv.ConfigCommand("1234", actor, []string{"delete", "plex.token"})
+	assert.ErrorContains(t, err, "can not be overridden per guild")
+
+	reply, err = srv.ConfigCommand("", actor, []string{"list"})
+	assert.NoError(t, err)
+	assert.Equal(t, "plex.token="+secretMask+"\nstarr.radarr.url=http://global:7878/", reply, "global list skips guild overrides")
+
+	reply, err = srv.ConfigCommand("1234", actor, []string{"list"})
+	assert.NoError(t, err)
+	assert.Equal(t, "starr.radarr.url=http://guild:7878/", reply)
+
+	reply, err = srv.ConfigCommand("1234", actor, []string{"delete", "starr.radarr.url"})
+	assert.NoError(t, err)
+	assert.Equal(t, GuildKey("1234", "starr.radarr.url")+" deleted", reply)
+	reply, err = srv.ConfigCommand("1234", actor, []string{"list"})
+	assert.NoError(t, err)
+	assert.Equal(t, "No config overrides for this guild", reply)
+
+	history, err := db.ConfigHistoryList("", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "discord:42", history[0].Actor, "changes are recorded with the discord user")
+}
+
+func TestChunkMessage(t *testing.T) {
+	assert.Equal(t, []string{"a\nb"}, ChunkMessage("a\nb", 10))
+	assert.Equal(t, []string{"aaaa", "bbbb"}, ChunkMessage("aaaa\nbbbb", 6))
+	assert.Equal(t, []string{"aaaa", "aa\nb"}, ChunkMessage("aaaaaa\nb", 4), "long lines are cut")
+	for _, msg := range ChunkMessage(strings.Repeat("line\n", 1000), discordMessageLimit) {
+		assert.LessOrEqual(t, len(msg), discordMessageLimit)
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// ConfigHistory is one change recorded in config_history.  Values are kept
+// as stored so secrets stay encrypted, OldSet and NewSet are false when the
+// key did not exist before or was deleted.
+type ConfigHistory struct {
+	ID     int64
+	Key    string
+	Old    string
+	OldSet bool
+	New    string
+	NewSet bool
+	Actor  string
+	At     time.Time
+}
+
+// String formats the change for display, secrets are masked.
+func (h *ConfigHistory) String() string {
+	show := func(v string, set bool) string {
+		if !set {
+			return "(unset)"
+		}
+		return MaskSecret(h.Key, v)
+	}
+	return fmt.Sprintf("%d %s %s %s: %s -> %s", h.ID, h.At.Format(time.RFC3339), h.Actor, h.Key, show(h.Old, h.OldSet), show(h.New, h.NewSet))
+}
+
+// CLIActor is the actor recorded for changes made with the arrmate command.
+func CLIActor() string {
+	if u, err := user.Current(); err == nil {
+		return "cli:" + u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return "cli:" + name
+	}
+	return "cli"
+}
+
+// DiscordActor is the actor recorded for changes made by a discord user.
+func DiscordActor(userID string) string {
+	return "discord:" + userID
+}
+
+// nullable binds an unset value as NULL.
+func nullable(v string, set bool) interface{} {
+	if !set {
+		return nil
+	}
+	return v
+}
+
+// rawConfigRecord stores k as v, or deletes it when set is false, and adds
+// the change to config_history returning its id.  Deleting a missing key is
+// not recorded and returns 0.  Callers provide the transaction.
+func (d *DB) rawConfigRecord(s *sqlite.Stmt, conn *sqlite.Conn, actor, k, v string, set bool) (int64, error) {
+	found, old, err := d.RawConfigGet(s, conn, k)
+	if err != nil {
+		return 0, err
+	}
+	if !found && !set {
+		return 0, nil
+	}
+	if set {
+		err = d.RawConfigSet(s, conn, k, v)
+	} else {
+		err = d.RawConfigDelete(s, conn, k)
+	}
+	if err != nil {
+		return 0, err
+	}
+	err = sqlitex.Execute(conn, `INSERT INTO config_history (key, old_value, new_value, actor, created_at) VALUES (?, ?, ?, ?, ?)`,
+		&sqlitex.ExecOptions{
+			Args: []interface{}{k, nullable(old, found), nullable(v, set), actor, time.Now().Unix()},
+		})
+	if err != nil {
+		return 0, fmt.Errorf("recording config history errored: %w", err)
+	}
+	return conn.LastInsertRowID(), nil
+}
+
+// ConfigHistoryList returns the changes to k, or every key when k is empty,
+// newest first.
+func (d *DB) ConfigHistoryList(k string, limit int) ([]*ConfigHistory, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	results := []*ConfigHistory{}
+	err = sqlitex.Execute(conn, `SELECT id, key, old_value, new_value, actor, created_at FROM config_history
+		WHERE ? = '' OR key = ? ORDER BY id DESC LIMIT ?`, &sqlitex.ExecOptions{
+		Args: []interface{}{k, k, limit},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			results = append(results, scanConfigHistory(stmt))
+			return nil
+		},
+	})
+	return results, err
+}
+
+func scanConfigHistory(stmt *sqlite.Stmt) *ConfigHistory {
+	return &ConfigHistory{
+		ID:     stmt.ColumnInt64(0),
+		Key:    stmt.ColumnText(1),
+		Old:    stmt.ColumnText(2),
+		OldSet: stmt.ColumnType(2) != sqlite.TypeNull,
+		New:    stmt.ColumnText(3),
+		NewSet: stmt.ColumnType(3) != sqlite.TypeNull,
+		Actor:  stmt.ColumnText(4),
+		At:     time.Unix(stmt.ColumnInt64(5), 0),
+	}
+}
+
+// ConfigRollback undoes the last change to k.  With a non zero toID the key
+// is restored to the value it had after that change instead.  The rollback
+// is recorded as a change by actor and returned, it is nil when the key was
+// already unset.
+func (d *DB) ConfigRollback(actor, k string, toID int64) (h *ConfigHistory, err error) {
+	var s *sqlite.Stmt
+
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	defer sqlitex.Save(conn)(&err)
+	query := `SELECT id, key, old_value, new_value, actor, created_at FROM config_history WHERE key = ? ORDER BY id DESC LIMIT 1`
+	args := []interface{}{k}
+	if toID != 0 {
+		query = `SELECT id, key, old_value, new_value, actor, created_at FROM config_history WHERE key = ? AND id = ?`
+		args = append(args, toID)
+	}
+	var target *ConfigHistory
+	err = sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			target = scanConfigHistory(stmt)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if target == nil {
+		if toID != 0 {
+			return nil, fmt.Errorf("no config history %d for %s", toID, k)
+		}
+		return nil, fmt.Errorf("no config history for %s", k)
+	}
+
+	v, set := target.Old, target.OldSet
+	if toID != 0 {
+		v, set = target.New, target.NewSet
+	}
+	// History written before a secret key was configured holds plaintext
+	if set && !IsEncrypted(v) {
+		if v, err = d.SealSecret(k, v); err != nil {
+			return nil, err
+		}
+	}
+	id, err := d.rawConfigRecord(s, conn, actor, k, v, set)
+	if err != nil || id == 0 {
+		return nil, err
+	}
+	err = sqlitex.Execute(conn, `SELECT id, key, old_value, new_value, actor, created_at FROM config_history WHERE id = ?`, &sqlitex.ExecOptions{
+		Args: []interface{}{id},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			h = scanConfigHistory(stmt)
+			return nil
+		},
+	})
+	return h, err
+}
+
+// ConfigHistoryLatest returns the id of the newest change, 0 when there is
+// no history yet.
+func (d *DB) ConfigHistoryLatest() (int64, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return 0, err
+	}
+	defer d.Pool.Put(conn)
+
+	var id int64
+	err = sqlitex.Execute(conn, `SELECT coalesce(max(id), 0) FROM config_history`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			id = stmt.ColumnInt64(0)
+			return nil
+		},
+	})
+	return id, err
+}
+
+// ConfigChangedSince returns the keys changed after the history id since and
+// the id of the newest change.
+func (d *DB) ConfigChangedSince(since int64) ([]string, int64, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, since, err
+	}
+	defer d.Pool.Put(conn)
+
+	keys := []string{}
+	latest := since
+	err = sqlitex.Execute(conn, `SELECT key, max(id) FROM config_history WHERE id > ? GROUP BY key ORDER BY key`, &sqlitex.ExecOptions{
+		Args: []interface{}{since},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			keys = append(keys, stmt.ColumnText(0))
+			if id := stmt.ColumnInt64(1); id > latest {
+				latest = id
+			}
+			return nil
+		},
+	})
+	return keys, latest, err
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_ConfigHistory(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.ConfigSetAs("cli:tester", "plex.url", "http://one:32400"))
+	assert.NoError(t, db.ConfigSetAs(DiscordActor("42"), "plex.url", "http://two:32400"))
+	assert.NoError(t, db.ConfigSetAs("cli:tester", "starr.radarr.url", "http://radarr:7878/"))
+	assert.NoError(t, db.ConfigDeleteAs("cli:tester", "plex.url"))
+	assert.NoError(t, db.ConfigDeleteAs("cli:tester", "plex.url"), "deleting a missing key is not an error")
+
+	history, err := db.ConfigHistoryList("plex.url", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 3, "deleting a missing key is not recorded") {
+		assert.False(t, history[0].NewSet, "newest first, the delete")
+		assert.Equal(t, "http://two:32400", history[0].Old)
+		assert.Equal(t, "discord:42", history[1].Actor)
+		assert.Equal(t, "http://one:32400", history[1].Old)
+		assert.False(t, history[2].OldSet, "first set created the key")
+	}
+	all, err := db.ConfigHistoryList("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, all, 4)
+
+	h, err := db.ConfigRollback("cli:tester", "plex.url", 0)
+	assert.NoError(t, err)
+	if assert.NotNil(t, h) {
+		assert.Equal(t, "http://two:32400", h.New, "undoing the delete restores the last value")
+	}
+	_, v, err := db.ConfigGet("plex.url")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://two:32400", v)
+
+	_, err = db.ConfigRollback("cli:tester", "plex.url", history[2].ID)
+	assert.NoError(t, err)
+	_, v, err = db.ConfigGet("plex.url")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://one:32400", v, "--to restores the value set by that change")
+
+	_, err = db.ConfigRollback("cli:tester", "plex.url", all[0].ID+100)
+	assert.ErrorContains(t, err, "no config history")
+	_, err = db.ConfigRollback("cli:tester", "plex.token", 0)
+	assert.ErrorContains(t, err, "no config history")
+
+	_, err = db.ConfigRollback("cli:tester", "starr.radarr.url", 0)
+	assert.NoError(t, err)
+	found, _, err := db.ConfigGet("starr.radarr.url")
+	assert.NoError(t, err)
+	assert.False(t, found, "undoing the first set removes the key")
+}
+
+func TestDB_ConfigHistory_Secrets(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	box, err := NewSecretBox(make([]byte, 32))
+	assert.NoError(t, err)
+	db.Secrets = box
+
+	assert.NoError(t, db.ConfigSet("plex.token", "first-secret"))
+	assert.NoError(t, db.ConfigSet("plex.token", "second-secret"))
+
+	history, err := db.ConfigHistoryList("plex.token", 10)
+	assert.NoError(t, err)
+	assert.True(t, IsEncrypted(history[0].New), "history keeps secrets encrypted")
+	assert.NotContains(t, history[0].String(), "second-secret")
+
+	_, err = db.ConfigRollback("cli:tester", "plex.token", 0)
+	assert.NoError(t, err)
+	_, v, err := db.ConfigGet("plex.token")
+	assert.NoError(t, err)
+	assert.Equal(t, "first-secret", v)
+}
+
+func TestDB_ConfigHistory_Plaintext_Secrets(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// Written before a secret key was configured
+	db.Secrets = nil
+	assert.NoError(t, db.ConfigSet("plex.token", "first-secret"))
+	assert.NoError(t, db.ConfigSet("plex.token", "second-secret"))
+
+	box, err := NewSecretBox(make([]byte, 32))
+	assert.NoError(t, err)
+	db.Secrets = box
+
+	// A rollback seals the plaintext value it restores
+	_, err = db.ConfigRollback("cli:tester", "plex.token", 0)
+	assert.NoError(t, err)
+	conn, err := db.Get(context.TODO())
+	assert.NoError(t, err)
+	_, raw, err := db.RawConfigGet(nil, conn, "plex.token")
+	db.Put(conn)
+	assert.NoError(t, err)
+	assert.True(t, IsEncrypted(raw), "rollback stores secrets encrypted")
+
+	changed, err := db.EncryptSecrets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"plex.token"}, changed, "history is encrypted too")
+
+	history, err := db.ConfigHistoryList("plex.token", 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 3)
+	for _, h := range history {
+		if h.OldSet {
+			assert.True(t, IsEncrypted(h.Old), h.String())
+		}
+		assert.True(t, IsEncrypted(h.New), h.String())
+	}
+	assert.False(t, history[2].OldSet, "unset values stay unset")
+
+	changed, err = db.EncryptSecrets()
+	assert.NoError(t, err)
+	assert.Empty(t, changed)
+	_, v, err := db.ConfigGet("plex.token")
+	assert.NoError(t, err)
+	assert.Equal(t, "first-secret", v)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ConfigFileEnv names an optional YAML or TOML config file layered over the
+// database.
+const ConfigFileEnv = "ARRMATE_CONFIG_FILE"
+
+// Sources a config value can come from, in order of precedence.
+const (
+	ConfigSourceEnv     = "env"
+	ConfigSourceFile    = "file"
+	ConfigSourceDB      = "db"
+	ConfigSourceDefault = "default"
+)
+
+// ConfigOverlay holds config from ARRMATE_* environment variables and a config
+// file, both win over the values stored in the database.
+type ConfigOverlay struct {
+	Env      map[string]string
+	File     map[string]string
+	FilePath string
+}
+
+// EnvName is the environment variable that overrides k, for example
+// starr.sonarr.url is ARRMATE_STARR_SONARR_URL and guild:1234:starr.radarr.url
+// is ARRMATE_GUILD_1234_STARR_RADARR_URL.
+func EnvName(k string) string {
+	base := BaseKey(k)
+	name := strings.ToUpper(strings.ReplaceAll(base, ".", "_"))
+	if base != k {
+		guildID := strings.TrimSuffix(strings.TrimPrefix(k, "guild:"), ":"+base)
+		return "ARRMATE_GUILD_" + guildID + "_" + name
+	}
+	return "ARRMATE_" + name
+}
+
+// LoadConfigOverlay reads the known keys from environ and the config file at
+// path, an empty path skips the file.  Files ending in .toml are read as TOML,
+// anything else as YAML.  Values are validated against
+// ConfigSchema and unknown keys in the file are an error.  ARRMATE_*
+// variables that are not config keys, like ARRMATE_SECRET_KEY, are ignored.
+func LoadConfigOverlay(environ []string, path string) (*ConfigOverlay, error) {
+	envKeys := map[string]string{}
+	for _, ck := range ConfigSchema {
+		envKeys[EnvName(ck.Key)] = ck.Key
+	}
+
+	co := &ConfigOverlay{
+		Env:      map[string]string{},
+		File:     map[string]string{},
+		FilePath: path,
+	}
+	for _, kv := range environ {
+		name, v, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(name, "ARRMATE_") {
+			continue
+		}
+		k, ok := envKeys[name]
+		if !ok && strings.HasPrefix(name, "ARRMATE_GUILD_") {
+			guildID, rest, _ := strings.Cut(strings.TrimPrefix(name, "ARRMATE_GUILD_"), "_")
+			if base, found := envKeys["ARRMATE_"+rest]; found {
+				k, ok = GuildKey(guildID, base), true
+			}
+		}
+		if !ok {
+			continue
+		}
+		if err := ValidateConfig(k, v); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		co.Env[k] = v
+	}
+
+	if path == "" {
+		return co, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(b, &doc)
+	} else {
+		err = yaml.Unmarshal(b, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for k, v := range flattenConfig("", doc) {
+		if err := ValidateConfig(k, v); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		co.File[k] = v
+	}
+	return co, nil
+}
+
+// flattenConfig turns nested maps into dotted keys, the top level guild map
+// is turned into guild:<id>:key overrides and lists are comma joined.
+func flattenConfig(prefix string, doc map[string]interface{}) map[string]string {
+	results := map[string]string{}
+	for k, v := range doc {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		switch val := v.(type) {
+		case map[string]interface{}:
+			if prefix == "" && k == "guild" {
+				for guildID, gv := range val {
+					if gm, ok := gv.(map[string]interface{}); ok {
+						for gk, gval := range flattenConfig("", gm) {
+							results[GuildKey(guildID, gk)] = gval
+						}
+					}
+				}
+				continue
+			}
+			for fk, fv := range flattenConfig(key, val) {
+				results[fk] = fv
+			}
+		case []interface{}:
+			items := make([]string, len(val))
+			for i, item := range val {
+				items[i] = fmt.Sprint(item)
+			}
+			results[key] = strings.Join(items, ",")
+		default:
+			results[key] = fmt.Sprint(val)
+		}
+	}
+	return results
+}
+
+// Get returns the overlay value of k and where it came from.  A nil overlay
+// has no values.
+func (co *ConfigOverlay) Get(k string) (bool, string, string) {
+	if co == nil {
+		return false, "", ""
+	}
+	if v, ok := co.Env[k]; ok {
+		return true, v, ConfigSourceEnv
+	}
+	if v, ok := co.File[k]; ok {
+		return true, v, ConfigSourceFile
+	}
+	return false, "", ""
+}
+
+// Keys returns every key set by the overlay.
+func (co *ConfigOverlay) Keys() []string {
+	results := []string{}
+	if co == nil {
+		return results
+	}
+	for k := range co.Env {
+		results = append(results, k)
+	}
+	for k := range co.File {
+		if _, ok := co.Env[k]; !ok {
+			results = append(results, k)
+		}
+	}
+	sort.Strings(results)
+	return results
+}
+
+// DescribeSource explains a source for config list --sources.
+func (co *ConfigOverlay) DescribeSource(k, source string) string {
+	switch source {
+	case ConfigSourceEnv:
+		return "env " + EnvName(k)
+	case ConfigSourceFile:
+		if co != nil {
+			return "file " + co.FilePath
+		}
+	}
+	return source
+}
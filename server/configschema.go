@@ -0,0 +1,261 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigType is how the value of a config key is validated.
+type ConfigType string
+
+const (
+	ConfigTypeString   ConfigType = "string"
+	ConfigTypeURL      ConfigType = "url"
+	ConfigTypeToken    ConfigType = "token"
+	ConfigTypeDuration ConfigType = "duration"
+	ConfigTypeInt      ConfigType = "int"
+	ConfigTypeBool     ConfigType = "bool"
+	ConfigTypeChannel  ConfigType = "channel id"
+	ConfigTypeIDList   ConfigType = "id list"
+)
+
+// ConfigKey describes a known key of the config store.
+type ConfigKey struct {
+	Key         string
+	Type        ConfigType
+	Description string
+	Default     string
+	// Guild keys may be overridden per guild with guild:<id>:key.
+	Guild bool
+}
+
+// Validate checks v against the type of the key.
+func (ck *ConfigKey) Validate(v string) error {
+	if err := validateConfigType(ck.Type, v); err != nil {
+		return fmt.Errorf("config %s: %w", ck.Key, err)
+	}
+	return nil
+}
+
+func validateConfigType(t ConfigType, v string) error {
+	switch t {
+	case ConfigTypeString:
+		return nil
+	case ConfigTypeURL:
+		u, err := url.Parse(v)
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%q is not a http(s) url", v)
+		}
+	case ConfigTypeToken:
+		if v == "" || strings.ContainsAny(v, " \t\r\n") {
+			return fmt.Errorf("tokens can not be empty or contain whitespace")
+		}
+	case ConfigTypeDuration:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like 30s, 5m or 2h", v)
+		}
+		if d <= 0 {
+			return fmt.Errorf("duration must be positive")
+		}
+	case ConfigTypeInt:
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			return fmt.Errorf("%q is not an integer", v)
+		}
+	case ConfigTypeBool:
+		if _, err := strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("%q is not true or false", v)
+		}
+	case ConfigTypeChannel:
+		return validateSnowflake(v)
+	case ConfigTypeIDList:
+		for _, id := range strings.Split(v, ",") {
+			if err := validateSnowflake(strings.TrimSpace(id)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown config type %q", t)
+	}
+	return nil
+}
+
+// validateSnowflake checks for a discord id, channel mentions are not
+// accepted so the stored value is always the bare id.
+func validateSnowflake(v string) error {
+	if _, err := strconv.ParseUint(v, 10, 64); err != nil {
+		return fmt.Errorf("%q is not a discord id", v)
+	}
+	return nil
+}
+
+// ConfigSchema is every key the config store knows about.
+var ConfigSchema = map[string]*ConfigKey{}
+
+// RegisterConfigKey adds a key to ConfigSchema, registering a key twice or
+// with an invalid default panics.
+func RegisterConfigKey(ck *ConfigKey) {
+	if _, ok := ConfigSchema[ck.Key]; ok {
+		panic("config key registered twice: " + ck.Key)
+	}
+	if ck.Default != "" {
+		if err := ck.Validate(ck.Default); err != nil {
+			panic(err)
+		}
+	}
+	ConfigSchema[ck.Key] = ck
+}
+
+func init() {
+	for _, ck := range []*ConfigKey{
+		{Key: "discord.token", Type: ConfigTypeToken, Description: "Discord bot token"},
+		{Key: "discord.admin.users", Type: ConfigTypeIDList, Description: "Comma separated discord user ids of admins", Guild: true},
+		{Key: "discord.admin.roles", Type: ConfigTypeIDList, Description: "Comma separated discord role ids of admins", Guild: true},
+		{Key: "plex.url", Type: ConfigTypeURL, Description: "Plex server url, e.g. http://192.168.1.5:32400"},
+		{Key: "plex.token", Type: ConfigTypeToken, Description: "Plex auth token"},
+		{Key: "plex.scan_interval", Type: ConfigTypeDuration, Default: "1h", Description: "How often plex libraries are scanned to match them with radarr and sonarr"},
+		{Key: "plex.history_interval", Type: ConfigTypeDuration, Default: "1h", Description: "How often plex play history is read"},
+		{Key: "starr.sync_interval", Type: ConfigTypeDuration, Default: "5m", Description: "How often the radarr and sonarr caches are refreshed"},
+		{Key: "config.reload_interval", Type: ConfigTypeDuration, Default: "10s", Description: "How often the server checks for config changes"},
+		{Key: "disk.check_interval", Type: ConfigTypeDuration, Default: "15m", Description: "How often sonarr and radarr disk space is sampled"},
+		{Key: "disk.min_free_gb", Type: ConfigTypeInt, Default: "50", Description: "Alert when a disk has less free space than this many GiB"},
+		{Key: "disk.fill_days", Type: ConfigTypeInt, Default: "7", Description: "Alert when a disk is trending to fill within this many days"},
+		{Key: "disk.alert_channel", Type: ConfigTypeChannel, Description: "Discord channel disk space alerts are sent to, no alerts when unset"},
+		{Key: "disk.alert_interval", Type: ConfigTypeDuration, Default: "24h", Description: "How long before the same disk alert is repeated"},
+		{Key: "disk.retention", Type: ConfigTypeDuration, Default: "720h", Description: "How long disk space samples are kept"},
+		{Key: "health.check_interval", Type: ConfigTypeDuration, Default: "5m", Description: "How often sonarr and radarr health is checked"},
+		{Key: "cleanup.unwatched_months", Type: ConfigTypeInt, Default: "6", Description: "Cleanup candidates were not added or watched for this many months"},
+		{Key: "cleanup.request_months", Type: ConfigTypeInt, Default: "3", Description: "Cleanup candidates were not requested for this many months"},
+		{Key: "cleanup.min_size_gb", Type: ConfigTypeInt, Default: "1", Description: "Cleanup candidates use at least this many GiB"},
+		{Key: "cleanup.max_items", Type: ConfigTypeInt, Default: "10", Description: "How many cleanup candidates !cleanup and arrmate cleanup plan list"},
+		{Key: "health.alert_channel", Type: ConfigTypeChannel, Description: "Discord channel health warnings and recoveries are sent to, no alerts when unset"},
+	} {
+		RegisterConfigKey(ck)
+	}
+	for _, app := range []string{"sonarr", "radarr"} {
+		RegisterConfigKey(&ConfigKey{Key: "starr." + app + ".url", Type: ConfigTypeURL, Guild: true, Description: app + " url, e.g. http://192.168.1.5:8989/"})
+		RegisterConfigKey(&ConfigKey{Key: "starr." + app + ".token", Type: ConfigTypeToken, Guild: true, Description: app + " api key"})
+		RegisterConfigKey(&ConfigKey{Key: "starr." + app + ".root_folder", Type: ConfigTypeString, Guild: true, Description: "Root folder new " + app + " items are added to, defaults to the first one " + app + " reports"})
+		RegisterConfigKey(&ConfigKey{Key: "starr." + app + ".quality_profile", Type: ConfigTypeInt, Guild: true, Description: "Quality profile id new " + app + " items are added with, defaults to the first one " + app + " reports"})
+	}
+	RegisterConfigKey(&ConfigKey{Key: "starr.sonarr.language_profile", Type: ConfigTypeInt, Guild: true, Description: "Language profile id new series are added with, defaults to the first one sonarr reports"})
+}
+
+// ConfigKeys returns the registered keys sorted by name.
+func ConfigKeys() []*ConfigKey {
+	results := make([]*ConfigKey, 0, len(ConfigSchema))
+	for _, ck := range ConfigSchema {
+		results = append(results, ck)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	return results
+}
+
+// LookupConfigKey finds the schema of k, guild overrides resolve to the key
+// they override.
+func LookupConfigKey(k string) (*ConfigKey, error) {
+	base := BaseKey(k)
+	ck, ok := ConfigSchema[base]
+	if !ok {
+		if suggestion := closestConfigKey(base); suggestion != "" {
+			return nil, fmt.Errorf("unknown config key %q, did you mean %q?", base, suggestion)
+		}
+		return nil, fmt.Errorf("unknown config key %q", base)
+	}
+	if base != k && !ck.Guild {
+		return nil, fmt.Errorf("config %s can not be overridden per guild", base)
+	}
+	return ck, nil
+}
+
+// ValidateConfig checks k is known and v is valid for it.
+func ValidateConfig(k, v string) error {
+	ck, err := LookupConfigKey(k)
+	if err != nil {
+		return err
+	}
+	return ck.Validate(v)
+}
+
+// configDefault returns the registered default of k.
+func configDefault(k string) (bool, string) {
+	ck, ok := ConfigSchema[k]
+	if !ok || ck.Default == "" {
+		return false, ""
+	}
+	return true, ck.Default
+}
+
+// closestConfigKey suggests a registered key for a typo, it is empty when
+// nothing is close.
+func closestConfigKey(k string) string {
+	best, bestDistance := "", 4
+	for name := range ConfigSchema {
+		d := levenshtein(k, name)
+		if d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// ConfigDuration returns a duration config key.
+func (d *DB) ConfigDuration(k string) (time.Duration, error) {
+	found, v, err := d.ConfigGet(k)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("No config for %s", k)
+	}
+	return time.ParseDuration(v)
+}
+
+// ConfigInt returns an integer config key.
+func (d *DB) ConfigInt(k string) (int64, error) {
+	found, v, err := d.ConfigGet(k)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("No config for %s", k)
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
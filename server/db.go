@@ -7,7 +7,9 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"io/fs"
-	"sort"
+	"os"
+	"strings"
+	"sync"
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitemigration"
 	"zombiezen.com/go/sqlite/sqlitex"
@@ -20,6 +22,8 @@ var Migrations []string
 var Schema sqlitemigration.Schema
 
 func init() {
+	// fs.Glob returns the names in lexical order which is the order the
+	// migrations must be applied in.
 	templates, _ := fs.Glob(migration_files, "migration/*.sql")
 	for _, a := range templates {
 		//fmt.Println(a)
@@ -29,7 +33,6 @@ func init() {
 		}
 		Migrations = append(Migrations, string(s))
 	}
-	sort.Strings(Migrations)
 	Schema = sqlitemigration.Schema{
 		AppID:               0xbf7294,
 		Migrations:          Migrations,
@@ -47,6 +50,12 @@ type DBConfig interface {
 	ConnectString() string
 }
 
+// ConfigFiler is implemented by a DBConfig that names a config file to layer
+// over the database, without it ARRMATE_CONFIG_FILE is used.
+type ConfigFiler interface {
+	ConfigFileName() string
+}
+
 func NewDB(cfg DBConfig) (*DB, error) {
 
 	db := &DB{}
@@ -60,12 +69,37 @@ func NewDB(cfg DBConfig) (*DB, error) {
 	db.Pool = pool
 	db.Log = log.With().Str("ss", "db").Logger()
 
+	secrets, err := LoadSecretBox()
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	db.Secrets = secrets
+
+	path := os.Getenv(ConfigFileEnv)
+	if cf, ok := cfg.(ConfigFiler); ok && cf.ConfigFileName() != "" {
+		path = cf.ConfigFileName()
+	}
+	overlay, err := LoadConfigOverlay(os.Environ(), path)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	db.Overlay = overlay
+
 	return db, nil
 }
 
 type DB struct {
 	Pool *sqlitemigration.Pool
 	Log  zerolog.Logger
+	// Secrets encrypts sensitive config values, nil stores them in plaintext.
+	Secrets *SecretBox
+	// Overlay is config from the environment and config file, it wins over
+	// the config table.
+	Overlay *ConfigOverlay
+	// live holds the *liveTables of every connection.
+	live sync.Map
 }
 
 func (d *DB) Get(ctx context.Context) (*sqlite.Conn, error) {
@@ -107,7 +141,10 @@ func (d *DB) ConnPrepareFunc() sqlitemigration.ConnPrepareFunc {
 		if err != nil {
 			return err
 		}
-		return nil
+		if err = RegisterFunctions(conn); err != nil {
+			return err
+		}
+		return d.StarrTables(conn)
 	}
 }
 
@@ -161,17 +198,82 @@ func (d *DB) RawConfigGet(s *sqlite.Stmt, conn *sqlite.Conn, k string) (bool, st
 
 }
 
+// configGetOpen is RawConfigGet with encrypted secrets decrypted.
+func (d *DB) configGetOpen(s *sqlite.Stmt, conn *sqlite.Conn, k string) (bool, string, error) {
+	found, v, err := d.RawConfigGet(s, conn, k)
+	if err != nil || !found {
+		return found, v, err
+	}
+	v, err = d.OpenSecret(k, v)
+	return found, v, err
+}
+
 func (d *DB) ConfigGet(k string) (bool, string, error) {
+	found, v, _, err := d.ConfigResolve("", k)
+	return found, v, err
+}
+
+// GuildKey returns the key a per guild override of k is stored under.
+func GuildKey(guildID, k string) string {
+	return "guild:" + guildID + ":" + k
+}
+
+// BaseKey strips the guild:<id>: prefix of an override.
+func BaseKey(k string) string {
+	if !strings.HasPrefix(k, "guild:") {
+		return k
+	}
+	parts := strings.SplitN(k, ":", 3)
+	if len(parts) != 3 {
+		return k
+	}
+	return parts[2]
+}
+
+// configLookup resolves a single key through the overlay and then the
+// database.
+func (d *DB) configLookup(s *sqlite.Stmt, conn *sqlite.Conn, k string) (bool, string, string, error) {
+	if d.Overlay != nil {
+		if found, v, source := d.Overlay.Get(k); found {
+			v, err := d.OpenSecret(k, v)
+			return found, v, source, err
+		}
+	}
+	found, v, err := d.configGetOpen(s, conn, k)
+	return found, v, ConfigSourceDB, err
+}
+
+// ConfigResolve resolves guild:<id>:k before falling back to the global k and
+// then its registered default, returning where the value came from.  Each key
+// is looked up in the environment, the config file and then the database.  An
+// empty guildID only resolves the global key.
+func (d *DB) ConfigResolve(guildID, k string) (bool, string, string, error) {
 	var err error
 	var s *sqlite.Stmt
 
 	// Get Conn
 	conn, err := d.Pool.Get(context.TODO())
 	if err != nil {
-		return false, "", err
+		return false, "", "", err
 	}
 	defer d.Pool.Put(conn)
-	return d.RawConfigGet(s, conn, k)
+	if guildID != "" {
+		found, v, source, err := d.configLookup(s, conn, GuildKey(guildID, k))
+		if err != nil || found {
+			return found, v, source, err
+		}
+	}
+	found, v, source, err := d.configLookup(s, conn, k)
+	if err != nil || found {
+		return found, v, source, err
+	}
+	found, v = configDefault(k)
+	return found, v, ConfigSourceDefault, nil
+}
+
+func (d *DB) ConfigGetGuild(guildID, k string) (bool, string, error) {
+	found, v, _, err := d.ConfigResolve(guildID, k)
+	return found, v, err
 }
 
 func (d *DB) RawConfigSet(s *sqlite.Stmt, conn *sqlite.Conn, k string, v string) error {
@@ -194,17 +296,35 @@ func (d *DB) RawConfigSet(s *sqlite.Stmt, conn *sqlite.Conn, k string, v string)
 
 }
 
+// ConfigSet is ConfigSetAs by the local CLI user.
 func (d *DB) ConfigSet(k, v string) error {
-	var err error
+	return d.ConfigSetAs(CLIActor(), k, v)
+}
+
+// ConfigSetAs stores a value after checking it against ConfigSchema, unknown
+// keys and invalid values are rejected.  The change is recorded in
+// config_history with actor.
+func (d *DB) ConfigSetAs(actor, k, v string) (err error) {
 	var s *sqlite.Stmt
 
+	if err = ValidateConfig(k, v); err != nil {
+		return err
+	}
+
 	// Get Conn
 	conn, err := d.Pool.Get(context.TODO())
 	if err != nil {
 		return err
 	}
 	defer d.Pool.Put(conn)
-	return d.RawConfigSet(s, conn, k, v)
+
+	v, err = d.SealSecret(k, v)
+	if err != nil {
+		return err
+	}
+	defer sqlitex.Save(conn)(&err)
+	_, err = d.rawConfigRecord(s, conn, actor, k, v, true)
+	return err
 }
 
 func (d *DB) RawConfigDelete(s *sqlite.Stmt, conn *sqlite.Conn, k string) error {
@@ -225,8 +345,15 @@ func (d *DB) RawConfigDelete(s *sqlite.Stmt, conn *sqlite.Conn, k string) error
 	return nil
 
 }
+
+// ConfigDelete is ConfigDeleteAs by the local CLI user.
 func (d *DB) ConfigDelete(k string) error {
-	var err error
+	return d.ConfigDeleteAs(CLIActor(), k)
+}
+
+// ConfigDeleteAs removes k and records the change in config_history with
+// actor.
+func (d *DB) ConfigDeleteAs(actor, k string) (err error) {
 	var s *sqlite.Stmt
 
 	// Get Conn
@@ -235,8 +362,10 @@ func (d *DB) ConfigDelete(k string) error {
 		return err
 	}
 	defer d.Pool.Put(conn)
-	return d.RawConfigDelete(s, conn, k)
 
+	defer sqlitex.Save(conn)(&err)
+	_, err = d.rawConfigRecord(s, conn, actor, k, "", false)
+	return err
 }
 
 /*
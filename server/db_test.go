@@ -8,7 +8,10 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitemigration"
 )
@@ -148,7 +151,7 @@ func TestNewDB_Migrations(t *testing.T) {
 	// Check for all the expect tables that should be setup in the database.
 	t.Run("Expected_Tables", func(t *testing.T) {
 		// List of all the tables that are expect to be with in the database after migrations
-		expectedTables := []string{"config", "sonarr"}
+		expectedTables := []string{"config", "sonarr", "radarr", "quotas", "media_requests", "sqlite_sequence", "guild_settings", "config_history", "sonarr_episodes", "sonarr_episode_sync", "disk_space", "disk_alerts", "starr_status", "starr_health", "plex_items", "plex_map", "plex_accounts", "plex_history"}
 
 		for _, tName := range expectedTables {
 			s := conn.Prep(" SELECT * FROM sqlite_master where type='table' and name=$name")
@@ -204,18 +207,18 @@ func TestDB_ConfigGet_ConfigSet(t *testing.T) {
 		var err error
 		var found bool
 		var result string
-		err = db.ConfigSet("jeremy", "rossi")
+		err = db.ConfigSet("starr.radarr.root_folder", "rossi")
 		assert.NoError(t, err, "ConfigSet should have worked as expected")
 
-		found, result, err = db.ConfigGet("jeremy")
+		found, result, err = db.ConfigGet("starr.radarr.root_folder")
 		assert.Equal(t, result, "rossi", "ConfigSet then ConfigGet should result in rossi")
 		assert.True(t, found)
 		assert.NoError(t, err, "ConfigGet should not error when key is found")
 
-		err = db.ConfigSet("jeremy", "rossi-rossi")
+		err = db.ConfigSet("starr.radarr.root_folder", "rossi-rossi")
 		assert.NoError(t, err, "ConfigSet should have worked as expected even with duplicate key")
 
-		found, result, err = db.ConfigGet("jeremy")
+		found, result, err = db.ConfigGet("starr.radarr.root_folder")
 		assert.Equal(t, result, "rossi-rossi", "ConfigSet then ConfigGet should result in rossi")
 		assert.True(t, found)
 		assert.NoError(t, err, "ConfigGet should not error when key is found")
@@ -233,27 +236,52 @@ func TestDB_ConfigGet_ConfigSet(t *testing.T) {
 		var err error
 		var found bool
 		var result string
-		err = db.ConfigSet("remove", "me")
+		err = db.ConfigSet("starr.sonarr.root_folder", "me")
 		assert.NoError(t, err, "ConfigSet should have worked as expected")
 
 		// Verify was inserted
-		found, result, err = db.ConfigGet("remove")
+		found, result, err = db.ConfigGet("starr.sonarr.root_folder")
 		assert.Equal(t, result, "me", "ConfigSet then ConfigGet should result in rossi")
 		assert.True(t, found)
 		assert.NoError(t, err, "ConfigGet should not error when key is found")
 
 		// Remove entry
-		err = db.ConfigDelete("remove")
+		err = db.ConfigDelete("starr.sonarr.root_folder")
 		assert.NoError(t, err, "ConfigDelete should not error when removing items")
 
 		// Verify was removed
-		found, result, err = db.ConfigGet("remove")
+		found, result, err = db.ConfigGet("starr.sonarr.root_folder")
 		assert.Equal(t, result, "", "ConfigSet then ConfigGet should result empty string")
 		assert.False(t, found)
 		assert.NoError(t, err, "ConfigGet should not error when key is not found")
 	})
 }
 
+func TestDB_ConfigSet_Schema(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, _ := NewDB(dcfg)
+	defer db.Close()
+
+	err := db.ConfigSet("starr.sonar.url", "http://localhost:8989/")
+	assert.ErrorContains(t, err, `did you mean "starr.sonarr.url"`, "typos are rejected with a suggestion")
+
+	assert.Error(t, db.ConfigSet("plex.url", "localhost"), "urls need a scheme and host")
+	assert.Error(t, db.ConfigSet("starr.radarr.quality_profile", "hd"), "ints are validated")
+	assert.Error(t, db.ConfigSet("discord.admin.users", "123,bob"), "id lists are validated")
+	assert.Error(t, db.ConfigSet(GuildKey("1234", "discord.token"), "abc"), "global only keys can not be overridden per guild")
+	assert.NoError(t, db.ConfigSet(GuildKey("1234", "discord.admin.users"), "123, 456"))
+
+	found, v, err := db.ConfigGet("starr.sync_interval")
+	assert.NoError(t, err)
+	assert.True(t, found, "defaults are returned for unset keys")
+	assert.Equal(t, "5m", v)
+
+	assert.NoError(t, db.ConfigSet("starr.sync_interval", "10m"))
+	d, err := db.ConfigDuration("starr.sync_interval")
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, d)
+}
+
 /*
 func TestDB_NewDB_With_Config_set(t *testing.T) {
 	var err error
@@ -279,3 +307,159 @@ func TestDB_NewDB_With_Config_set(t *testing.T) {
 	assert.NoError(t, err, "ConfigGet should not error when key is found")
 }
 */
+
+func TestDB_ConfigGetGuild(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, _ := NewDB(dcfg)
+	defer db.Close()
+
+	assert.NoError(t, db.ConfigSet("starr.radarr.url", "http://global:7878/"))
+	assert.NoError(t, db.ConfigSet(GuildKey("1234", "starr.radarr.url"), "http://guild:7878/"))
+
+	found, v, err := db.ConfigGetGuild("1234", "starr.radarr.url")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "http://guild:7878/", v, "guild override wins over the global key")
+
+	found, v, err = db.ConfigGetGuild("5678", "starr.radarr.url")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "http://global:7878/", v, "guilds without an override use the global key")
+
+	found, v, err = db.ConfigGetGuild("", "starr.radarr.url")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "http://global:7878/", v, "empty guild only resolves the global key")
+
+	found, _, err = db.ConfigGetGuild("1234", "starr.sonarr.url")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestLoadConfigOverlay(t *testing.T) {
+	assert.Equal(t, "ARRMATE_STARR_SONARR_URL", EnvName("starr.sonarr.url"))
+	assert.Equal(t, "ARRMATE_GUILD_1234_STARR_SONARR_URL", EnvName(GuildKey("1234", "starr.sonarr.url")))
+
+	path := filepath.Join(t.TempDir(), "arrmate.yaml")
+	yml := `
+plex:
+  url: http://file:32400
+discord:
+  admin:
+    users: [111, 222]
+guild:
+  "1234":
+    starr:
+      radarr:
+        url: http://guild-file:7878/
+`
+	assert.NoError(t, os.WriteFile(path, []byte(yml), 0600))
+
+	co, err := LoadConfigOverlay([]string{
+		"ARRMATE_PLEX_URL=http://env:32400",
+		"ARRMATE_GUILD_1234_STARR_SONARR_URL=http://guild-env:8989/",
+		"ARRMATE_SECRET_KEY=ignored",
+		"HOME=/root",
+	}, path)
+	assert.NoError(t, err)
+
+	found, v, source := co.Get("plex.url")
+	assert.True(t, found)
+	assert.Equal(t, "http://env:32400", v, "env wins over the file")
+	assert.Equal(t, ConfigSourceEnv, source)
+
+	found, v, source = co.Get("discord.admin.users")
+	assert.True(t, found)
+	assert.Equal(t, "111,222", v, "lists are comma joined")
+	assert.Equal(t, ConfigSourceFile, source)
+
+	found, v, _ = co.Get(GuildKey("1234", "starr.radarr.url"))
+	assert.True(t, found)
+	assert.Equal(t, "http://guild-file:7878/", v)
+
+	found, v, _ = co.Get(GuildKey("1234", "starr.sonarr.url"))
+	assert.True(t, found)
+	assert.Equal(t, "http://guild-env:8989/", v)
+
+	assert.Equal(t, []string{"discord.admin.users", GuildKey("1234", "starr.radarr.url"), GuildKey("1234", "starr.sonarr.url"), "plex.url"}, co.Keys())
+
+	_, err = LoadConfigOverlay([]string{"ARRMATE_STARR_SYNC_INTERVAL=often"}, "")
+	assert.ErrorContains(t, err, "ARRMATE_STARR_SYNC_INTERVAL")
+
+	assert.NoError(t, os.WriteFile(path, []byte("plex:\n  ulr: http://file:32400\n"), 0600))
+	_, err = LoadConfigOverlay(nil, path)
+	assert.ErrorContains(t, err, "unknown config key")
+
+	tomlPath := filepath.Join(t.TempDir(), "arrmate.toml")
+	tml := `
+[plex]
+url = "http://file:32400"
+
+[discord.admin]
+users = [111, 222]
+
+[guild."1234".starr.radarr]
+url = "http://guild-file:7878/"
+`
+	assert.NoError(t, os.WriteFile(tomlPath, []byte(tml), 0600))
+	co, err = LoadConfigOverlay(nil, tomlPath)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"plex.url":                           "http://file:32400",
+		"discord.admin.users":                "111,222",
+		GuildKey("1234", "starr.radarr.url"): "http://guild-file:7878/",
+	}, co.File)
+
+	assert.NoError(t, os.WriteFile(tomlPath, []byte("[plex]\nulr = \"http://file:32400\"\n"), 0600))
+	_, err = LoadConfigOverlay(nil, tomlPath)
+	assert.ErrorContains(t, err, "unknown config key")
+}
+
+// clearArrmateEnv unsets every ARRMATE_* variable for the rest of the test so
+// NewDB only sees the overlay the test sets up.
+func clearArrmateEnv(t *testing.T) {
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "ARRMATE_") {
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestDB_ConfigOverlay(t *testing.T) {
+	clearArrmateEnv(t)
+	path := filepath.Join(t.TempDir(), "arrmate.toml")
+	assert.NoError(t, os.WriteFile(path, []byte("[guild.\"1234\".starr.radarr]\nurl = \"http://file:7878/\"\n"), 0600))
+	t.Setenv(ConfigFileEnv, path)
+	t.Setenv("ARRMATE_PLEX_URL", "http://env:32400")
+
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.ConfigSet("plex.url", "http://db:32400"))
+	assert.NoError(t, db.ConfigSet("starr.radarr.url", "http://db:7878/"))
+
+	found, v, source, err := db.ConfigResolve("", "plex.url")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "http://env:32400", v)
+	assert.Equal(t, ConfigSourceEnv, source)
+
+	_, v, source, err = db.ConfigResolve("1234", "starr.radarr.url")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://file:7878/", v)
+	assert.Equal(t, ConfigSourceFile, source)
+
+	_, v, source, err = db.ConfigResolve("5678", "starr.radarr.url")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://db:7878/", v)
+	assert.Equal(t, ConfigSourceDB, source)
+
+	_, v, source, err = db.ConfigResolve("", "starr.sync_interval")
+	assert.NoError(t, err)
+	assert.Equal(t, "5m", v)
+	assert.Equal(t, ConfigSourceDefault, source)
+}
@@ -0,0 +1,361 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	"golift.io/starr"
+	"sort"
+	"strings"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// diskTrendWindow is how far back samples are used to predict when a disk
+// fills up.
+const diskTrendWindow = 7 * 24 * time.Hour
+
+// diskMinTrendSpan is how far apart the first and last sample must be before
+// a trend is trusted, a few minutes of downloading look like a full disk in
+// hours.
+const diskMinTrendSpan = 24 * time.Hour
+
+// Reasons a disk alert is sent.
+const (
+	DiskAlertLowSpace = "low space"
+	DiskAlertFilling  = "filling"
+)
+
+// DiskSpace is an entry of the starr diskspace endpoint.
+type DiskSpace struct {
+	Path       string `json:"path"`
+	Label      string `json:"label"`
+	FreeSpace  int64  `json:"freeSpace"`
+	TotalSpace int64  `json:"totalSpace"`
+}
+
+// DiskSample is a row of disk_space.
+type DiskSample struct {
+	App        string
+	Path       string
+	Label      string
+	FreeSpace  int64
+	TotalSpace int64
+	At         time.Time
+}
+
+// DiskStatus is the latest sample of a path with its trend.  DaysToFull is
+// only set when the free space is shrinking.
+type DiskStatus struct {
+	DiskSample
+	DaysToFull float64
+	Filling    bool
+}
+
+// String formats the status for discord.
+func (s *DiskStatus) String() string {
+	line := fmt.Sprintf("%s: %s free of %s", s.Path, HumanSize(s.FreeSpace), HumanSize(s.TotalSpace))
+	if s.Filling {
+		line += fmt.Sprintf(", full in %.1f days", s.DaysToFull)
+	}
+	return line
+}
+
+// DiskAlert is a disk that is low on space or filling up.
+type DiskAlert struct {
+	Status *DiskStatus
+	Reason string
+}
+
+// String formats the alert for the ops channel.
+func (a *DiskAlert) String() string {
+	return fmt.Sprintf("Disk %s: %s", a.Reason, a.Status)
+}
+
+// FetchDiskSpace reads the diskspace endpoint of a StarrClient.
+func FetchDiskSpace(api starr.APIer) ([]*DiskSpace, error) {
+	var results []*DiskSpace
+	if err := api.GetInto(context.TODO(), "v3/diskspace", nil, &results); err != nil {
+		return nil, fmt.Errorf("api.Get(diskspace): %w", err)
+	}
+	return results, nil
+}
+
+// RecordDiskSpace stores a sample of every disk of app.
+func (d *DB) RecordDiskSpace(app string, spaces []*DiskSpace, at time.Time) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	doUpdate := func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+		for _, s := range spaces {
+			err = sqlitex.Execute(conn, "INSERT INTO disk_space (app, path, label, free_space, total_space, created_at) VALUES (?, ?, ?, ?, ?, ?);", &sqlitex.ExecOptions{
+				Args: []interface{}{app, s.Path, s.Label, s.FreeSpace, s.TotalSpace, at.Unix()},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return doUpdate()
+}
+
+// PruneDiskSpace drops the samples taken before before.
+func (d *DB) PruneDiskSpace(before time.Time) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	return sqlitex.Execute(conn, "DELETE FROM disk_space WHERE created_at < ?;", &sqlitex.ExecOptions{
+		Args: []interface{}{before.Unix()},
+	})
+}
+
+// DiskSamples returns the samples since since ordered by path and time.
+// Sonarr and radarr usually share disks so a path has samples of both.
+func (d *DB) DiskSamples(since time.Time) ([]*DiskSample, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	results := []*DiskSample{}
+	err = sqlitex.Execute(conn, `SELECT app, path, label, free_space, total_space, created_at FROM disk_space
+		WHERE created_at >= ? ORDER BY path, created_at, app`, &sqlitex.ExecOptions{
+		Args: []interface{}{since.Unix()},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			results = append(results, &DiskSample{
+				App:        stmt.ColumnText(0),
+				Path:       stmt.ColumnText(1),
+				Label:      stmt.ColumnText(2),
+				FreeSpace:  stmt.ColumnInt64(3),
+				TotalSpace: stmt.ColumnInt64(4),
+				At:         time.Unix(stmt.ColumnInt64(5), 0),
+			})
+			return nil
+		},
+	})
+	return results, err
+}
+
+// DaysToFull fits a line through the free space of samples and returns the
+// days until it reaches 0 from the last sample.  It is false when there are
+// too few samples, they span less than diskMinTrendSpan or the free space is
+// not shrinking.
+func DaysToFull(samples []*DiskSample) (float64, bool) {
+	if len(samples) < 2 || samples[len(samples)-1].At.Sub(samples[0].At) < diskMinTrendSpan {
+		return 0, false
+	}
+	start := samples[0].At
+	var n, sumX, sumY, sumXY, sumXX float64
+	for _, s := range samples {
+		x := s.At.Sub(start).Hours() / 24
+		y := float64(s.FreeSpace)
+		n++
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	slope := (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+	if slope >= 0 {
+		return 0, false
+	}
+	return float64(samples[len(samples)-1].FreeSpace) / -slope, true
+}
+
+// DiskStatuses returns the latest sample and trend of every path sampled
+// since now minus diskTrendWindow, ordered by path.
+func (d *DB) DiskStatuses(now time.Time) ([]*DiskStatus, error) {
+	samples, err := d.DiskSamples(now.Add(-diskTrendWindow))
+	if err != nil {
+		return nil, err
+	}
+	byPath := map[string][]*DiskSample{}
+	for _, s := range samples {
+		byPath[s.Path] = append(byPath[s.Path], s)
+	}
+	results := []*DiskStatus{}
+	for _, samples := range byPath {
+		status := &DiskStatus{DiskSample: *samples[len(samples)-1]}
+		status.DaysToFull, status.Filling = DaysToFull(samples)
+		results = append(results, status)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+	return results, nil
+}
+
+// DiskAlerts returns the disks with less than minFree bytes free or trending
+// to fill within fillDays.
+func DiskAlerts(statuses []*DiskStatus, minFree int64, fillDays float64) []*DiskAlert {
+	results := []*DiskAlert{}
+	for _, s := range statuses {
+		if s.FreeSpace < minFree {
+			results = append(results, &DiskAlert{Status: s, Reason: DiskAlertLowSpace})
+		}
+		if s.Filling && s.DaysToFull <= fillDays {
+			results = append(results, &DiskAlert{Status: s, Reason: DiskAlertFilling})
+		}
+	}
+	return results
+}
+
+// DiskAlertDue records the alert and reports if it should be sent, it is not
+// when the same alert was sent less than interval ago.
+func (d *DB) DiskAlertDue(a *DiskAlert, interval time.Duration, now time.Time) (due bool, err error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return false, err
+	}
+	defer d.Pool.Put(conn)
+
+	defer sqlitex.Save(conn)(&err)
+	var last int64
+	found := false
+	err = sqlitex.Execute(conn, "SELECT created_at FROM disk_alerts WHERE path = ? AND reason = ?", &sqlitex.ExecOptions{
+		Args: []interface{}{a.Status.Path, a.Reason},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			found = true
+			last = stmt.ColumnInt64(0)
+			return nil
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	if found && now.Sub(time.Unix(last, 0)) < interval {
+		return false, nil
+	}
+	err = sqlitex.Execute(conn, `INSERT INTO disk_alerts (path, reason, created_at) VALUES (?, ?, ?)
+		ON CONFLICT(path, reason) DO UPDATE SET created_at = EXCLUDED.created_at`, &sqlitex.ExecOptions{
+		Args: []interface{}{a.Status.Path, a.Reason, now.Unix()},
+	})
+	return err == nil, err
+}
+
+// SetupDiskSpace schedules CheckDiskSpace every disk.check_interval.
+func (srv *ArrServer) SetupDiskSpace() error {
+	interval, err := srv.DB.ConfigDuration("disk.check_interval")
+	if err != nil {
+		return err
+	}
+	job, err := srv.Cron.Every(interval).StartImmediately().Do(func() {
+		if err := srv.CheckDiskSpace(time.Now()); err != nil {
+			log.Warn().Err(err).Msg("Checking disk space failed")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	job.Tag("disk")
+	return nil
+}
+
+// CheckDiskSpace samples the disks of sonarr and radarr, apps that are not
+// configured are skipped, and sends the alerts that are due to
+// disk.alert_channel.
+func (srv *ArrServer) CheckDiskSpace(now time.Time) error {
+	for _, app := range []string{"sonarr", "radarr"} {
+		api, err := srv.StarrClient("", app)
+		if err != nil {
+			log.Debug().Err(err).Str("app", app).Msg("Skipping disk space")
+			continue
+		}
+		spaces, err := FetchDiskSpace(api)
+		if err != nil {
+			log.Warn().Err(err).Str("app", app).Msg("Fetching disk space failed")
+			continue
+		}
+		if err := srv.DB.RecordDiskSpace(app, spaces, now); err != nil {
+			return err
+		}
+	}
+	retention, err := srv.DB.ConfigDuration("disk.retention")
+	if err != nil {
+		return err
+	}
+	if err := srv.DB.PruneDiskSpace(now.Add(-retention)); err != nil {
+		return err
+	}
+
+	alerts, err := srv.DueDiskAlerts(now)
+	if err != nil || len(alerts) == 0 {
+		return err
+	}
+	found, channel, err := srv.DB.ConfigGet("disk.alert_channel")
+	if err != nil {
+		return err
+	}
+	lines := make([]string, len(alerts))
+	for i, a := range alerts {
+		lines[i] = a.String()
+	}
+	session := srv.Session()
+	if !found || session == nil {
+		log.Warn().Strs("alerts", lines).Msg("Disk space alerts without disk.alert_channel")
+		return nil
+	}
+	_, err = session.ChannelMessageSend(channel, strings.Join(lines, "\n"))
+	return err
+}
+
+// DueDiskAlerts returns the alerts of the current disk statuses that were
+// not sent within disk.alert_interval.
+func (srv *ArrServer) DueDiskAlerts(now time.Time) ([]*DiskAlert, error) {
+	minFree, err := srv.DB.ConfigInt("disk.min_free_gb")
+	if err != nil {
+		return nil, err
+	}
+	fillDays, err := srv.DB.ConfigInt("disk.fill_days")
+	if err != nil {
+		return nil, err
+	}
+	interval, err := srv.DB.ConfigDuration("disk.alert_interval")
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := srv.DB.DiskStatuses(now)
+	if err != nil {
+		return nil, err
+	}
+	results := []*DiskAlert{}
+	for _, a := range DiskAlerts(statuses, minFree<<30, float64(fillDays)) {
+		due, err := srv.DB.DiskAlertDue(a, interval, now)
+		if err != nil {
+			return nil, err
+		}
+		if due {
+			results = append(results, a)
+		}
+	}
+	return results, nil
+}
+
+// HandleDisk shows the free space and trend of every disk.
+func (srv *ArrServer) HandleDisk(s *discordgo.Session, m *discordgo.MessageCreate) {
+	statuses, err := srv.DB.DiskStatuses(time.Now())
+	if err != nil {
+		log.Error().Err(err).Msg("Reading disk space failed")
+		return
+	}
+	if len(statuses) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "No disk space samples yet")
+		return
+	}
+	lines := make([]string, len(statuses))
+	for i, status := range statuses {
+		lines[i] = status.String()
+	}
+	for _, msg := range ChunkMessage(strings.Join(lines, "\n"), discordMessageLimit) {
+		s.ChannelMessageSend(m.ChannelID, msg)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golift.io/starr"
+	"golift.io/starr/sonarr"
+)
+
+func TestDaysToFull(t *testing.T) {
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	samples := []*DiskSample{
+		{FreeSpace: 100, At: start},
+		{FreeSpace: 90, At: start.Add(24 * time.Hour)},
+		{FreeSpace: 80, At: start.Add(48 * time.Hour)},
+	}
+	days, filling := DaysToFull(samples)
+	assert.True(t, filling)
+	assert.InDelta(t, 8.0, days, 0.001)
+
+	samples[2].FreeSpace = 120
+	_, filling = DaysToFull(samples)
+	assert.False(t, filling, "growing free space is not filling")
+
+	_, filling = DaysToFull(samples[:1])
+	assert.False(t, filling, "one sample has no trend")
+
+	_, filling = DaysToFull([]*DiskSample{
+		{FreeSpace: 100, At: start},
+		{FreeSpace: 50, At: start.Add(time.Hour)},
+		{FreeSpace: 10, At: start.Add(2 * time.Hour)},
+	})
+	assert.False(t, filling, "a few hours of samples are too short for a trend")
+}
+
+func TestDiskAlerts(t *testing.T) {
+	statuses := []*DiskStatus{
+		{DiskSample: DiskSample{Path: "/ok", FreeSpace: 500}},
+		{DiskSample: DiskSample{Path: "/low", FreeSpace: 5}},
+		{DiskSample: DiskSample{Path: "/filling", FreeSpace: 500}, Filling: true, DaysToFull: 3},
+		{DiskSample: DiskSample{Path: "/slow", FreeSpace: 500}, Filling: true, DaysToFull: 30},
+	}
+	alerts := DiskAlerts(statuses, 10, 7)
+	assert.Len(t, alerts, 2)
+	assert.Equal(t, "/low", alerts[0].Status.Path)
+	assert.Equal(t, DiskAlertLowSpace, alerts[0].Reason)
+	assert.Equal(t, "/filling", alerts[1].Status.Path)
+	assert.Equal(t, DiskAlertFilling, alerts[1].Reason)
+}
+
+func TestArrServer_CheckDiskSpace(t *testing.T) {
+	free := int64(200 << 30)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v3/diskspace", r.URL.Path)
+		json.NewEncoder(w).Encode([]*DiskSpace{{Path: "/data", Label: "data", FreeSpace: free, TotalSpace: 1 << 40}})
+	}))
+	defer api.Close()
+
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := &ArrServer{DB: db}
+	assert.NoError(t, db.ConfigSet("starr.sonarr.url", api.URL))
+	assert.NoError(t, db.ConfigSet("starr.sonarr.token", "token"))
+
+	spaces, err := FetchDiskSpace(sonarr.New(starr.New("token", api.URL, time.Second)))
+	assert.NoError(t, err)
+	assert.Equal(t, []*DiskSpace{{Path: "/data", Label: "data", FreeSpace: free, TotalSpace: 1 << 40}}, spaces)
+
+	now := time.Now()
+	assert.NoError(t, srv.CheckDiskSpace(now.Add(-48*time.Hour)), "radarr is not configured and skipped")
+	free = 150 << 30
+	assert.NoError(t, srv.CheckDiskSpace(now.Add(-24*time.Hour)))
+	statuses, err := db.DiskStatuses(now)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 1)
+	assert.True(t, statuses[0].Filling)
+	assert.InDelta(t, 3.0, statuses[0].DaysToFull, 0.01)
+
+	alerts, err := srv.DueDiskAlerts(now)
+	assert.NoError(t, err)
+	assert.Len(t, alerts, 1)
+	assert.Equal(t, DiskAlertFilling, alerts[0].Reason)
+	assert.Equal(t, "Disk filling: /data: 150.0 GiB free of 1.0 TiB, full in 3.0 days", alerts[0].String())
+
+	alerts, err = srv.DueDiskAlerts(now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, alerts, 0, "an alert is not repeated within disk.alert_interval")
+
+	alerts, err = srv.DueDiskAlerts(now.Add(25 * time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, alerts, 1)
+
+	assert.NoError(t, db.PruneDiskSpace(now))
+	statuses, err = db.DiskStatuses(now)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 0)
+}
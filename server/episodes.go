@@ -0,0 +1,377 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	"golift.io/starr/sonarr"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const sonarrEpisodesUsage = "usage: !sonarr episodes <series> [season]"
+
+// Episode is a row of the sonarr_episodes cache.
+type Episode struct {
+	ID            int64
+	SeriesID      int64
+	SeasonNumber  int64
+	EpisodeNumber int64
+	Title         string
+	AirDate       string
+	HasFile       bool
+	Monitored     bool
+	Quality       string
+	Size          int64
+}
+
+// Aired reports if the episode aired before now, episodes without an air
+// date have not.
+func (e *Episode) Aired(now time.Time) bool {
+	return e.AirDate != "" && e.AirDate <= now.Format("2006-01-02")
+}
+
+// SeriesFingerprint is what the episode sync compares to decide if a series
+// changed, empty when sonarr sent no statistics so it is always synced.
+func SeriesFingerprint(s *sonarr.Series) string {
+	if s.Statistics == nil {
+		return ""
+	}
+	b, _ := json.Marshal(s.Statistics)
+	return string(b)
+}
+
+// SyncSonarrEpisodes refreshes sonarr_episodes for every series whose
+// statistics changed since its last sync and drops the episodes of series
+// that are gone.  A series that fails is logged and retried on the next sync.
+func (srv *ArrServer) SyncSonarrEpisodes(sc *sonarr.Sonarr, series []*sonarr.Series) error {
+	synced, err := srv.DB.EpisodeSyncState()
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, len(series))
+	for i, s := range series {
+		ids[i] = s.ID
+		fingerprint := SeriesFingerprint(s)
+		if prev, ok := synced[s.ID]; ok && fingerprint != "" && prev == fingerprint {
+			continue
+		}
+		episodes, err := sc.GetSeriesEpisodes(s.ID)
+		if err != nil {
+			log.Warn().Err(err).Int64("series", s.ID).Msg("Fetching sonarr episodes failed")
+			continue
+		}
+		files, err := sc.GetSeriesEpisodeFiles(s.ID)
+		if err != nil {
+			log.Warn().Err(err).Int64("series", s.ID).Msg("Fetching sonarr episode files failed")
+			continue
+		}
+		if err := srv.DB.CacheSonarrEpisodes(s.ID, fingerprint, episodes, files); err != nil {
+			return err
+		}
+	}
+	return srv.DB.PruneSonarrEpisodes(ids)
+}
+
+// EpisodeSyncState returns the fingerprint of every synced series by id.
+func (d *DB) EpisodeSyncState() (map[int64]string, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	results := map[int64]string{}
+	err = sqlitex.Execute(conn, "SELECT series_id, statistics FROM sonarr_episode_sync", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			results[stmt.ColumnInt64(0)] = stmt.ColumnText(1)
+			return nil
+		},
+	})
+	return results, err
+}
+
+// CacheSonarrEpisodes replaces the episodes of a series and records the
+// fingerprint they were synced at.
+func (d *DB) CacheSonarrEpisodes(seriesID int64, fingerprint string, episodes []*sonarr.Episode, files []*sonarr.EpisodeFile) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	byID := map[int64]*sonarr.EpisodeFile{}
+	for _, f := range files {
+		byID[f.ID] = f
+	}
+
+	doUpdate := func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+
+		err = sqlitex.Execute(conn, "DELETE FROM sonarr_episodes WHERE series_id = ?;", &sqlitex.ExecOptions{
+			Args: []interface{}{seriesID},
+		})
+		if err != nil {
+			return fmt.Errorf("database: %w", err)
+		}
+		q := `INSERT INTO sonarr_episodes (id, series_id, season_number, episode_number, title, air_date, has_file, monitored, quality, size, RAW)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+		for _, e := range episodes {
+			raw, _ := json.Marshal(e)
+			var quality, size interface{}
+			if f, ok := byID[e.EpisodeFileID]; ok && e.HasFile {
+				size = f.Size
+				if f.Quality != nil && f.Quality.Quality != nil {
+					quality = f.Quality.Quality.Name
+				}
+			}
+			err = sqlitex.Execute(conn, q, &sqlitex.ExecOptions{
+				Args: []interface{}{
+					e.ID,
+					seriesID,
+					e.SeasonNumber,
+					e.EpisodeNumber,
+					e.Title,
+					e.AirDate,
+					FormatBool(e.HasFile),
+					FormatBool(e.Monitored),
+					quality,
+					size,
+					raw,
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return sqlitex.Execute(conn, `INSERT INTO sonarr_episode_sync (series_id, statistics) VALUES (?, ?)
+			ON CONFLICT(series_id) DO UPDATE SET statistics = EXCLUDED.statistics, synced_at = EXCLUDED.synced_at`,
+			&sqlitex.ExecOptions{Args: []interface{}{seriesID, fingerprint}})
+	}
+	return doUpdate()
+}
+
+// PruneSonarrEpisodes drops the episodes and sync state of every series not
+// in seriesIDs.
+func (d *DB) PruneSonarrEpisodes(seriesIDs []int64) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	keep, _ := json.Marshal(seriesIDs)
+	doUpdate := func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+		for _, table := range []string{"sonarr_episodes", "sonarr_episode_sync"} {
+			err = sqlitex.Execute(conn, "DELETE FROM "+table+" WHERE series_id NOT IN (SELECT value FROM json_each(?));", &sqlitex.ExecOptions{
+				Args: []interface{}{string(keep)},
+			})
+			if err != nil {
+				return fmt.Errorf("database: %w", err)
+			}
+		}
+		return nil
+	}
+	return doUpdate()
+}
+
+// SonarrEpisodes returns the cached episodes of a series ordered by season and
+// number, a negative season returns every season.
+func (d *DB) SonarrEpisodes(seriesID, season int64) ([]*Episode, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	results := []*Episode{}
+	err = sqlitex.Execute(conn, `SELECT id, series_id, season_number, episode_number, title, air_date, has_file, monitored, quality, size
+		FROM sonarr_episodes WHERE series_id = ? AND (? < 0 OR season_number = ?)
+		ORDER BY season_number, episode_number`, &sqlitex.ExecOptions{
+		Args: []interface{}{seriesID, season, season},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			results = append(results, &Episode{
+				ID:            stmt.ColumnInt64(0),
+				SeriesID:      stmt.ColumnInt64(1),
+				SeasonNumber:  stmt.ColumnInt64(2),
+				EpisodeNumber: stmt.ColumnInt64(3),
+				Title:         stmt.ColumnText(4),
+				AirDate:       stmt.ColumnText(5),
+				HasFile:       stmt.ColumnInt64(6) == 1,
+				Monitored:     stmt.ColumnInt64(7) == 1,
+				Quality:       stmt.ColumnText(8),
+				Size:          stmt.ColumnInt64(9),
+			})
+			return nil
+		},
+	})
+	return results, err
+}
+
+// FindSonarrSeries looks a series up in the sonarr cache by title, an exact
+// match wins over a normalized one which wins over a partial one.  It
+// returns 0 when nothing matches.
+func (d *DB) FindSonarrSeries(title string) (int64, string, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return 0, "", err
+	}
+	defer d.Pool.Put(conn)
+
+	var id int64
+	var found string
+	err = sqlitex.Execute(conn, `SELECT id, title FROM sonarr
+		WHERE title = ?1 COLLATE NOCASE OR normalize_title(title) = normalize_title(?1) OR title LIKE ?2 ESCAPE '\'
+		ORDER BY title = ?1 COLLATE NOCASE DESC, normalize_title(title) = normalize_title(?1) DESC, length(title), title
+		LIMIT 1`, &sqlitex.ExecOptions{
+		Args: []interface{}{title, "%" + likeEscape(title) + "%"},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			id = stmt.ColumnInt64(0)
+			found = stmt.ColumnText(1)
+			return nil
+		},
+	})
+	return id, found, err
+}
+
+// SeasonGrid renders one line per season with a cell per episode: ■ on disk,
+// □ aired but missing and · not aired yet.
+func SeasonGrid(title string, episodes []*Episode, now time.Time) string {
+	seasons := map[int64][]*Episode{}
+	for _, e := range episodes {
+		seasons[e.SeasonNumber] = append(seasons[e.SeasonNumber], e)
+	}
+	numbers := []int64{}
+	for n := range seasons {
+		numbers = append(numbers, n)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	var b strings.Builder
+	b.WriteString(title + "\n")
+	for _, n := range numbers {
+		var cells strings.Builder
+		have, aired := 0, 0
+		for _, e := range seasons[n] {
+			switch {
+			case e.HasFile:
+				cells.WriteString("■")
+				have++
+				aired++
+			case e.Aired(now):
+				cells.WriteString("□")
+				aired++
+			default:
+				cells.WriteString("·")
+			}
+		}
+		b.WriteString(fmt.Sprintf("S%02d %s %d/%d\n", n, cells.String(), have, aired))
+	}
+	b.WriteString("■ on disk  □ missing  · not aired")
+	return b.String()
+}
+
+// SeasonList renders the episodes of a single season with their air date,
+// quality and size.
+func SeasonList(title string, season int64, episodes []*Episode, now time.Time) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("%s season %d\n", title, season))
+	for _, e := range episodes {
+		state := "·"
+		if e.HasFile {
+			state = "■"
+		} else if e.Aired(now) {
+			state = "□"
+		}
+		airDate := e.AirDate
+		if airDate == "" {
+			airDate = "TBA"
+		}
+		line := fmt.Sprintf("E%02d %-10s %s", e.EpisodeNumber, airDate, state)
+		if e.HasFile {
+			line += fmt.Sprintf(" %s %s", e.Quality, HumanSize(e.Size))
+		}
+		b.WriteString(line + " " + e.Title + "\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// FindSonarrSeriesSeason resolves "<series> [season]".  The whole argument
+// is tried as a title first so titles ending in a number like "The 100" keep
+// it, the season is only split off when that finds nothing.  season is -1
+// without one.
+func (d *DB) FindSonarrSeriesSeason(args string) (id int64, found string, season int64, err error) {
+	title := strings.Join(strings.Fields(args), " ")
+	if id, found, err = d.FindSonarrSeries(title); err != nil || id != 0 {
+		return id, found, -1, err
+	}
+	title, season = parseEpisodesArgs(title)
+	if season < 0 {
+		return 0, "", -1, nil
+	}
+	id, found, err = d.FindSonarrSeries(title)
+	return id, found, season, err
+}
+
+// parseEpisodesArgs splits "<series> [season]", a trailing number or sN is
+// the season when there is a title before it.
+func parseEpisodesArgs(args string) (string, int64) {
+	fields := strings.Fields(args)
+	if len(fields) > 1 {
+		last := strings.TrimPrefix(strings.ToLower(fields[len(fields)-1]), "s")
+		if n, err := strconv.ParseInt(last, 10, 64); err == nil && n >= 0 {
+			return strings.Join(fields[:len(fields)-1], " "), n
+		}
+	}
+	return strings.Join(fields, " "), -1
+}
+
+// HandleSonarrEpisodes shows which episodes of a series are on disk from the
+// sonarr_episodes cache, as a grid of every season or a list of one.
+func (srv *ArrServer) HandleSonarrEpisodes(s *discordgo.Session, m *discordgo.MessageCreate) {
+	title := strings.TrimSpace(strings.TrimPrefix(m.Content, "!sonarr episodes "))
+	if title == "" {
+		s.ChannelMessageSend(m.ChannelID, sonarrEpisodesUsage)
+		return
+	}
+	id, found, season, err := srv.DB.FindSonarrSeriesSeason(title)
+	if err != nil {
+		log.Error().Err(err).Str("search", title).Msg("Looking up sonarr series failed")
+		return
+	}
+	if id == 0 {
+		s.ChannelMessageSend(m.ChannelID, "Could not find a series matching "+title)
+		return
+	}
+	episodes, err := srv.DB.SonarrEpisodes(id, season)
+	if err != nil {
+		log.Error().Err(err).Int64("series", id).Msg("Reading sonarr episodes failed")
+		return
+	}
+	if len(episodes) == 0 {
+		if season >= 0 {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("No episodes of %s season %d are known", found, season))
+			return
+		}
+		s.ChannelMessageSend(m.ChannelID, "No episodes of "+found+" are known yet")
+		return
+	}
+
+	text := SeasonGrid(found, episodes, time.Now())
+	if season >= 0 {
+		text = SeasonList(found, season, episodes, time.Now())
+	}
+	for _, chunk := range ChunkMessage(text, discordMessageLimit-8) {
+		if _, err := s.ChannelMessageSend(m.ChannelID, "```\n"+chunk+"\n```"); err != nil {
+			log.Error().Err(err).Msg("Sending message failed")
+			return
+		}
+	}
+}
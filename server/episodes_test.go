@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golift.io/starr"
+	"golift.io/starr/sonarr"
+)
+
+func TestDB_SyncSonarrEpisodes(t *testing.T) {
+	requests := []string{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+"?"+r.URL.RawQuery)
+		switch r.URL.Path {
+		case "/api/v3/episode":
+			json.NewEncoder(w).Encode([]*sonarr.Episode{
+				{ID: 11, SeriesID: 1, SeasonNumber: 1, EpisodeNumber: 1, Title: "The Target", AirDate: "2002-06-02", HasFile: true, EpisodeFileID: 100},
+				{ID: 12, SeriesID: 1, SeasonNumber: 1, EpisodeNumber: 2, Title: "The Detail", AirDate: "2002-06-09"},
+			})
+		case "/api/v3/episodeFile":
+			json.NewEncoder(w).Encode([]*sonarr.EpisodeFile{
+				{ID: 100, SeriesID: 1, Size: 1 << 30, Quality: &starr.Quality{Quality: &starr.BaseQuality{Name: "Bluray-1080p"}}},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := &ArrServer{DB: db}
+	sc := sonarr.New(starr.New("token", api.URL, time.Second))
+
+	series := []*sonarr.Series{{ID: 1, Title: "The Wire", Statistics: &sonarr.Statistics{EpisodeFileCount: 1}}}
+	assert.NoError(t, srv.SyncSonarrEpisodes(sc, series))
+	assert.Len(t, requests, 2)
+
+	episodes, err := db.SonarrEpisodes(1, -1)
+	assert.NoError(t, err)
+	assert.Len(t, episodes, 2)
+	assert.Equal(t, "Bluray-1080p", episodes[0].Quality)
+	assert.Equal(t, int64(1<<30), episodes[0].Size)
+	assert.False(t, episodes[1].HasFile)
+	assert.Equal(t, "", episodes[1].Quality)
+
+	assert.NoError(t, srv.SyncSonarrEpisodes(sc, series))
+	assert.Len(t, requests, 2, "unchanged statistics are not fetched again")
+
+	series[0].Statistics.EpisodeFileCount = 2
+	assert.NoError(t, srv.SyncSonarrEpisodes(sc, series))
+	assert.Len(t, requests, 4, "changed statistics are fetched again")
+
+	assert.NoError(t, srv.SyncSonarrEpisodes(sc, nil))
+	episodes, err = db.SonarrEpisodes(1, -1)
+	assert.NoError(t, err)
+	assert.Len(t, episodes, 0, "episodes of removed series are dropped")
+}
+
+func TestDB_FindSonarrSeries(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.CacheSonarr([]*sonarr.Series{
+		{ID: 1, Title: "The Office (US)"},
+		{ID: 2, Title: "The Office"},
+		{ID: 3, Title: "Law & Order: SVU"},
+	}))
+
+	for search, want := range map[string]int64{
+		"the office":          2,
+		"office us":           1,
+		"law and order: svu":  3,
+		"Order":               3,
+		"Nothing like it all": 0,
+		"%":                   0,
+		"Of_ice":              0,
+	} {
+		id, _, err := db.FindSonarrSeries(search)
+		assert.NoError(t, err)
+		assert.Equal(t, want, id, search)
+	}
+	assert.NoError(t, db.CacheSonarr([]*sonarr.Series{
+		{ID: 4, Title: "The 100"},
+		{ID: 5, Title: "The Wire"},
+	}))
+	for search, want := range map[string][2]int64{
+		"The 100":    {4, -1},
+		"the 100 s2": {4, 2},
+		"The 100 3":  {4, 3},
+		"The Wire 3": {5, 3},
+		"Nothing 3":  {0, 3},
+		"Nothing":    {0, -1},
+	} {
+		id, _, season, err := db.FindSonarrSeriesSeason(search)
+		assert.NoError(t, err)
+		assert.Equal(t, want, [2]int64{id, season}, search)
+	}
+}
+
+func TestSeasonGrid(t *testing.T) {
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	episodes := []*Episode{
+		{SeasonNumber: 1, EpisodeNumber: 1, AirDate: "2022-01-01", HasFile: true, Quality: "HDTV-720p", Size: 1 << 20, Title: "Pilot"},
+		{SeasonNumber: 1, EpisodeNumber: 2, AirDate: "2022-01-08", Title: "Second"},
+		{SeasonNumber: 2, EpisodeNumber: 1, AirDate: "2022-07-01", Title: "Later"},
+		{SeasonNumber: 2, EpisodeNumber: 2, Title: "TBA"},
+	}
+	assert.Equal(t, "Show\nS01 ■□ 1/2\nS02 ·· 0/0\n■ on disk  □ missing  · not aired", SeasonGrid("Show", episodes, now))
+	assert.Equal(t, "Show season 1\nE01 2022-01-01 ■ HDTV-720p 1.0 MiB Pilot\nE02 2022-01-08 □ Second",
+		SeasonList("Show", 1, episodes[:2], now))
+}
+
+func TestParseEpisodesArgs(t *testing.T) {
+	title, season := parseEpisodesArgs("The Wire 3")
+	assert.Equal(t, "The Wire", title)
+	assert.Equal(t, int64(3), season)
+
+	title, season = parseEpisodesArgs("The Wire s02")
+	assert.Equal(t, "The Wire", title)
+	assert.Equal(t, int64(2), season)
+
+	title, season = parseEpisodesArgs("1883")
+	assert.Equal(t, "1883", title)
+	assert.Equal(t, int64(-1), season)
+}
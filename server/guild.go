@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Command groups are used to restrict which channels of a guild accept a
+// command.
+const (
+	CommandGroupGeneral = "general"
+	CommandGroupSearch  = "search"
+	CommandGroupRequest = "request"
+	CommandGroupAdmin   = "admin"
+)
+
+var CommandGroups = []string{CommandGroupGeneral, CommandGroupSearch, CommandGroupRequest, CommandGroupAdmin}
+
+func validCommandGroup(group string) error {
+	for _, g := range CommandGroups {
+		if g == group {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown command group %q, expected one of %s", group, strings.Join(CommandGroups, ", "))
+}
+
+func (d *DB) GuildChannelAllow(guildID, group, channelID string) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	return sqlitex.Execute(conn, "INSERT INTO guild_settings (guild_id, command_group, channel_id) VALUES (?, ?, ?) ON CONFLICT DO NOTHING", &sqlitex.ExecOptions{
+		Args: []interface{}{guildID, group, channelID},
+	})
+}
+
+func (d *DB) GuildChannelDeny(guildID, group, channelID string) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	return sqlitex.Execute(conn, "DELETE FROM guild_settings WHERE guild_id = ? AND command_group = ? AND channel_id = ?", &sqlitex.ExecOptions{
+		Args: []interface{}{guildID, group, channelID},
+	})
+}
+
+// GuildChannelClear removes all channel restrictions of group so it is
+// allowed everywhere again.
+func (d *DB) GuildChannelClear(guildID, group string) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	return sqlitex.Execute(conn, "DELETE FROM guild_settings WHERE guild_id = ? AND command_group = ?", &sqlitex.ExecOptions{
+		Args: []interface{}{guildID, group},
+	})
+}
+
+// GuildChannels returns the allowed channels of every restricted group in a
+// guild.
+func (d *DB) GuildChannels(guildID string) (map[string][]string, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	results := map[string][]string{}
+	err = sqlitex.Execute(conn, "SELECT command_group, channel_id FROM guild_settings WHERE guild_id = ? ORDER BY command_group, channel_id", &sqlitex.ExecOptions{
+		Args: []interface{}{guildID},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			group := stmt.ColumnText(0)
+			results[group] = append(results[group], stmt.ColumnText(1))
+			return nil
+		},
+	})
+	return results, err
+}
+
+// GuildChannelAllowed reports if group may be used in channelID, when it may
+// not the allowed channels are returned.
+func (d *DB) GuildChannelAllowed(guildID, group, channelID string) (bool, []string, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return false, nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	allowed := []string{}
+	err = sqlitex.Execute(conn, "SELECT channel_id FROM guild_settings WHERE guild_id = ? AND command_group = ?", &sqlitex.ExecOptions{
+		Args: []interface{}{guildID, group},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			allowed = append(allowed, stmt.ColumnText(0))
+			return nil
+		},
+	})
+	if err != nil {
+		return false, nil, err
+	}
+	if len(allowed) == 0 {
+		return true, nil, nil
+	}
+	for _, c := range allowed {
+		if c == channelID {
+			return true, nil, nil
+		}
+	}
+	return false, allowed, nil
+}
+
+const channelsUsage = "usage: !channels list | !channels allow <group> [#channel...] | !channels deny <group> [#channel...] | !channels clear <group>"
+
+// HandleChannels manages which channels of the current guild accept each
+// command group.  It is always allowed for admins so they can not lock
+// themselves out.
+func (srv *ArrServer) HandleChannels(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if !srv.IsAdmin(m) {
+		s.ChannelMessageSend(m.ChannelID, "Only admins can manage channels")
+		return
+	}
+	if m.GuildID == "" {
+		s.ChannelMessageSend(m.ChannelID, "!channels must be used in a guild channel")
+		return
+	}
+	args := strings.Fields(strings.TrimPrefix(m.Content, "!channels"))
+	if len(args) == 0 {
+		s.ChannelMessageSend(m.ChannelID, channelsUsage)
+		return
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		var groups map[string][]string
+		groups, err = srv.DB.GuildChannels(m.GuildID)
+		if err == nil {
+			s.ChannelMessageSend(m.ChannelID, FormatGuildChannels(groups))
+			return
+		}
+	case "allow", "deny":
+		if len(args) < 2 {
+			break
+		}
+		if err = validCommandGroup(args[1]); err != nil {
+			break
+		}
+		channels := args[2:]
+		if len(channels) == 0 {
+			channels = []string{m.ChannelID}
+		}
+		for _, c := range channels {
+			if args[0] == "allow" {
+				err = srv.DB.GuildChannelAllow(m.GuildID, args[1], MentionID(c))
+			} else {
+				err = srv.DB.GuildChannelDeny(m.GuildID, args[1], MentionID(c))
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			s.ChannelMessageSend(m.ChannelID, "Updated channels for "+args[1])
+			return
+		}
+	case "clear":
+		if len(args) != 2 {
+			break
+		}
+		if err = validCommandGroup(args[1]); err != nil {
+			break
+		}
+		if err = srv.DB.GuildChannelClear(m.GuildID, args[1]); err == nil {
+			s.ChannelMessageSend(m.ChannelID, args[1]+" commands are now allowed in every channel")
+			return
+		}
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("command", m.Content).Msg("Problem with channels command")
+		s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+		return
+	}
+	s.ChannelMessageSend(m.ChannelID, channelsUsage)
+}
+
+func FormatGuildChannels(groups map[string][]string) string {
+	var b bytes.Buffer
+	names := make([]string, 0, len(CommandGroups))
+	names = append(names, CommandGroups...)
+	sort.Strings(names)
+	for _, g := range names {
+		b.WriteString(g)
+		b.WriteString(": ")
+		if len(groups[g]) == 0 {
+			b.WriteString("every channel")
+		}
+		for i, c := range groups[g] {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString("<#" + c + ">")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_GuildChannelAllowed(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, _ := NewDB(dcfg)
+	defer db.Close()
+
+	allowed, channels, err := db.GuildChannelAllowed("guild-1", CommandGroupRequest, "chan-1")
+	assert.NoError(t, err)
+	assert.True(t, allowed, "groups without rows are allowed everywhere")
+	assert.Empty(t, channels)
+
+	assert.NoError(t, db.GuildChannelAllow("guild-1", CommandGroupRequest, "chan-requests"))
+	assert.NoError(t, db.GuildChannelAllow("guild-1", CommandGroupRequest, "chan-requests"), "allowing twice is not an error")
+
+	allowed, channels, err = db.GuildChannelAllowed("guild-1", CommandGroupRequest, "chan-1")
+	assert.NoError(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, []string{"chan-requests"}, channels)
+
+	allowed, _, err = db.GuildChannelAllowed("guild-1", CommandGroupRequest, "chan-requests")
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, _, err = db.GuildChannelAllowed("guild-2", CommandGroupRequest, "chan-1")
+	assert.NoError(t, err)
+	assert.True(t, allowed, "restrictions are per guild")
+
+	allowed, _, err = db.GuildChannelAllowed("guild-1", CommandGroupSearch, "chan-1")
+	assert.NoError(t, err)
+	assert.True(t, allowed, "restrictions are per group")
+
+	groups, err := db.GuildChannels("guild-1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{CommandGroupRequest: {"chan-requests"}}, groups)
+
+	assert.NoError(t, db.GuildChannelDeny("guild-1", CommandGroupRequest, "chan-requests"))
+	allowed, _, err = db.GuildChannelAllowed("guild-1", CommandGroupRequest, "chan-1")
+	assert.NoError(t, err)
+	assert.True(t, allowed, "removing the last channel allows the group everywhere")
+}
+
+func TestMatchCommand(t *testing.T) {
+	assert.Nil(t, MatchCommand("hello"))
+	assert.Nil(t, MatchCommand("!quotas"))
+	assert.Equal(t, CommandGroupGeneral, MatchCommand("ping").Group)
+	assert.Equal(t, CommandGroupSearch, MatchCommand("!radarr search alien").Group)
+	assert.Equal(t, CommandGroupRequest, MatchCommand("!radarr add 348").Group)
+	assert.Equal(t, CommandGroupRequest, MatchCommand("!quota").Group)
+	assert.True(t, MatchCommand("!channels list").Always)
+	assert.Equal(t, "123", MentionID("<#123>"))
+	assert.Equal(t, "123", MentionID("<@!123>"))
+	assert.Equal(t, "123", MentionID("<@&123>"))
+}
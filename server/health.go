@@ -0,0 +1,379 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	"golift.io/starr"
+	"sort"
+	"strings"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// HealthUnreachable is the issue recorded when an instance does not answer,
+// its other issues are kept until it answers again.
+var HealthUnreachable = &HealthIssue{Source: "arrmate", Type: "error", Message: "unreachable"}
+
+// StarrInstance is a configured sonarr or radarr, either the global one or a
+// guild override of starr.<app>.url.
+type StarrInstance struct {
+	App     string
+	GuildID string
+}
+
+// Name identifies the instance in messages and the health tables.
+func (i *StarrInstance) Name() string {
+	if i.GuildID == "" {
+		return i.App
+	}
+	return i.App + " (guild " + i.GuildID + ")"
+}
+
+// HealthIssue is an entry of the starr health endpoint.
+type HealthIssue struct {
+	Source  string `json:"source"`
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	WikiURL string `json:"wikiUrl"`
+}
+
+func (h *HealthIssue) key() string {
+	return h.Source + "\x00" + h.Message
+}
+
+// SystemStatus is the part of the starr system/status endpoint arrmate
+// reports.
+type SystemStatus struct {
+	AppName string `json:"appName"`
+	Version string `json:"version"`
+}
+
+// StarrHealth is the last check of an instance.
+type StarrHealth struct {
+	Instance  string
+	Version   string
+	Error     string
+	CheckedAt time.Time
+	Issues    []*HealthIssue
+}
+
+// Summary formats the health of the instance for discord.
+func (h *StarrHealth) Summary(now time.Time) string {
+	line := h.Instance
+	if h.Version != "" {
+		line += " " + h.Version
+	}
+	if len(h.Issues) == 0 {
+		line += ": ok"
+	}
+	lines := []string{fmt.Sprintf("%s (checked %s ago)", line, now.Sub(h.CheckedAt).Round(time.Second))}
+	for _, i := range h.Issues {
+		lines = append(lines, fmt.Sprintf("  %s: %s", i.Type, i.Message))
+	}
+	if h.Error != "" {
+		lines = append(lines, "  last check: "+h.Error)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// HealthAlert is an issue that appeared or cleared on an instance.
+type HealthAlert struct {
+	Instance  string
+	Issue     *HealthIssue
+	Recovered bool
+}
+
+// String formats the alert for the ops channel.
+func (a *HealthAlert) String() string {
+	if a.Recovered {
+		return fmt.Sprintf("Health %s recovered: %s", a.Instance, a.Issue.Message)
+	}
+	return fmt.Sprintf("Health %s %s: %s", a.Instance, a.Issue.Type, a.Issue.Message)
+}
+
+// FetchSystemStatus reads the system/status endpoint of a StarrClient.
+func FetchSystemStatus(api starr.APIer) (*SystemStatus, error) {
+	var result SystemStatus
+	if err := api.GetInto(context.TODO(), "v3/system/status", nil, &result); err != nil {
+		return nil, fmt.Errorf("api.Get(system/status): %w", err)
+	}
+	return &result, nil
+}
+
+// FetchHealth reads the warnings and errors of the health endpoint of a
+// StarrClient, notices are dropped.
+func FetchHealth(api starr.APIer) ([]*HealthIssue, error) {
+	var results []*HealthIssue
+	if err := api.GetInto(context.TODO(), "v3/health", nil, &results); err != nil {
+		return nil, fmt.Errorf("api.Get(health): %w", err)
+	}
+	issues := []*HealthIssue{}
+	for _, h := range results {
+		if h.Type == "warning" || h.Type == "error" {
+			issues = append(issues, h)
+		}
+	}
+	return issues, nil
+}
+
+// StarrInstances returns the global sonarr and radarr plus every guild that
+// overrides their url, sorted by name.
+func (d *DB) StarrInstances() ([]*StarrInstance, error) {
+	keys, err := d.ConfigList()
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, d.Overlay.Keys()...)
+
+	seen := map[string]bool{}
+	results := []*StarrInstance{}
+	add := func(i *StarrInstance) {
+		if !seen[i.Name()] {
+			seen[i.Name()] = true
+			results = append(results, i)
+		}
+	}
+	for _, app := range []string{"sonarr", "radarr"} {
+		found, _, err := d.ConfigGet("starr." + app + ".url")
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			add(&StarrInstance{App: app})
+		}
+		for _, k := range keys {
+			if strings.HasPrefix(k, "guild:") && BaseKey(k) == "starr."+app+".url" {
+				add(&StarrInstance{App: app, GuildID: strings.SplitN(k, ":", 3)[1]})
+			}
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name() < results[j].Name() })
+	return results, nil
+}
+
+// UpdateStarrHealth records a check of inst and returns the issues that are
+// new and the ones that cleared since the last check.  When the check failed
+// with checkErr the issues it can no longer see are kept, not cleared.
+func (d *DB) UpdateStarrHealth(inst *StarrInstance, version, checkErr string, issues []*HealthIssue, now time.Time) (added, cleared []*HealthIssue, err error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	doUpdate := func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+		existing := map[string]*HealthIssue{}
+		err = sqlitex.Execute(conn, "SELECT source, type, message, wiki_url FROM starr_health WHERE instance = ?", &sqlitex.ExecOptions{
+			Args: []interface{}{inst.Name()},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				h := &HealthIssue{Source: stmt.ColumnText(0), Type: stmt.ColumnText(1), Message: stmt.ColumnText(2), WikiURL: stmt.ColumnText(3)}
+				existing[h.key()] = h
+				return nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+		for _, h := range issues {
+			if _, ok := existing[h.key()]; ok {
+				delete(existing, h.key())
+			} else {
+				added = append(added, h)
+			}
+			err = sqlitex.Execute(conn, `INSERT INTO starr_health (instance, source, type, message, wiki_url, first_seen, last_seen) VALUES (?, ?, ?, ?, ?, ?, ?)
+				ON CONFLICT(instance, source, message) DO UPDATE SET type = EXCLUDED.type, wiki_url = EXCLUDED.wiki_url, last_seen = EXCLUDED.last_seen`, &sqlitex.ExecOptions{
+				Args: []interface{}{inst.Name(), h.Source, h.Type, h.Message, h.WikiURL, now.Unix(), now.Unix()},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for _, h := range existing {
+			if checkErr != "" && h.key() != HealthUnreachable.key() {
+				continue
+			}
+			cleared = append(cleared, h)
+			err = sqlitex.Execute(conn, "DELETE FROM starr_health WHERE instance = ? AND source = ? AND message = ?", &sqlitex.ExecOptions{
+				Args: []interface{}{inst.Name(), h.Source, h.Message},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return sqlitex.Execute(conn, `INSERT INTO starr_status (instance, app, guild_id, version, error, checked_at) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(instance) DO UPDATE SET version = COALESCE(EXCLUDED.version, version), error = EXCLUDED.error, checked_at = EXCLUDED.checked_at`, &sqlitex.ExecOptions{
+			Args: []interface{}{inst.Name(), inst.App, inst.GuildID, nullable(version, version != ""), nullable(checkErr, checkErr != ""), now.Unix()},
+		})
+	}
+	if err := doUpdate(); err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(cleared, func(i, j int) bool { return cleared[i].Message < cleared[j].Message })
+	return added, cleared, nil
+}
+
+// StarrHealth returns the last check of every instance ordered by name.
+func (d *DB) StarrHealth() ([]*StarrHealth, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	results := []*StarrHealth{}
+	byInstance := map[string]*StarrHealth{}
+	err = sqlitex.Execute(conn, "SELECT instance, version, error, checked_at FROM starr_status ORDER BY instance", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			h := &StarrHealth{
+				Instance:  stmt.ColumnText(0),
+				Version:   stmt.ColumnText(1),
+				Error:     stmt.ColumnText(2),
+				CheckedAt: time.Unix(stmt.ColumnInt64(3), 0),
+			}
+			byInstance[h.Instance] = h
+			results = append(results, h)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = sqlitex.Execute(conn, "SELECT instance, source, type, message, wiki_url FROM starr_health ORDER BY instance, type, message", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if h, ok := byInstance[stmt.ColumnText(0)]; ok {
+				h.Issues = append(h.Issues, &HealthIssue{Source: stmt.ColumnText(1), Type: stmt.ColumnText(2), Message: stmt.ColumnText(3), WikiURL: stmt.ColumnText(4)})
+			}
+			return nil
+		},
+	})
+	return results, err
+}
+
+// SetupHealth schedules CheckHealth every health.check_interval.
+func (srv *ArrServer) SetupHealth() error {
+	interval, err := srv.DB.ConfigDuration("health.check_interval")
+	if err != nil {
+		return err
+	}
+	job, err := srv.Cron.Every(interval).StartImmediately().Do(func() {
+		if err := srv.CheckHealth(time.Now()); err != nil {
+			log.Warn().Err(err).Msg("Checking health failed")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	job.Tag("health")
+	return nil
+}
+
+// CheckInstanceHealth polls the status and health of inst and records them.
+func (srv *ArrServer) CheckInstanceHealth(inst *StarrInstance, now time.Time) ([]*HealthAlert, error) {
+	var version, checkErr string
+	issues := []*HealthIssue{}
+	api, err := srv.StarrClient(inst.GuildID, inst.App)
+	if err == nil {
+		var status *SystemStatus
+		if status, err = FetchSystemStatus(api); err == nil {
+			version = status.Version
+			issues, err = FetchHealth(api)
+		}
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("instance", inst.Name()).Msg("Checking starr health failed")
+		checkErr = err.Error()
+		issues = []*HealthIssue{HealthUnreachable}
+	}
+
+	added, cleared, err := srv.DB.UpdateStarrHealth(inst, version, checkErr, issues, now)
+	if err != nil {
+		return nil, err
+	}
+	results := []*HealthAlert{}
+	for _, h := range added {
+		results = append(results, &HealthAlert{Instance: inst.Name(), Issue: h})
+	}
+	for _, h := range cleared {
+		results = append(results, &HealthAlert{Instance: inst.Name(), Issue: h, Recovered: true})
+	}
+	return results, nil
+}
+
+// CheckHealth checks every starr instance and sends new warnings, errors and
+// recoveries to health.alert_channel.
+func (srv *ArrServer) CheckHealth(now time.Time) error {
+	instances, err := srv.DB.StarrInstances()
+	if err != nil {
+		return err
+	}
+	lines := []string{}
+	for _, inst := range instances {
+		alerts, err := srv.CheckInstanceHealth(inst, now)
+		if err != nil {
+			return err
+		}
+		for _, a := range alerts {
+			lines = append(lines, a.String())
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	found, channel, err := srv.DB.ConfigGet("health.alert_channel")
+	if err != nil {
+		return err
+	}
+	session := srv.Session()
+	if !found || session == nil {
+		log.Warn().Strs("alerts", lines).Msg("Health alerts without health.alert_channel")
+		return nil
+	}
+	for _, msg := range ChunkMessage(strings.Join(lines, "\n"), discordMessageLimit) {
+		if _, err := session.ChannelMessageSend(channel, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PlexHealth reports if plex answers and how long it took.
+func (srv *ArrServer) PlexHealth() string {
+	plexConn := srv.PlexConn()
+	if plexConn == nil {
+		return "plex: not configured"
+	}
+	start := time.Now()
+	ok, err := plexConn.Test()
+	took := time.Since(start).Round(time.Millisecond)
+	switch {
+	case err != nil:
+		return "plex: unreachable: " + err.Error()
+	case !ok:
+		return "plex: unreachable"
+	}
+	return fmt.Sprintf("plex: ok (%s)", took)
+}
+
+// HandleHealth summarizes plex, discord and the last check of every starr
+// instance.
+func (srv *ArrServer) HandleHealth(s *discordgo.Session, m *discordgo.MessageCreate) {
+	lines := []string{
+		srv.PlexHealth(),
+		fmt.Sprintf("discord: %s heartbeat latency", s.HeartbeatLatency().Round(time.Millisecond)),
+	}
+	health, err := srv.DB.StarrHealth()
+	if err != nil {
+		log.Error().Err(err).Msg("Reading starr health failed")
+		return
+	}
+	for _, h := range health {
+		lines = append(lines, h.Summary(time.Now()))
+	}
+	for _, msg := range ChunkMessage(strings.Join(lines, "\n"), discordMessageLimit) {
+		s.ChannelMessageSend(m.ChannelID, msg)
+	}
+}
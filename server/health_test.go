@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArrServer_CheckInstanceHealth(t *testing.T) {
+	issues := []*HealthIssue{
+		{Source: "IndexerStatusCheck", Type: "warning", Message: "Indexers unavailable due to failures: nzbgeek"},
+		{Source: "UpdateCheck", Type: "notice", Message: "New update is available"},
+	}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v3/system/status":
+			json.NewEncoder(w).Encode(&SystemStatus{AppName: "Sonarr", Version: "3.0.9.1549"})
+		case "/api/v3/health":
+			json.NewEncoder(w).Encode(issues)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := &ArrServer{DB: db}
+	assert.NoError(t, db.ConfigSet("starr.sonarr.url", api.URL))
+	assert.NoError(t, db.ConfigSet("starr.sonarr.token", "token"))
+	assert.NoError(t, db.ConfigSet(GuildKey("1234", "starr.radarr.url"), "http://127.0.0.1:1/"))
+
+	instances, err := db.StarrInstances()
+	assert.NoError(t, err)
+	assert.Equal(t, []*StarrInstance{{App: "radarr", GuildID: "1234"}, {App: "sonarr"}}, instances)
+	radarr, sonarr := instances[0], instances[1]
+
+	// checked_at is stored in seconds.
+	now := time.Unix(time.Now().Unix(), 0)
+	alerts, err := srv.CheckInstanceHealth(sonarr, now)
+	assert.NoError(t, err)
+	assert.Len(t, alerts, 1, "notices are not alerts")
+	assert.Equal(t, "Health sonarr warning: Indexers unavailable due to failures: nzbgeek", alerts[0].String())
+
+	alerts, err = srv.CheckInstanceHealth(sonarr, now.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Len(t, alerts, 0, "a warning is only sent when it appears")
+
+	alerts, err = srv.CheckInstanceHealth(radarr, now)
+	assert.NoError(t, err)
+	assert.Len(t, alerts, 1)
+	assert.Equal(t, "Health radarr (guild 1234) error: unreachable", alerts[0].String())
+
+	health, err := db.StarrHealth()
+	assert.NoError(t, err)
+	assert.Len(t, health, 2)
+	assert.Equal(t, "radarr (guild 1234)", health[0].Instance)
+	assert.NotEmpty(t, health[0].Error)
+	assert.Equal(t, "sonarr 3.0.9.1549 (checked 1m0s ago)\n  warning: Indexers unavailable due to failures: nzbgeek",
+		health[1].Summary(now.Add(2*time.Minute)))
+
+	issues = issues[1:]
+	alerts, err = srv.CheckInstanceHealth(sonarr, now.Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.Len(t, alerts, 1)
+	assert.Equal(t, "Health sonarr recovered: Indexers unavailable due to failures: nzbgeek", alerts[0].String())
+
+	health, err = db.StarrHealth()
+	assert.NoError(t, err)
+	assert.Equal(t, "sonarr 3.0.9.1549: ok (checked 0s ago)", health[1].Summary(now.Add(2*time.Minute)))
+}
+
+func TestDB_UpdateStarrHealth_Unreachable(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	inst := &StarrInstance{App: "sonarr"}
+	warning := &HealthIssue{Source: "DownloadClientCheck", Type: "error", Message: "Unable to communicate with sabnzbd"}
+	now := time.Now()
+	added, _, err := db.UpdateStarrHealth(inst, "3.0.9", "", []*HealthIssue{warning}, now)
+	assert.NoError(t, err)
+	assert.Len(t, added, 1)
+
+	added, cleared, err := db.UpdateStarrHealth(inst, "", "connection refused", []*HealthIssue{HealthUnreachable}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []*HealthIssue{HealthUnreachable}, added)
+	assert.Len(t, cleared, 0, "issues are kept while the instance is unreachable")
+
+	_, cleared, err = db.UpdateStarrHealth(inst, "3.0.9", "", []*HealthIssue{}, now)
+	assert.NoError(t, err)
+	assert.Len(t, cleared, 2)
+
+	health, err := db.StarrHealth()
+	assert.NoError(t, err)
+	assert.Equal(t, "3.0.9", health[0].Version)
+	assert.Empty(t, health[0].Error)
+}
@@ -0,0 +1,465 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	"golift.io/starr/radarr"
+	"golift.io/starr/sonarr"
+	"net/url"
+	"strconv"
+	"strings"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Admin actions on cached movies and series.
+const (
+	MediaMonitor   = "monitor"
+	MediaUnmonitor = "unmonitor"
+	MediaDelete    = "delete"
+	MediaGrab      = "grab"
+)
+
+// Button custom ids, the confirm button carries the whole action so nothing
+// is kept between the prompt and the click.  An ask button carries it too and
+// opens the prompt for buttons listed ahead of it, like those of !cleanup.
+const (
+	mediaConfirmPrefix = "media:"
+	mediaCancelPrefix  = "media-cancel:"
+	mediaAskPrefix     = "media-ask:"
+)
+
+// MediaAction is an admin action on a movie or series of the cache.  Season
+// limits a sonarr action to a season and is -1 for the whole series,
+// DeleteFiles makes a delete remove the files on disk too.
+type MediaAction struct {
+	UserID      string
+	App         string
+	Action      string
+	ID          int64
+	Season      int
+	DeleteFiles bool
+}
+
+// ParseMediaAction parses the action, id and option of
+// !<app> <action> <id> [season|files].
+func ParseMediaAction(userID, app string, args []string) (*MediaAction, error) {
+	usage := fmt.Sprintf("usage: !%s monitor|unmonitor|delete|grab <id>", app)
+	if app == "sonarr" {
+		usage += " [season], !sonarr delete <id> [files]"
+	} else {
+		usage += ", !radarr delete <id> [files]"
+	}
+	if len(args) < 2 || len(args) > 3 {
+		return nil, errors.New(usage)
+	}
+	a := &MediaAction{UserID: userID, App: app, Action: args[0], Season: -1}
+	switch a.Action {
+	case MediaMonitor, MediaUnmonitor, MediaDelete, MediaGrab, MediaCleanup:
+	default:
+		return nil, errors.New(usage)
+	}
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || id <= 0 {
+		return nil, fmt.Errorf("%q is not an id, %s", args[1], usage)
+	}
+	a.ID = id
+	if len(args) == 3 {
+		switch {
+		case a.Action == MediaDelete && args[2] == "files":
+			a.DeleteFiles = true
+		case a.Action != MediaDelete && app == "sonarr":
+			season, err := strconv.Atoi(args[2])
+			if err != nil || season < 0 {
+				return nil, fmt.Errorf("%q is not a season, %s", args[2], usage)
+			}
+			a.Season = season
+		default:
+			return nil, errors.New(usage)
+		}
+	}
+	return a, nil
+}
+
+// CustomID encodes the action as the id of its confirm button.
+func (a *MediaAction) CustomID() string {
+	return a.buttonID(mediaConfirmPrefix)
+}
+
+// AskID encodes the action as the id of a button that asks to confirm it.
+func (a *MediaAction) AskID() string {
+	return a.buttonID(mediaAskPrefix)
+}
+
+func (a *MediaAction) buttonID(prefix string) string {
+	return fmt.Sprintf("%s%s:%s:%s:%d:%d:%t", prefix, a.UserID, a.App, a.Action, a.ID, a.Season, a.DeleteFiles)
+}
+
+// ParseMediaActionID decodes the id of a confirm or ask button.
+func ParseMediaActionID(customID string) (*MediaAction, error) {
+	var parts []string
+	for _, prefix := range []string{mediaConfirmPrefix, mediaAskPrefix} {
+		if strings.HasPrefix(customID, prefix) {
+			parts = strings.Split(strings.TrimPrefix(customID, prefix), ":")
+		}
+	}
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("%q is not a media action", customID)
+	}
+	args := []string{parts[2], parts[3]}
+	if parts[4] != "-1" {
+		args = append(args, parts[4])
+	}
+	if parts[5] == "true" {
+		args = append(args, "files")
+	}
+	return ParseMediaAction(parts[0], parts[1], args)
+}
+
+// Describe says what the action does to title.
+func (a *MediaAction) Describe(title string) string {
+	target := title
+	if a.Season >= 0 {
+		target = fmt.Sprintf("season %d of %s", a.Season, title)
+	}
+	switch a.Action {
+	case MediaDelete:
+		if a.DeleteFiles {
+			return fmt.Sprintf("delete %s from %s and its files", target, a.App)
+		}
+		return fmt.Sprintf("delete %s from %s, keeping its files", target, a.App)
+	case MediaGrab:
+		return fmt.Sprintf("search the indexers for %s in %s and grab a release", target, a.App)
+	case MediaCleanup:
+		return fmt.Sprintf("delete the files of %s and unmonitor it in %s", target, a.App)
+	}
+	return fmt.Sprintf("%s %s in %s", a.Action, target, a.App)
+}
+
+// CachedTitle returns the title and year of a movie or series in the cache,
+// "" when the id is not cached.
+func (d *DB) CachedTitle(app string, id int64) (string, error) {
+	if app != "sonarr" && app != "radarr" {
+		return "", fmt.Errorf("unknown starr app %q", app)
+	}
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return "", err
+	}
+	defer d.Pool.Put(conn)
+
+	var title string
+	err = sqlitex.Execute(conn, "SELECT title, year FROM "+app+" WHERE id = ?", &sqlitex.ExecOptions{
+		Args: []interface{}{id},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			title = fmt.Sprintf("%s (%d)", stmt.ColumnText(0), stmt.ColumnInt64(1))
+			return nil
+		},
+	})
+	return title, err
+}
+
+// DeleteCachedMovie drops a movie from the radarr cache.
+func (d *DB) DeleteCachedMovie(id int64) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	return sqlitex.Execute(conn, "DELETE FROM radarr WHERE id = ?;", &sqlitex.ExecOptions{
+		Args: []interface{}{id},
+	})
+}
+
+// DeleteCachedSeries drops a series and its episodes from the sonarr cache.
+func (d *DB) DeleteCachedSeries(id int64) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	doUpdate := func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+		err = sqlitex.Execute(conn, "DELETE FROM sonarr WHERE id = ?;", &sqlitex.ExecOptions{
+			Args: []interface{}{id},
+		})
+		if err != nil {
+			return err
+		}
+		for _, table := range []string{"sonarr_episodes", "sonarr_episode_sync"} {
+			err = sqlitex.Execute(conn, "DELETE FROM "+table+" WHERE series_id = ?;", &sqlitex.ExecOptions{
+				Args: []interface{}{id},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return doUpdate()
+}
+
+// SetCachedSeasonMonitored marks the cached episodes of a season like sonarr
+// does when the season is monitored or unmonitored.
+func (d *DB) SetCachedSeasonMonitored(seriesID int64, season int, monitored bool) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	return sqlitex.Execute(conn, "UPDATE sonarr_episodes SET monitored = ? WHERE series_id = ? AND season_number = ?;", &sqlitex.ExecOptions{
+		Args: []interface{}{FormatBool(monitored), seriesID, season},
+	})
+}
+
+// RunMediaAction calls sonarr or radarr and updates the cache right away
+// instead of waiting for the next sync.  Ids come from the cache so the
+// global instances are used.
+func (srv *ArrServer) RunMediaAction(a *MediaAction) error {
+	switch a.App {
+	case "radarr":
+		return srv.runRadarrAction(a)
+	case "sonarr":
+		return srv.runSonarrAction(a)
+	}
+	return fmt.Errorf("unknown starr app %q", a.App)
+}
+
+func (srv *ArrServer) runRadarrAction(a *MediaAction) error {
+	r, err := srv.NewRadarr("")
+	if err != nil {
+		return err
+	}
+	switch a.Action {
+	case MediaMonitor, MediaUnmonitor:
+		movie, err := r.GetMovieByID(a.ID)
+		if err != nil {
+			return err
+		}
+		movie.Monitored = a.Action == MediaMonitor
+		if err := r.UpdateMovie(a.ID, movie); err != nil {
+			return err
+		}
+		return srv.DB.UpdateCachedMovie(movie)
+	case MediaDelete:
+		params := url.Values{"deleteFiles": {strconv.FormatBool(a.DeleteFiles)}}
+		if _, err := r.Delete(context.TODO(), "v3/movie/"+strconv.FormatInt(a.ID, 10), params); err != nil {
+			return fmt.Errorf("api.Delete(movie): %w", err)
+		}
+		return srv.DB.DeleteCachedMovie(a.ID)
+	case MediaGrab:
+		_, err := r.SendCommand(&radarr.CommandRequest{Name: "MoviesSearch", MovieIDs: []int64{a.ID}})
+		return err
+	case MediaCleanup:
+		return srv.cleanupMovie(a.ID)
+	}
+	return fmt.Errorf("unknown action %q", a.Action)
+}
+
+func (srv *ArrServer) runSonarrAction(a *MediaAction) error {
+	sc, err := srv.NewSonarr("")
+	if err != nil {
+		return err
+	}
+	switch a.Action {
+	case MediaMonitor, MediaUnmonitor:
+		series, err := sc.GetSeriesByID(a.ID)
+		if err != nil {
+			return err
+		}
+		monitored := a.Action == MediaMonitor
+		if a.Season < 0 {
+			series.Monitored = monitored
+		} else {
+			var found *sonarr.Season
+			for _, s := range series.Seasons {
+				if s.SeasonNumber == a.Season {
+					found = s
+				}
+			}
+			if found == nil {
+				return fmt.Errorf("%s has no season %d", series.Title, a.Season)
+			}
+			found.Monitored = monitored
+		}
+		if err := sc.UpdateSeries(a.ID, series); err != nil {
+			return err
+		}
+		if err := srv.DB.UpdateCachedSeries(series); err != nil {
+			return err
+		}
+		if a.Season < 0 {
+			return nil
+		}
+		return srv.DB.SetCachedSeasonMonitored(a.ID, a.Season, monitored)
+	case MediaDelete:
+		params := url.Values{"deleteFiles": {strconv.FormatBool(a.DeleteFiles)}}
+		if _, err := sc.Delete(context.TODO(), "v3/series/"+strconv.FormatInt(a.ID, 10), params); err != nil {
+			return fmt.Errorf("api.Delete(series): %w", err)
+		}
+		return srv.DB.DeleteCachedSeries(a.ID)
+	case MediaGrab:
+		if a.Season < 0 {
+			_, err := sc.SendCommand(&sonarr.CommandRequest{Name: "SeriesSearch", SeriesID: a.ID})
+			return err
+		}
+		// sonarr.CommandRequest has no season number.
+		body, err := json.Marshal(map[string]interface{}{"name": "SeasonSearch", "seriesId": a.ID, "seasonNumber": a.Season})
+		if err != nil {
+			return err
+		}
+		if _, err := sc.Post(context.TODO(), "v3/command", nil, bytes.NewReader(body)); err != nil {
+			return fmt.Errorf("api.Post(command): %w", err)
+		}
+		return nil
+	case MediaCleanup:
+		return srv.cleanupSeries(a.ID)
+	}
+	return fmt.Errorf("unknown action %q", a.Action)
+}
+
+// HandleMediaAction asks an admin to confirm !radarr or !sonarr monitor,
+// unmonitor, delete and grab with a button.  The actions change the global
+// instances so guild admins are not enough.
+func (srv *ArrServer) HandleMediaAction(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if !srv.IsGlobalAdmin(m) {
+		s.ChannelMessageSend(m.ChannelID, "Only global admins can change media")
+		return
+	}
+	args := strings.Fields(strings.TrimPrefix(m.Content, "!"))
+	a, err := ParseMediaAction(m.Author.ID, args[0], args[1:])
+	if err != nil {
+		s.ChannelMessageSend(m.ChannelID, err.Error())
+		return
+	}
+	title, err := srv.DB.CachedTitle(a.App, a.ID)
+	if err != nil {
+		log.Error().Err(err).Str("app", a.App).Int64("id", a.ID).Msg("Reading cached title failed")
+		return
+	}
+	if title == "" {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("No %s item with id %d, see !%s search", a.App, a.ID, a.App))
+		return
+	}
+	content, components := a.Prompt(title)
+	_, err = s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{Content: content, Components: components})
+	if err != nil {
+		log.Error().Err(err).Msg("Sending confirmation failed")
+	}
+}
+
+// Prompt is the message asking to confirm the action on title, with its
+// confirm and cancel buttons.
+func (a *MediaAction) Prompt(title string) (string, []discordgo.MessageComponent) {
+	style := discordgo.PrimaryButton
+	if a.Action == MediaDelete || a.Action == MediaCleanup {
+		style = discordgo.DangerButton
+	}
+	return "Confirm: " + a.Describe(title) + "?", []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+		discordgo.Button{Label: strings.ToUpper(a.Action[:1]) + a.Action[1:], Style: style, CustomID: a.CustomID()},
+		discordgo.Button{Label: "Cancel", Style: discordgo.SecondaryButton, CustomID: mediaCancelPrefix + a.UserID},
+	}}}
+}
+
+// DiscordInteractionHandler handles the ask, confirm and cancel buttons of
+// media actions, only the global admin who asked may press them.
+func (srv *ArrServer) DiscordInteractionHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent {
+		return
+	}
+	customID := i.MessageComponentData().CustomID
+	var userID string
+	switch {
+	case strings.HasPrefix(customID, mediaCancelPrefix):
+		userID = strings.TrimPrefix(customID, mediaCancelPrefix)
+	case strings.HasPrefix(customID, mediaConfirmPrefix):
+		userID = strings.SplitN(strings.TrimPrefix(customID, mediaConfirmPrefix), ":", 2)[0]
+	case strings.HasPrefix(customID, mediaAskPrefix):
+		userID = strings.SplitN(strings.TrimPrefix(customID, mediaAskPrefix), ":", 2)[0]
+	default:
+		return
+	}
+	if interactionUserID(i) != userID || !srv.IsInteractionGlobalAdmin(i) {
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{Content: "Only <@" + userID + "> can answer this", Flags: uint64(discordgo.MessageFlagsEphemeral)},
+		})
+		return
+	}
+
+	if strings.HasPrefix(customID, mediaAskPrefix) {
+		srv.askMediaAction(s, i, customID)
+		return
+	}
+	reply := "Cancelled"
+	if strings.HasPrefix(customID, mediaConfirmPrefix) {
+		reply = srv.confirmMediaAction(customID)
+	}
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{Content: reply, Components: []discordgo.MessageComponent{}},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Answering interaction failed")
+	}
+}
+
+// askMediaAction answers an ask button with a new confirm prompt, the
+// message holding the button is left as is so its other buttons still work.
+func (srv *ArrServer) askMediaAction(s *discordgo.Session, i *discordgo.InteractionCreate, customID string) {
+	data := &discordgo.InteractionResponseData{}
+	a, err := ParseMediaActionID(customID)
+	if err != nil {
+		data.Content = "Error: " + err.Error()
+	} else {
+		title, err := srv.DB.CachedTitle(a.App, a.ID)
+		if err != nil || title == "" {
+			title = fmt.Sprintf("id %d", a.ID)
+		}
+		data.Content, data.Components = a.Prompt(title)
+	}
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: data,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Answering interaction failed")
+	}
+}
+
+// confirmMediaAction runs the action of a confirm button and returns what
+// to replace the prompt with.
+func (srv *ArrServer) confirmMediaAction(customID string) string {
+	a, err := ParseMediaActionID(customID)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	title, err := srv.DB.CachedTitle(a.App, a.ID)
+	if err != nil || title == "" {
+		title = fmt.Sprintf("id %d", a.ID)
+	}
+	if err := srv.RunMediaAction(a); err != nil {
+		log.Error().Err(err).Str("app", a.App).Str("action", a.Action).Int64("id", a.ID).Msg("Media action failed")
+		return "Could not " + a.Describe(title) + ": " + err.Error()
+	}
+	log.Info().Str("user", a.UserID).Str("app", a.App).Str("action", a.Action).Int64("id", a.ID).Msg("Media action")
+	return "Done: " + a.Describe(title)
+}
+
+func interactionUserID(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"golift.io/starr/radarr"
+	"golift.io/starr/sonarr"
+)
+
+func TestParseMediaAction(t *testing.T) {
+	a, err := ParseMediaAction("42", "sonarr", []string{"unmonitor", "7", "2"})
+	assert.NoError(t, err)
+	assert.Equal(t, &MediaAction{UserID: "42", App: "sonarr", Action: MediaUnmonitor, ID: 7, Season: 2}, a)
+	assert.Equal(t, "unmonitor season 2 of The Wire (2002) in sonarr", a.Describe("The Wire (2002)"))
+
+	back, err := ParseMediaActionID(a.CustomID())
+	assert.NoError(t, err)
+	assert.Equal(t, a, back)
+
+	a, err = ParseMediaAction("42", "radarr", []string{"delete", "3", "files"})
+	assert.NoError(t, err)
+	assert.True(t, a.DeleteFiles)
+	assert.Equal(t, "delete Alien (1979) from radarr and its files", a.Describe("Alien (1979)"))
+	back, err = ParseMediaActionID(a.CustomID())
+	assert.NoError(t, err)
+	assert.Equal(t, a, back)
+
+	for _, args := range [][]string{
+		{"monitor"},
+		{"rename", "3"},
+		{"monitor", "x"},
+		{"monitor", "3", "2"},
+		{"delete", "3", "all"},
+	} {
+		_, err := ParseMediaAction("42", "radarr", args)
+		assert.Error(t, err, args)
+	}
+	a, err = ParseMediaAction("42", "sonarr", []string{"grab", "7", "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "search the indexers for season 1 of The Wire (2002) in sonarr and grab a release", a.Describe("The Wire (2002)"))
+	_, err = ParseMediaAction("42", "radarr", []string{"search", "3"})
+	assert.Error(t, err, "search is for the cache only")
+
+	_, err = ParseMediaActionID("media-cancel:42")
+	assert.Error(t, err)
+}
+
+func TestArrServer_RunMediaAction(t *testing.T) {
+	movie := &radarr.Movie{ID: 3, Title: "Alien", Year: 1979, Monitored: true}
+	series := &sonarr.Series{ID: 7, Title: "The Wire", Year: 2002, Monitored: true, Seasons: []*sonarr.Season{
+		{SeasonNumber: 1, Monitored: true},
+		{SeasonNumber: 2, Monitored: true},
+	}}
+	commands := []map[string]interface{}{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v3/movie/3":
+			json.NewEncoder(w).Encode(movie)
+		case "PUT /api/v3/movie/3":
+			json.NewDecoder(r.Body).Decode(movie)
+			json.NewEncoder(w).Encode(movie)
+		case "GET /api/v3/series/7":
+			json.NewEncoder(w).Encode(series)
+		case "PUT /api/v3/series/7":
+			json.NewDecoder(r.Body).Decode(series)
+			json.NewEncoder(w).Encode(series)
+		case "DELETE /api/v3/movie/3":
+			assert.Equal(t, "true", r.URL.Query().Get("deleteFiles"))
+		case "POST /api/v3/command":
+			var cmd map[string]interface{}
+			b, _ := io.ReadAll(r.Body)
+			assert.NoError(t, json.Unmarshal(b, &cmd))
+			commands = append(commands, cmd)
+			w.Write([]byte(`{"id": 1}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := &ArrServer{DB: db}
+	for _, app := range []string{"sonarr", "radarr"} {
+		assert.NoError(t, db.ConfigSet("starr."+app+".url", api.URL))
+		assert.NoError(t, db.ConfigSet("starr."+app+".token", "token"))
+	}
+	assert.NoError(t, db.CacheRadarr([]*radarr.Movie{movie}))
+	assert.NoError(t, db.CacheSonarr([]*sonarr.Series{series}))
+	assert.NoError(t, db.CacheSonarrEpisodes(7, "fingerprint", []*sonarr.Episode{
+		{ID: 1, SeasonNumber: 2, EpisodeNumber: 1, Monitored: true},
+		{ID: 2, SeasonNumber: 1, EpisodeNumber: 1, Monitored: true},
+	}, nil))
+
+	title, err := db.CachedTitle("radarr", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, "Alien (1979)", title)
+
+	assert.NoError(t, srv.RunMediaAction(&MediaAction{App: "radarr", Action: MediaUnmonitor, ID: 3, Season: -1}))
+	assert.False(t, movie.Monitored)
+	result, err := db.QueryReadOnly("SELECT monitored FROM radarr WHERE id = 3", sqlTimeout, sqlMaxRows)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"0"}}, result.Rows, "the cache is updated without a sync")
+
+	assert.NoError(t, srv.RunMediaAction(&MediaAction{App: "sonarr", Action: MediaUnmonitor, ID: 7, Season: 2}))
+	assert.True(t, series.Monitored)
+	assert.False(t, series.Seasons[1].Monitored)
+	result, err = db.QueryReadOnly("SELECT season_number, monitored FROM sonarr_episodes ORDER BY season_number", sqlTimeout, sqlMaxRows)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"1", "1"}, {"2", "0"}}, result.Rows)
+
+	assert.Error(t, srv.RunMediaAction(&MediaAction{App: "sonarr", Action: MediaMonitor, ID: 7, Season: 9}))
+
+	assert.NoError(t, srv.RunMediaAction(&MediaAction{App: "sonarr", Action: MediaGrab, ID: 7, Season: 1}))
+	assert.NoError(t, srv.RunMediaAction(&MediaAction{App: "radarr", Action: MediaGrab, ID: 3, Season: -1}))
+	assert.Len(t, commands, 2)
+	assert.Equal(t, "SeasonSearch", commands[0]["name"])
+	assert.Equal(t, float64(1), commands[0]["seasonNumber"])
+	assert.Equal(t, "MoviesSearch", commands[1]["name"])
+
+	assert.NoError(t, srv.RunMediaAction(&MediaAction{App: "radarr", Action: MediaDelete, ID: 3, Season: -1, DeleteFiles: true}))
+	title, err = db.CachedTitle("radarr", 3)
+	assert.NoError(t, err)
+	assert.Empty(t, title)
+
+	assert.NoError(t, db.DeleteCachedSeries(7))
+	result, err = db.QueryReadOnly("SELECT count(*) FROM sonarr_episodes", sqlTimeout, sqlMaxRows)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"0"}}, result.Rows)
+}
+
+func TestArrServer_IsGlobalAdmin(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := &ArrServer{DB: db}
+
+	assert.NoError(t, db.ConfigSet("discord.admin.users", "111"))
+	assert.NoError(t, db.ConfigSet(GuildKey("1234", "discord.admin.users"), "222"))
+	message := func(userID string) *discordgo.MessageCreate {
+		return &discordgo.MessageCreate{Message: &discordgo.Message{GuildID: "1234", Author: &discordgo.User{ID: userID}}}
+	}
+	assert.True(t, srv.IsAdmin(message("222")))
+	assert.False(t, srv.IsGlobalAdmin(message("222")), "guild admins can not change the global instances")
+	assert.True(t, srv.IsGlobalAdmin(message("111")))
+
+	click := &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{GuildID: "1234", Member: &discordgo.Member{User: &discordgo.User{ID: "222"}}}}
+	assert.False(t, srv.IsInteractionGlobalAdmin(click))
+}
@@ -0,0 +1,29 @@
+-- begin transaction / auto handled by migrations
+
+-- quotas limits how many media requests a user can make in a rolling window.
+-- scope is one of 'user', 'role' or 'default' and subject is the discord
+-- user id, role id or '*' respectively.
+CREATE TABLE IF NOT EXISTS quotas (
+    scope TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    max_requests INT NOT NULL,
+    window_seconds INT NOT NULL,
+    UNIQUE(scope, subject, kind)
+);
+
+-- media_requests records every add made through the bot so quotas can be
+-- counted.  Rows with override = 1 are not counted against the user.
+CREATE TABLE IF NOT EXISTS media_requests (
+    id integer primary key autoincrement,
+    user_id TEXT NOT NULL,
+    guild_id TEXT,
+    kind TEXT NOT NULL,
+    title TEXT,
+    external_id INT,
+    override INT NOT NULL DEFAULT 0,
+    created_at integer(4) not null default (strftime('%s','now'))
+);
+CREATE INDEX IF NOT EXISTS media_requests_index_user on media_requests(user_id, kind, created_at);
+
+-- commit transaction / Auto handled by migrations
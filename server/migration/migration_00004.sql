@@ -0,0 +1,12 @@
+-- begin transaction / auto handled by migrations
+
+-- guild_settings restricts a command group to a set of channels in a guild.
+-- A group without any rows for a guild is allowed in every channel.
+CREATE TABLE IF NOT EXISTS guild_settings (
+    guild_id TEXT NOT NULL,
+    command_group TEXT NOT NULL,
+    channel_id TEXT NOT NULL,
+    UNIQUE(guild_id, command_group, channel_id)
+);
+
+-- commit transaction / Auto handled by migrations
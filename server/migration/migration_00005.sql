@@ -0,0 +1,17 @@
+-- begin transaction / auto handled by migrations
+
+-- config_history records every change to the config table.  old_value and
+-- new_value are stored as they are in config, secrets stay encrypted, and
+-- are NULL when the key did not exist before or was deleted.  actor is
+-- cli:<user> or discord:<user id>.
+CREATE TABLE IF NOT EXISTS config_history (
+    id integer primary key autoincrement,
+    key TEXT NOT NULL,
+    old_value TEXT,
+    new_value TEXT,
+    actor TEXT NOT NULL,
+    created_at integer(4) not null default (strftime('%s','now'))
+);
+CREATE INDEX IF NOT EXISTS config_history_index_key on config_history(key, id);
+
+-- commit transaction / Auto handled by migrations
@@ -0,0 +1,66 @@
+-- begin transaction / auto handled by migrations
+
+-- Fields searches filter on, copied out of RAW by the sync.  tags is the
+-- comma separated tag ids, rating is ratings.value and rating_votes
+-- ratings.votes.
+ALTER TABLE sonarr ADD COLUMN year INT;
+ALTER TABLE sonarr ADD COLUMN tvdb_id INT;
+ALTER TABLE sonarr ADD COLUMN imdb_id TEXT;
+ALTER TABLE sonarr ADD COLUMN path TEXT;
+ALTER TABLE sonarr ADD COLUMN size_on_disk INT;
+ALTER TABLE sonarr ADD COLUMN quality_profile_id INT;
+ALTER TABLE sonarr ADD COLUMN tags TEXT;
+ALTER TABLE sonarr ADD COLUMN rating REAL;
+ALTER TABLE sonarr ADD COLUMN rating_votes INT;
+ALTER TABLE sonarr ADD COLUMN certification TEXT;
+
+ALTER TABLE radarr ADD COLUMN year INT;
+ALTER TABLE radarr ADD COLUMN tmdb_id INT;
+ALTER TABLE radarr ADD COLUMN imdb_id TEXT;
+ALTER TABLE radarr ADD COLUMN path TEXT;
+ALTER TABLE radarr ADD COLUMN size_on_disk INT;
+ALTER TABLE radarr ADD COLUMN quality_profile_id INT;
+ALTER TABLE radarr ADD COLUMN tags TEXT;
+ALTER TABLE radarr ADD COLUMN rating REAL;
+ALTER TABLE radarr ADD COLUMN rating_votes INT;
+ALTER TABLE radarr ADD COLUMN certification TEXT;
+
+-- Fill in the rows cached before the columns existed, the next sync
+-- rewrites them anyway.
+UPDATE sonarr SET
+    year = json_extract(CAST(RAW AS TEXT), '$.year'),
+    tvdb_id = json_extract(CAST(RAW AS TEXT), '$.tvdbId'),
+    imdb_id = json_extract(CAST(RAW AS TEXT), '$.imdbId'),
+    path = json_extract(CAST(RAW AS TEXT), '$.path'),
+    size_on_disk = json_extract(CAST(RAW AS TEXT), '$.statistics.sizeOnDisk'),
+    quality_profile_id = json_extract(CAST(RAW AS TEXT), '$.qualityProfileId'),
+    tags = (SELECT group_concat(value, ',') FROM json_each(CAST(RAW AS TEXT), '$.tags')),
+    rating = json_extract(CAST(RAW AS TEXT), '$.ratings.value'),
+    rating_votes = json_extract(CAST(RAW AS TEXT), '$.ratings.votes'),
+    certification = json_extract(CAST(RAW AS TEXT), '$.certification')
+WHERE json_valid(CAST(RAW AS TEXT));
+UPDATE radarr SET
+    year = json_extract(CAST(RAW AS TEXT), '$.year'),
+    tmdb_id = json_extract(CAST(RAW AS TEXT), '$.tmdbId'),
+    imdb_id = json_extract(CAST(RAW AS TEXT), '$.imdbId'),
+    path = json_extract(CAST(RAW AS TEXT), '$.path'),
+    size_on_disk = json_extract(CAST(RAW AS TEXT), '$.sizeOnDisk'),
+    quality_profile_id = json_extract(CAST(RAW AS TEXT), '$.qualityProfileId'),
+    tags = (SELECT group_concat(value, ',') FROM json_each(CAST(RAW AS TEXT), '$.tags')),
+    rating = json_extract(CAST(RAW AS TEXT), '$.ratings.value'),
+    rating_votes = json_extract(CAST(RAW AS TEXT), '$.ratings.votes'),
+    certification = json_extract(CAST(RAW AS TEXT), '$.certification')
+WHERE json_valid(CAST(RAW AS TEXT));
+
+CREATE INDEX IF NOT EXISTS sonarr_index_year on sonarr(year);
+CREATE INDEX IF NOT EXISTS sonarr_index_tvdb_id on sonarr(tvdb_id);
+CREATE INDEX IF NOT EXISTS sonarr_index_imdb_id on sonarr(imdb_id);
+CREATE INDEX IF NOT EXISTS sonarr_index_quality_profile_id on sonarr(quality_profile_id);
+CREATE INDEX IF NOT EXISTS sonarr_index_rating on sonarr(rating);
+CREATE INDEX IF NOT EXISTS radarr_index_year on radarr(year);
+CREATE INDEX IF NOT EXISTS radarr_index_tmdb_id on radarr(tmdb_id);
+CREATE INDEX IF NOT EXISTS radarr_index_imdb_id on radarr(imdb_id);
+CREATE INDEX IF NOT EXISTS radarr_index_quality_profile_id on radarr(quality_profile_id);
+CREATE INDEX IF NOT EXISTS radarr_index_rating on radarr(rating);
+
+-- commit transaction / Auto handled by migrations
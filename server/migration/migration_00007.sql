@@ -0,0 +1,28 @@
+-- begin transaction / auto handled by migrations
+
+-- sonarr_episodes caches the episodes of every series, quality and size come
+-- from the episode file and are NULL without one.
+CREATE TABLE IF NOT EXISTS sonarr_episodes (
+    id INT PRIMARY KEY,
+    series_id INT NOT NULL,
+    season_number INT NOT NULL,
+    episode_number INT NOT NULL,
+    title TEXT,
+    air_date TEXT,
+    has_file INT,
+    monitored INT,
+    quality TEXT,
+    size INT,
+    RAW TEXT
+);
+CREATE INDEX IF NOT EXISTS sonarr_episodes_index_series on sonarr_episodes(series_id, season_number, episode_number);
+
+-- sonarr_episode_sync is the statistics of a series when its episodes were
+-- last synced, only series whose statistics changed are fetched again.
+CREATE TABLE IF NOT EXISTS sonarr_episode_sync (
+    series_id INT PRIMARY KEY,
+    statistics TEXT NOT NULL,
+    synced_at integer(4) not null default (strftime('%s','now'))
+);
+
+-- commit transaction / Auto handled by migrations
@@ -0,0 +1,24 @@
+-- begin transaction / auto handled by migrations
+
+-- disk_space is a sample of the sonarr and radarr diskspace endpoints, a
+-- row per app and path every disk.check_interval.
+CREATE TABLE IF NOT EXISTS disk_space (
+    app TEXT NOT NULL,
+    path TEXT NOT NULL,
+    label TEXT,
+    free_space INT NOT NULL,
+    total_space INT NOT NULL,
+    created_at integer(4) not null default (strftime('%s','now'))
+);
+CREATE INDEX IF NOT EXISTS disk_space_index_path on disk_space(path, created_at);
+
+-- disk_alerts remembers the last alert per path and reason so the ops
+-- channel is told once per disk.alert_interval.
+CREATE TABLE IF NOT EXISTS disk_alerts (
+    path TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    created_at integer(4) not null default (strftime('%s','now')),
+    PRIMARY KEY (path, reason)
+);
+
+-- commit transaction / Auto handled by migrations
@@ -0,0 +1,27 @@
+-- begin transaction / auto handled by migrations
+
+-- starr_status is the last system status check of every starr instance,
+-- instance is the app optionally followed by the guild it is configured for.
+CREATE TABLE IF NOT EXISTS starr_status (
+    instance TEXT PRIMARY KEY,
+    app TEXT NOT NULL,
+    guild_id TEXT NOT NULL DEFAULT '',
+    version TEXT,
+    error TEXT,
+    checked_at integer(4) not null default (strftime('%s','now'))
+);
+
+-- starr_health holds the warnings and errors an instance currently reports,
+-- a row is removed when it clears.
+CREATE TABLE IF NOT EXISTS starr_health (
+    instance TEXT NOT NULL,
+    source TEXT NOT NULL,
+    type TEXT NOT NULL,
+    message TEXT NOT NULL,
+    wiki_url TEXT,
+    first_seen integer(4) not null default (strftime('%s','now')),
+    last_seen integer(4) not null default (strftime('%s','now')),
+    PRIMARY KEY (instance, source, message)
+);
+
+-- commit transaction / Auto handled by migrations
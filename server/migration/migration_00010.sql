@@ -0,0 +1,31 @@
+-- begin transaction / auto handled by migrations
+
+-- plex_items is the last scan of the plex movie and show libraries with the
+-- tmdb, tvdb and imdb ids of their guids and a link to watch them.
+CREATE TABLE IF NOT EXISTS plex_items (
+    rating_key TEXT PRIMARY KEY,
+    library TEXT NOT NULL,
+    type TEXT NOT NULL,
+    title TEXT NOT NULL,
+    year INT,
+    tmdb_id INT,
+    tvdb_id INT,
+    imdb_id TEXT,
+    link TEXT
+);
+CREATE INDEX IF NOT EXISTS plex_items_index_tmdb on plex_items(tmdb_id);
+CREATE INDEX IF NOT EXISTS plex_items_index_tvdb on plex_items(tvdb_id);
+CREATE INDEX IF NOT EXISTS plex_items_index_imdb on plex_items(imdb_id);
+
+-- plex_map links a radarr movie or sonarr series to the plex item with the
+-- same tmdb or tvdb id, or failing that imdb id.
+CREATE TABLE IF NOT EXISTS plex_map (
+    app TEXT NOT NULL,
+    item_id INT NOT NULL,
+    rating_key TEXT NOT NULL,
+    matched_by TEXT NOT NULL,
+    PRIMARY KEY (app, item_id)
+);
+CREATE INDEX IF NOT EXISTS plex_map_index_rating_key on plex_map(rating_key);
+
+-- commit transaction / Auto handled by migrations
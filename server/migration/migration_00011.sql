@@ -0,0 +1,29 @@
+-- begin transaction / auto handled by migrations
+
+-- plex_accounts names the accounts of the plex server.
+CREATE TABLE IF NOT EXISTS plex_accounts (
+    id INT PRIMARY KEY,
+    name TEXT NOT NULL
+);
+
+-- plex_history is the play history of the plex server, item_key is the
+-- rating key of the movie or of the show an episode belongs to so it joins
+-- plex_items.
+CREATE TABLE IF NOT EXISTS plex_history (
+    history_key TEXT PRIMARY KEY,
+    account_id INT NOT NULL,
+    rating_key TEXT NOT NULL,
+    item_key TEXT NOT NULL,
+    type TEXT NOT NULL,
+    title TEXT NOT NULL,
+    show_title TEXT,
+    library_section_id TEXT,
+    viewed_at integer(4) not null
+);
+CREATE INDEX IF NOT EXISTS plex_history_index_viewed_at on plex_history(viewed_at);
+CREATE INDEX IF NOT EXISTS plex_history_index_item_key on plex_history(item_key, viewed_at);
+
+-- added_at lets unwatched reports skip what was only just added.
+ALTER TABLE plex_items ADD COLUMN added_at integer(4);
+
+-- commit transaction / Auto handled by migrations
@@ -0,0 +1,448 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const (
+	// plexHistoryPage is how many plays are read per request.
+	plexHistoryPage = 500
+	// plexHistoryMax caps the lines of !plex history.
+	plexHistoryMax = 20
+	// plexTopMax caps the lines of !plex top.
+	plexTopMax = 10
+	// plexUnwatchedMonths is the default of !plex unwatched.
+	plexUnwatchedMonths = 6
+	// plexUnwatchedMax caps the lines of !plex unwatched.
+	plexUnwatchedMax = 25
+)
+
+// PlexPlay is an entry of the plex play history.  ItemKey is the rating key
+// of the movie, or of the show for an episode.
+type PlexPlay struct {
+	HistoryKey       string
+	AccountID        int64
+	Account          string
+	RatingKey        string
+	ItemKey          string
+	Type             string
+	Title            string
+	ShowTitle        string
+	LibrarySectionID string
+	ViewedAt         time.Time
+}
+
+// DisplayTitle is the title with the show of an episode.
+func (p *PlexPlay) DisplayTitle() string {
+	if p.ShowTitle != "" {
+		return p.ShowTitle + " - " + p.Title
+	}
+	return p.Title
+}
+
+// String formats the play for discord.
+func (p *PlexPlay) String() string {
+	return fmt.Sprintf("%s %s: %s", p.ViewedAt.Format("2006-01-02 15:04"), p.Account, p.DisplayTitle())
+}
+
+// plexHistoryEntry is an entry of /status/sessions/history/all.
+type plexHistoryEntry struct {
+	HistoryKey       string      `json:"historyKey"`
+	RatingKey        string      `json:"ratingKey"`
+	GrandparentKey   string      `json:"grandparentKey"`
+	Title            string      `json:"title"`
+	GrandparentTitle string      `json:"grandparentTitle"`
+	Type             string      `json:"type"`
+	ViewedAt         int64       `json:"viewedAt"`
+	AccountID        int64       `json:"accountID"`
+	LibrarySectionID interface{} `json:"librarySectionID"`
+}
+
+func (e *plexHistoryEntry) play() *PlexPlay {
+	p := &PlexPlay{
+		HistoryKey: e.HistoryKey,
+		AccountID:  e.AccountID,
+		RatingKey:  e.RatingKey,
+		ItemKey:    e.RatingKey,
+		Type:       e.Type,
+		Title:      e.Title,
+		ViewedAt:   time.Unix(e.ViewedAt, 0),
+	}
+	if e.LibrarySectionID != nil {
+		p.LibrarySectionID = fmt.Sprint(e.LibrarySectionID)
+	}
+	if e.Type == "episode" && e.GrandparentKey != "" {
+		p.ItemKey = path.Base(e.GrandparentKey)
+		p.ShowTitle = e.GrandparentTitle
+	}
+	return p
+}
+
+// FetchPlexHistory reads the plays viewed at or after since, oldest first.
+func (srv *ArrServer) FetchPlexHistory(since int64) ([]*PlexPlay, error) {
+	results := []*PlexPlay{}
+	for start := 0; ; start += plexHistoryPage {
+		var page struct {
+			MediaContainer struct {
+				Metadata []*plexHistoryEntry `json:"Metadata"`
+			} `json:"MediaContainer"`
+		}
+		params := url.Values{
+			"X-Plex-Container-Start": {strconv.Itoa(start)},
+			"X-Plex-Container-Size":  {strconv.Itoa(plexHistoryPage)},
+		}
+		err := srv.PlexGet(fmt.Sprintf("/status/sessions/history/all?sort=viewedAt:asc&viewedAt>=%d", since), params, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page.MediaContainer.Metadata {
+			results = append(results, e.play())
+		}
+		if len(page.MediaContainer.Metadata) < plexHistoryPage {
+			return results, nil
+		}
+	}
+}
+
+// FetchPlexAccounts returns the names of the accounts of the plex server.
+func (srv *ArrServer) FetchPlexAccounts() (map[int64]string, error) {
+	var accounts struct {
+		MediaContainer struct {
+			Account []struct {
+				ID   int64  `json:"id"`
+				Name string `json:"name"`
+			} `json:"Account"`
+		} `json:"MediaContainer"`
+	}
+	if err := srv.PlexGet("/accounts", nil, &accounts); err != nil {
+		return nil, err
+	}
+	results := map[int64]string{}
+	for _, a := range accounts.MediaContainer.Account {
+		results[a.ID] = a.Name
+	}
+	return results, nil
+}
+
+// SyncPlexHistory stores the accounts and the plays since the last one
+// stored.
+func (srv *ArrServer) SyncPlexHistory() error {
+	accounts, err := srv.FetchPlexAccounts()
+	if err != nil {
+		return err
+	}
+	latest, err := srv.DB.PlexHistoryLatest()
+	if err != nil {
+		return err
+	}
+	plays, err := srv.FetchPlexHistory(latest)
+	if err != nil {
+		return err
+	}
+	log.Debug().Int("plays", len(plays)).Int64("since", latest).Msg("Plex history read")
+	return srv.DB.RecordPlexHistory(accounts, plays)
+}
+
+// SetupPlexHistory schedules SyncPlexHistory every plex.history_interval
+// when plex is configured.
+func (srv *ArrServer) SetupPlexHistory() error {
+	if srv.PlexConn() == nil {
+		return nil
+	}
+	interval, err := srv.DB.ConfigDuration("plex.history_interval")
+	if err != nil {
+		return err
+	}
+	job, err := srv.Cron.Every(interval).StartImmediately().Do(func() {
+		if err := srv.SyncPlexHistory(); err != nil {
+			log.Warn().Err(err).Msg("Reading plex history failed")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	job.Tag("plex")
+	return nil
+}
+
+// PlexHistoryLatest returns when the last stored play was viewed, 0 when
+// there is none.  Plays at that second are read again and ignored.
+func (d *DB) PlexHistoryLatest() (int64, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return 0, err
+	}
+	defer d.Pool.Put(conn)
+
+	var latest int64
+	err = sqlitex.Execute(conn, "SELECT coalesce(max(viewed_at), 0) FROM plex_history", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			latest = stmt.ColumnInt64(0)
+			return nil
+		},
+	})
+	return latest, err
+}
+
+// RecordPlexHistory stores the account names and the plays not stored yet.
+func (d *DB) RecordPlexHistory(accounts map[int64]string, plays []*PlexPlay) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	doUpdate := func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+		for id, name := range accounts {
+			err = sqlitex.Execute(conn, `INSERT INTO plex_accounts (id, name) VALUES (?, ?)
+				ON CONFLICT(id) DO UPDATE SET name = EXCLUDED.name`, &sqlitex.ExecOptions{
+				Args: []interface{}{id, name},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		q := `INSERT OR IGNORE INTO plex_history (history_key, account_id, rating_key, item_key, type, title, show_title, library_section_id, viewed_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+		for _, p := range plays {
+			err = sqlitex.Execute(conn, q, &sqlitex.ExecOptions{
+				Args: []interface{}{
+					p.HistoryKey,
+					p.AccountID,
+					p.RatingKey,
+					p.ItemKey,
+					p.Type,
+					p.Title,
+					nullable(p.ShowTitle, p.ShowTitle != ""),
+					nullable(p.LibrarySectionID, p.LibrarySectionID != ""),
+					p.ViewedAt.Unix(),
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return doUpdate()
+}
+
+// PlexHistory returns the latest plays, of the account named account unless
+// it is empty.
+func (d *DB) PlexHistory(account string, limit int) ([]*PlexPlay, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	results := []*PlexPlay{}
+	err = sqlitex.Execute(conn, `SELECT h.history_key, h.account_id, coalesce(a.name, h.account_id), h.rating_key, h.item_key, h.type, h.title,
+			coalesce(h.show_title, ''), coalesce(h.library_section_id, ''), h.viewed_at
+		FROM plex_history h LEFT JOIN plex_accounts a ON a.id = h.account_id
+		WHERE ?1 = '' OR a.name = ?1 COLLATE NOCASE
+		ORDER BY h.viewed_at DESC LIMIT ?2`, &sqlitex.ExecOptions{
+		Args: []interface{}{account, limit},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			results = append(results, &PlexPlay{
+				HistoryKey:       stmt.ColumnText(0),
+				AccountID:        stmt.ColumnInt64(1),
+				Account:          stmt.ColumnText(2),
+				RatingKey:        stmt.ColumnText(3),
+				ItemKey:          stmt.ColumnText(4),
+				Type:             stmt.ColumnText(5),
+				Title:            stmt.ColumnText(6),
+				ShowTitle:        stmt.ColumnText(7),
+				LibrarySectionID: stmt.ColumnText(8),
+				ViewedAt:         time.Unix(stmt.ColumnInt64(9), 0),
+			})
+			return nil
+		},
+	})
+	return results, err
+}
+
+// MostWatched returns the movies and shows played the most since since, an
+// episode counts for its show.
+func (d *DB) MostWatched(since time.Time, limit int) ([]NamedCount, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	results := []NamedCount{}
+	err = sqlitex.Execute(conn, `SELECT coalesce(max(show_title), max(title)), count(*) AS plays FROM plex_history
+		WHERE viewed_at >= ? GROUP BY item_key ORDER BY plays DESC, 1 LIMIT ?`, &sqlitex.ExecOptions{
+		Args: []interface{}{since.Unix(), limit},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			results = append(results, NamedCount{Name: stmt.ColumnText(0), Count: stmt.ColumnInt64(1)})
+			return nil
+		},
+	})
+	return results, err
+}
+
+// PlaysPerDay counts the plays of every day since since, days without plays
+// are left out.
+func (d *DB) PlaysPerDay(since time.Time) ([]NamedCount, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	results := []NamedCount{}
+	err = sqlitex.Execute(conn, `SELECT date(viewed_at, 'unixepoch') AS day, count(*) FROM plex_history
+		WHERE viewed_at >= ? GROUP BY day ORDER BY day`, &sqlitex.ExecOptions{
+		Args: []interface{}{since.Unix()},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			results = append(results, NamedCount{Name: stmt.ColumnText(0), Count: stmt.ColumnInt64(1)})
+			return nil
+		},
+	})
+	return results, err
+}
+
+// UnwatchedItem is a plex movie or show nobody played since a date.
+type UnwatchedItem struct {
+	RatingKey   string
+	Library     string
+	Title       string
+	Year        int64
+	LastWatched time.Time
+}
+
+// String formats the item for discord.
+func (u *UnwatchedItem) String() string {
+	last := "never watched"
+	if !u.LastWatched.IsZero() {
+		last = "last watched " + u.LastWatched.Format("2006-01-02")
+	}
+	return fmt.Sprintf("%s: %s (%d), %s", u.Library, u.Title, u.Year, last)
+}
+
+// Unwatched returns the plex items nobody played since since, leaving out
+// the ones added after since.  The ones watched longest ago come first.
+func (d *DB) Unwatched(since time.Time) ([]*UnwatchedItem, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	results := []*UnwatchedItem{}
+	err = sqlitex.Execute(conn, `SELECT p.rating_key, p.library, p.title, p.year, h.last FROM plex_items p
+		LEFT JOIN (SELECT item_key, max(viewed_at) AS last FROM plex_history GROUP BY item_key) h ON h.item_key = p.rating_key
+		WHERE coalesce(h.last, 0) < ?1 AND coalesce(p.added_at, 0) < ?1
+		ORDER BY coalesce(h.last, 0), p.title`, &sqlitex.ExecOptions{
+		Args: []interface{}{since.Unix()},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			u := &UnwatchedItem{
+				RatingKey: stmt.ColumnText(0),
+				Library:   stmt.ColumnText(1),
+				Title:     stmt.ColumnText(2),
+				Year:      stmt.ColumnInt64(3),
+			}
+			if stmt.ColumnType(4) != sqlite.TypeNull {
+				u.LastWatched = time.Unix(stmt.ColumnInt64(4), 0)
+			}
+			results = append(results, u)
+			return nil
+		},
+	})
+	return results, err
+}
+
+// monthStart is the first instant of the month of now.
+func monthStart(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+}
+
+// HandlePlexHistory shows admins the latest plays, !plex history <user>
+// those of one account.
+func (srv *ArrServer) HandlePlexHistory(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if !srv.IsAdmin(m) {
+		s.ChannelMessageSend(m.ChannelID, "Only admins can read the plex history")
+		return
+	}
+	account := strings.TrimSpace(strings.TrimPrefix(m.Content, "!plex history"))
+	plays, err := srv.DB.PlexHistory(account, plexHistoryMax)
+	if err != nil {
+		log.Error().Err(err).Msg("Reading plex history failed")
+		s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+		return
+	}
+	if len(plays) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "No plays found")
+		return
+	}
+	lines := make([]string, len(plays))
+	for i, p := range plays {
+		lines[i] = p.String()
+	}
+	for _, msg := range ChunkMessage(strings.Join(lines, "\n"), discordMessageLimit) {
+		s.ChannelMessageSend(m.ChannelID, msg)
+	}
+}
+
+// HandlePlexTop shows the most watched movies and shows of this month.
+func (srv *ArrServer) HandlePlexTop(s *discordgo.Session, m *discordgo.MessageCreate) {
+	top, err := srv.DB.MostWatched(monthStart(time.Now()), plexTopMax)
+	if err != nil {
+		log.Error().Err(err).Msg("Reading plex history failed")
+		s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+		return
+	}
+	if len(top) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "Nothing watched this month")
+		return
+	}
+	lines := []string{"Most watched this month:"}
+	for _, c := range top {
+		lines = append(lines, fmt.Sprintf("  %s: %d plays", c.Name, c.Count))
+	}
+	s.ChannelMessageSend(m.ChannelID, strings.Join(lines, "\n"))
+}
+
+// HandlePlexUnwatched lists what nobody watched in the last months, 6 unless
+// given like !plex unwatched 12.
+func (srv *ArrServer) HandlePlexUnwatched(s *discordgo.Session, m *discordgo.MessageCreate) {
+	months := plexUnwatchedMonths
+	if arg := strings.TrimSpace(strings.TrimPrefix(m.Content, "!plex unwatched")); arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			s.ChannelMessageSend(m.ChannelID, "usage: !plex unwatched [months]")
+			return
+		}
+		months = n
+	}
+	items, err := srv.DB.Unwatched(time.Now().AddDate(0, -months, 0))
+	if err != nil {
+		log.Error().Err(err).Msg("Reading unwatched items failed")
+		s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+		return
+	}
+	lines := []string{fmt.Sprintf("Not watched in %d months: %d", months, len(items))}
+	for i, u := range items {
+		if i == plexUnwatchedMax {
+			lines = append(lines, fmt.Sprintf("  and %d more", len(items)-plexUnwatchedMax))
+			break
+		}
+		lines = append(lines, "  "+u.String())
+	}
+	for _, msg := range ChunkMessage(strings.Join(lines, "\n"), discordMessageLimit) {
+		s.ChannelMessageSend(m.ChannelID, msg)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jrudio/go-plex-client"
+	"github.com/stretchr/testify/assert"
+	"jeremyrossi.com/go/arrmate/server/chart"
+)
+
+func TestArrServer_SyncPlexHistory(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	day := 24 * time.Hour
+	plays := []string{
+		fmt.Sprintf(`{"historyKey": "/status/sessions/history/1", "ratingKey": "10", "title": "Alien", "type": "movie", "viewedAt": %d, "accountID": 1, "librarySectionID": "1"}`, now.Add(-400*day).Unix()),
+		fmt.Sprintf(`{"historyKey": "/status/sessions/history/2", "ratingKey": "21", "grandparentKey": "/library/metadata/20", "title": "The Target", "grandparentTitle": "The Wire", "type": "episode", "viewedAt": %d, "accountID": 2, "librarySectionID": 2}`, now.Add(-2*day).Unix()),
+		fmt.Sprintf(`{"historyKey": "/status/sessions/history/3", "ratingKey": "22", "grandparentKey": "/library/metadata/20", "title": "The Detail", "grandparentTitle": "The Wire", "type": "episode", "viewedAt": %d, "accountID": 2}`, now.Add(-day).Unix()),
+	}
+	served := 2
+	queries := []string{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/accounts":
+			w.Write([]byte(`{"MediaContainer": {"Account": [{"id": 1, "name": "jeremy"}, {"id": 2, "name": "guest"}]}}`))
+		case "/status/sessions/history/all":
+			queries = append(queries, r.URL.RawQuery)
+			w.Write([]byte(`{"MediaContainer": {"Metadata": [` + strings.Join(plays[:served], ",") + `]}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+	plexConn, err := plex.New(api.URL, "token")
+	assert.NoError(t, err)
+	srv := &ArrServer{DB: db}
+	srv.SetPlexConn(plexConn)
+
+	assert.NoError(t, srv.SyncPlexHistory())
+	served = 3
+	assert.NoError(t, srv.SyncPlexHistory())
+	assert.Len(t, queries, 2)
+	assert.True(t, strings.HasPrefix(queries[0], "sort=viewedAt:asc&viewedAt>=0&"), queries[0])
+	assert.Contains(t, queries[1], fmt.Sprintf("viewedAt>=%d", now.Add(-2*day).Unix()), "only plays since the last one are read")
+
+	history, err := db.PlexHistory("", 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 3, "plays read twice are stored once")
+	assert.Equal(t, "guest", history[0].Account)
+	assert.Equal(t, "The Wire - The Detail", history[0].DisplayTitle())
+	assert.Equal(t, "20", history[0].ItemKey)
+	assert.Equal(t, "2", history[1].LibrarySectionID)
+
+	history, err = db.PlexHistory("Jeremy", 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, now.Add(-400*day).Format("2006-01-02 15:04")+" jeremy: Alien", history[0].String())
+
+	top, err := db.MostWatched(now.Add(-7*day), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []NamedCount{{Name: "The Wire", Count: 2}}, top, "episodes count for their show")
+
+	perDay, err := db.PlaysPerDay(now.Add(-7 * day))
+	assert.NoError(t, err)
+	assert.Len(t, perDay, 2)
+
+	assert.NoError(t, db.CachePlexItems([]*PlexItem{
+		{RatingKey: "10", Library: "Movies", Type: "movie", Title: "Alien", Year: 1979, AddedAt: now.Add(-500 * day).Unix()},
+		{RatingKey: "11", Library: "Movies", Type: "movie", Title: "Heat", Year: 1995, AddedAt: now.Add(-500 * day).Unix()},
+		{RatingKey: "12", Library: "Movies", Type: "movie", Title: "Dune", Year: 2021, AddedAt: now.Add(-day).Unix()},
+		{RatingKey: "20", Library: "TV Shows", Type: "show", Title: "The Wire", Year: 2002, AddedAt: now.Add(-500 * day).Unix()},
+	}, "abc123"))
+	unwatched, err := db.Unwatched(now.AddDate(0, -6, 0))
+	assert.NoError(t, err)
+	assert.Len(t, unwatched, 2, "recently added and watched items are left out")
+	assert.Equal(t, "Movies: Heat (1995), never watched", unwatched[0].String())
+	assert.Equal(t, "Movies: Alien (1979), last watched "+now.Add(-400*day).Format("2006-01-02"), unwatched[1].String())
+}
+
+func TestDayBars(t *testing.T) {
+	now := time.Date(2022, 3, 2, 12, 0, 0, 0, time.UTC)
+	bars := DayBars([]NamedCount{{"2022-03-01", 4}}, time.Date(2022, 2, 27, 0, 0, 0, 0, time.UTC), now)
+	assert.Equal(t, []chart.Bar{{Label: "27"}, {Label: "28"}, {Label: "01", Value: 4}, {Label: "02"}}, bars)
+}
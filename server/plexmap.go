@@ -0,0 +1,344 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// plexReportMax caps the lines of each list of !plex report.
+const plexReportMax = 25
+
+// PlexItem is a movie or show of a plex library with the ids its guids
+// carry.
+type PlexItem struct {
+	RatingKey string
+	Library   string
+	Type      string
+	Title     string
+	Year      int
+	AddedAt   int64
+	TmdbID    int64
+	TvdbID    int64
+	ImdbID    string
+}
+
+// ParsePlexGUID sets the tmdb, tvdb or imdb id of a guid, both the
+// tmdb://603 form of the new agents and the
+// com.plexapp.agents.themoviedb://603?lang=en form of the legacy ones.
+func (i *PlexItem) ParsePlexGUID(guid string) {
+	scheme, id, ok := strings.Cut(guid, "://")
+	if !ok {
+		return
+	}
+	scheme = strings.TrimPrefix(scheme, "com.plexapp.agents.")
+	id, _, _ = strings.Cut(id, "?")
+	id, _, _ = strings.Cut(id, "/")
+	switch scheme {
+	case "tmdb", "themoviedb":
+		i.TmdbID, _ = strconv.ParseInt(id, 10, 64)
+	case "tvdb", "thetvdb":
+		i.TvdbID, _ = strconv.ParseInt(id, 10, 64)
+	case "imdb":
+		i.ImdbID = id
+	}
+}
+
+// PlexWatchURL links to an item in plex web.
+func PlexWatchURL(machineID, ratingKey string) string {
+	return fmt.Sprintf("https://app.plex.tv/desktop/#!/server/%s/details?key=%s", machineID, url.QueryEscape("/library/metadata/"+ratingKey))
+}
+
+// onPlex is the search result suffix of an item matched to plex.
+func onPlex(link string) string {
+	if link == "" {
+		return ""
+	}
+	return " On Plex ✓ <" + link + ">"
+}
+
+// plexLinkColumn selects the watch link of the cache row of app for a
+// SearchTable.
+func plexLinkColumn(app string) string {
+	return fmt.Sprintf("(SELECT p.link FROM plex_map m JOIN plex_items p USING (rating_key) WHERE m.app = '%s' AND m.item_id = %s.id)", app, app)
+}
+
+// PlexGet reads a plex api path as JSON into out, for what the plex client
+// does not cover.  Filters like viewedAt>=1 go in path as plex wants them
+// unescaped.
+func (srv *ArrServer) PlexGet(path string, params url.Values, out interface{}) error {
+	plexConn := srv.PlexConn()
+	if plexConn == nil {
+		return fmt.Errorf("plex is not configured")
+	}
+	u := strings.TrimSuffix(plexConn.URL, "/") + path
+	if len(params) > 0 {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		u += sep + params.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Plex-Token", plexConn.Token)
+	resp, err := plexConn.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("plex %s: %s", path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("plex %s: %w", path, err)
+	}
+	return nil
+}
+
+// PlexMachineID returns the id of the plex server used in watch links.
+func (srv *ArrServer) PlexMachineID() (string, error) {
+	var identity struct {
+		MediaContainer struct {
+			MachineIdentifier string `json:"machineIdentifier"`
+		} `json:"MediaContainer"`
+	}
+	if err := srv.PlexGet("/identity", nil, &identity); err != nil {
+		return "", err
+	}
+	return identity.MediaContainer.MachineIdentifier, nil
+}
+
+// ScanPlex reads every movie and show library of plex and matches them with
+// the radarr and sonarr caches.
+func (srv *ArrServer) ScanPlex() error {
+	plexConn := srv.PlexConn()
+	if plexConn == nil {
+		return fmt.Errorf("plex is not configured")
+	}
+	machineID, err := srv.PlexMachineID()
+	if err != nil {
+		return err
+	}
+	sections, err := plexConn.GetLibraries()
+	if err != nil {
+		return err
+	}
+	items := []*PlexItem{}
+	for _, d := range sections.MediaContainer.Directory {
+		if d.Type != "movie" && d.Type != "show" {
+			continue
+		}
+		content, err := plexConn.GetLibraryContent(d.Key, "?includeGuids=1")
+		if err != nil {
+			return fmt.Errorf("plex library %s: %w", d.Title, err)
+		}
+		for _, m := range content.MediaContainer.Metadata {
+			item := &PlexItem{RatingKey: m.RatingKey, Library: d.Title, Type: d.Type, Title: m.Title, Year: m.Year, AddedAt: int64(m.AddedAt)}
+			item.ParsePlexGUID(m.GUID)
+			for _, g := range m.AltGUIDs {
+				item.ParsePlexGUID(g.ID)
+			}
+			items = append(items, item)
+		}
+	}
+	return srv.DB.CachePlexItems(items, machineID)
+}
+
+// SetupPlexScan schedules ScanPlex every plex.scan_interval when plex is
+// configured.
+func (srv *ArrServer) SetupPlexScan() error {
+	if srv.PlexConn() == nil {
+		return nil
+	}
+	interval, err := srv.DB.ConfigDuration("plex.scan_interval")
+	if err != nil {
+		return err
+	}
+	job, err := srv.Cron.Every(interval).StartImmediately().Do(func() {
+		if err := srv.ScanPlex(); err != nil {
+			log.Warn().Err(err).Msg("Scanning plex failed")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	job.Tag("plex")
+	return nil
+}
+
+// CachePlexItems replaces plex_items and rebuilds plex_map.
+func (d *DB) CachePlexItems(items []*PlexItem, machineID string) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	doUpdate := func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+		err = sqlitex.Execute(conn, "DELETE FROM plex_items;", nil)
+		if err != nil {
+			return err
+		}
+		q := `INSERT OR REPLACE INTO plex_items (rating_key, library, type, title, year, added_at, tmdb_id, tvdb_id, imdb_id, link)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+		for _, i := range items {
+			err = sqlitex.Execute(conn, q, &sqlitex.ExecOptions{
+				Args: []interface{}{
+					i.RatingKey,
+					i.Library,
+					i.Type,
+					i.Title,
+					i.Year,
+					nullableInt(i.AddedAt),
+					nullableInt(i.TmdbID),
+					nullableInt(i.TvdbID),
+					nullable(i.ImdbID, i.ImdbID != ""),
+					PlexWatchURL(machineID, i.RatingKey),
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return rebuildPlexMap(conn)
+	}
+	return doUpdate()
+}
+
+// RebuildPlexMap matches the radarr and sonarr caches with plex_items again,
+// after either of them changed.
+func (d *DB) RebuildPlexMap() error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	doUpdate := func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+		return rebuildPlexMap(conn)
+	}
+	return doUpdate()
+}
+
+// rebuildPlexMap matches on the tmdb or tvdb id first, an item keeps its
+// first match.
+func rebuildPlexMap(conn *sqlite.Conn) error {
+	for _, q := range []string{
+		"DELETE FROM plex_map;",
+		`INSERT OR IGNORE INTO plex_map (app, item_id, rating_key, matched_by)
+			SELECT 'radarr', r.id, p.rating_key, 'tmdb' FROM radarr r JOIN plex_items p ON p.type = 'movie' AND p.tmdb_id = r.tmdb_id WHERE r.tmdb_id > 0;`,
+		`INSERT OR IGNORE INTO plex_map (app, item_id, rating_key, matched_by)
+			SELECT 'radarr', r.id, p.rating_key, 'imdb' FROM radarr r JOIN plex_items p ON p.type = 'movie' AND p.imdb_id = r.imdb_id WHERE r.imdb_id != '';`,
+		`INSERT OR IGNORE INTO plex_map (app, item_id, rating_key, matched_by)
+			SELECT 'sonarr', s.id, p.rating_key, 'tvdb' FROM sonarr s JOIN plex_items p ON p.type = 'show' AND p.tvdb_id = s.tvdb_id WHERE s.tvdb_id > 0;`,
+		`INSERT OR IGNORE INTO plex_map (app, item_id, rating_key, matched_by)
+			SELECT 'sonarr', s.id, p.rating_key, 'imdb' FROM sonarr s JOIN plex_items p ON p.type = 'show' AND p.imdb_id = s.imdb_id WHERE s.imdb_id != '';`,
+	} {
+		if err := sqlitex.ExecuteTransient(conn, q, nil); err != nil {
+			return fmt.Errorf("database: %w", err)
+		}
+	}
+	return nil
+}
+
+func nullableInt(v int64) interface{} {
+	if v == 0 {
+		return nil
+	}
+	return v
+}
+
+// PlexReport lists what radarr and sonarr downloaded that plex does not
+// have, usually a failed library scan, and what plex has that neither of
+// them manages.
+type PlexReport struct {
+	MissingFromPlex []string
+	MissingFromArr  []string
+}
+
+// Text formats the report for discord, at most max lines per list.
+func (r *PlexReport) Text(max int) string {
+	var b strings.Builder
+	for _, list := range []struct {
+		title string
+		items []string
+	}{
+		{"Downloaded but not on plex", r.MissingFromPlex},
+		{"On plex but not in radarr or sonarr", r.MissingFromArr},
+	} {
+		b.WriteString(fmt.Sprintf("%s: %d\n", list.title, len(list.items)))
+		for i, item := range list.items {
+			if i == max {
+				b.WriteString(fmt.Sprintf("  and %d more\n", len(list.items)-max))
+				break
+			}
+			b.WriteString("  " + item + "\n")
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// PlexReport compares the caches with the last plex scan.
+func (d *DB) PlexReport() (*PlexReport, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	report := &PlexReport{MissingFromPlex: []string{}, MissingFromArr: []string{}}
+	err = sqlitex.Execute(conn, `SELECT a.app, a.title, a.year FROM (
+			SELECT 'radarr' AS app, id, title, year, size_on_disk FROM radarr
+			UNION ALL SELECT 'sonarr', id, title, year, size_on_disk FROM sonarr
+		) a WHERE a.size_on_disk > 0 AND NOT EXISTS (SELECT 1 FROM plex_map m WHERE m.app = a.app AND m.item_id = a.id)
+		ORDER BY a.app, a.title`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			report.MissingFromPlex = append(report.MissingFromPlex, fmt.Sprintf("%s: %s (%d)", stmt.ColumnText(0), stmt.ColumnText(1), stmt.ColumnInt64(2)))
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = sqlitex.Execute(conn, `SELECT library, title, year FROM plex_items p
+		WHERE NOT EXISTS (SELECT 1 FROM plex_map m WHERE m.rating_key = p.rating_key)
+		ORDER BY library, title`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			report.MissingFromArr = append(report.MissingFromArr, fmt.Sprintf("%s: %s (%d)", stmt.ColumnText(0), stmt.ColumnText(1), stmt.ColumnInt64(2)))
+			return nil
+		},
+	})
+	return report, err
+}
+
+// HandlePlexReport shows what is downloaded but missing from plex and what
+// plex has that radarr and sonarr do not.
+func (srv *ArrServer) HandlePlexReport(s *discordgo.Session, m *discordgo.MessageCreate) {
+	report, err := srv.DB.PlexReport()
+	if err != nil {
+		log.Error().Err(err).Msg("Building plex report failed")
+		s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+		return
+	}
+	text := report.Text(plexReportMax)
+	if srv.PlexConn() == nil {
+		text = "plex is not configured\n" + text
+	}
+	for _, msg := range ChunkMessage(text, discordMessageLimit) {
+		s.ChannelMessageSend(m.ChannelID, msg)
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jrudio/go-plex-client"
+	"github.com/stretchr/testify/assert"
+	"golift.io/starr/radarr"
+	"golift.io/starr/sonarr"
+)
+
+func TestPlexItem_ParsePlexGUID(t *testing.T) {
+	i := &PlexItem{}
+	for _, guid := range []string{"plex://movie/5d776825880197001ec967c6", "tmdb://603", "imdb://tt0133093", "tvdb://169"} {
+		i.ParsePlexGUID(guid)
+	}
+	assert.Equal(t, &PlexItem{TmdbID: 603, TvdbID: 169, ImdbID: "tt0133093"}, i)
+
+	i = &PlexItem{}
+	i.ParsePlexGUID("com.plexapp.agents.themoviedb://603?lang=en")
+	i.ParsePlexGUID("com.plexapp.agents.thetvdb://79126/1/2?lang=en")
+	i.ParsePlexGUID("com.plexapp.agents.imdb://tt0133093?lang=en")
+	assert.Equal(t, &PlexItem{TmdbID: 603, TvdbID: 79126, ImdbID: "tt0133093"}, i)
+}
+
+func TestArrServer_ScanPlex(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/identity":
+			w.Write([]byte(`{"MediaContainer": {"machineIdentifier": "abc123"}}`))
+		case "/library/sections":
+			w.Write([]byte(`{"MediaContainer": {"Directory": [
+				{"key": "1", "title": "Movies", "type": "movie"},
+				{"key": "2", "title": "TV Shows", "type": "show"},
+				{"key": "3", "title": "Music", "type": "artist"}]}}`))
+		case "/library/sections/1/all":
+			assert.Equal(t, "1", r.URL.Query().Get("includeGuids"))
+			w.Write([]byte(`{"MediaContainer": {"Metadata": [
+				{"ratingKey": "10", "title": "Alien", "year": 1979, "guid": "plex://movie/1", "Guid": [{"id": "tmdb://348"}]},
+				{"ratingKey": "11", "title": "Hereditary", "year": 2018, "guid": "com.plexapp.agents.imdb://tt7784604?lang=en"},
+				{"ratingKey": "12", "title": "Home Video", "year": 2020, "guid": "local://12"}]}}`))
+		case "/library/sections/2/all":
+			w.Write([]byte(`{"MediaContainer": {"Metadata": [
+				{"ratingKey": "20", "title": "The Wire", "year": 2002, "guid": "plex://show/2", "Guid": [{"id": "tvdb://79126"}]}]}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+	plexConn, err := plex.New(api.URL, "token")
+	assert.NoError(t, err)
+	srv := &ArrServer{DB: db}
+	srv.SetPlexConn(plexConn)
+
+	assert.NoError(t, db.CacheRadarr([]*radarr.Movie{
+		{ID: 1, Title: "Alien", Year: 1979, TmdbID: 348, SizeOnDisk: 10},
+		{ID: 2, Title: "Hereditary", Year: 2018, TmdbID: 493922, ImdbID: "tt7784604", SizeOnDisk: 10},
+		{ID: 3, Title: "Up", Year: 2009, TmdbID: 14160, SizeOnDisk: 10},
+		{ID: 4, Title: "Dune", Year: 2021, TmdbID: 438631},
+	}))
+	assert.NoError(t, db.CacheSonarr([]*sonarr.Series{
+		{ID: 1, Title: "The Wire", Year: 2002, TvdbID: 79126},
+	}))
+	assert.NoError(t, srv.ScanPlex())
+
+	result, err := db.QueryReadOnly("SELECT app, item_id, rating_key, matched_by FROM plex_map ORDER BY app, item_id", sqlTimeout, sqlMaxRows)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"radarr", "1", "10", "tmdb"},
+		{"radarr", "2", "11", "imdb"},
+		{"sonarr", "1", "20", "tvdb"},
+	}, result.Rows)
+
+	results, _, err := db.Search(RadarrSearch, "alien", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"id=1 title=Alien status= added=0001-01-01 available=0 On Plex ✓ <" + PlexWatchURL("abc123", "10") + ">"}, results)
+	results, _, err = db.Search(RadarrSearch, "up", 10)
+	assert.NoError(t, err)
+	assert.NotContains(t, results[0], "On Plex")
+	assert.Equal(t, "https://app.plex.tv/desktop/#!/server/abc123/details?key=%2Flibrary%2Fmetadata%2F10", PlexWatchURL("abc123", "10"))
+
+	report, err := db.PlexReport()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"radarr: Up (2009)"}, report.MissingFromPlex, "Dune has no file and is not expected on plex")
+	assert.Equal(t, []string{"Movies: Home Video (2020)"}, report.MissingFromArr)
+	assert.Equal(t, "Downloaded but not on plex: 1\n  radarr: Up (2009)\nOn plex but not in radarr or sonarr: 1\n  Movies: Home Video (2020)", report.Text(10))
+	assert.Equal(t, "Downloaded but not on plex: 1\n  and 1 more\nOn plex but not in radarr or sonarr: 1\n  and 1 more", report.Text(0))
+
+	assert.NoError(t, db.CacheRadarr([]*radarr.Movie{{ID: 3, Title: "Up", Year: 2009, TmdbID: 14160}}))
+	assert.NoError(t, db.RebuildPlexMap())
+	report, err = db.PlexReport()
+	assert.NoError(t, err)
+	assert.Len(t, report.MissingFromArr, 3, "the map follows the caches")
+}
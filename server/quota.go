@@ -0,0 +1,540 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const (
+	QuotaScopeUser    = "user"
+	QuotaScopeRole    = "role"
+	QuotaScopeDefault = "default"
+
+	QuotaKindMovie  = "movie"
+	QuotaKindSeries = "series"
+)
+
+// Quota is the number of requests of a kind allowed in a rolling window.
+type Quota struct {
+	Scope   string
+	Subject string
+	Kind    string
+	Limit   int64
+	Window  time.Duration
+}
+
+// QuotaStatus is how much of a Quota a user has used.  A nil Quota means the
+// user is not limited.
+type QuotaStatus struct {
+	Quota     *Quota
+	Used      int64
+	Remaining int64
+	ResetAt   time.Time
+}
+
+// Exhausted reports if the user has no requests left in the current window.
+func (qs *QuotaStatus) Exhausted() bool {
+	return qs.Quota != nil && qs.Remaining <= 0
+}
+
+// MediaRequest is a single add made through the bot.
+type MediaRequest struct {
+	ID         int64
+	UserID     string
+	GuildID    string
+	Kind       string
+	Title      string
+	ExternalID int64
+	Override   bool
+	CreatedAt  time.Time
+}
+
+// ParseQuotaWindow parses a window like "12h", "7d" or "2w".  Go durations
+// are accepted as well.
+func ParseQuotaWindow(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+	if len(v) > 1 {
+		unit := v[len(v)-1]
+		if unit == 'd' || unit == 'w' {
+			n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid window %q", v)
+			}
+			if n <= 0 {
+				return 0, fmt.Errorf("window %q must be longer than 0", v)
+			}
+			d := time.Duration(n) * 24 * time.Hour
+			if unit == 'w' {
+				d *= 7
+			}
+			return d, nil
+		}
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid window %q", v)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("window %q must be longer than 0", v)
+	}
+	return d, nil
+}
+
+// FormatQuotaWindow is the inverse of ParseQuotaWindow for whole days.
+func FormatQuotaWindow(d time.Duration) string {
+	day := 24 * time.Hour
+	if d >= day && d%day == 0 {
+		return fmt.Sprintf("%dd", d/day)
+	}
+	return d.String()
+}
+
+func (d *DB) QuotaSet(q *Quota) error {
+	if q.Limit < 0 {
+		return fmt.Errorf("quota limit %d can not be negative", q.Limit)
+	}
+	if q.Window <= 0 {
+		return fmt.Errorf("quota window %s must be longer than 0", q.Window)
+	}
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	return sqlitex.Execute(conn, `INSERT INTO quotas (scope, subject, kind, max_requests, window_seconds) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(scope, subject, kind) DO UPDATE SET max_requests = EXCLUDED.max_requests, window_seconds = EXCLUDED.window_seconds`,
+		&sqlitex.ExecOptions{
+			Args: []interface{}{q.Scope, q.Subject, q.Kind, q.Limit, int64(q.Window / time.Second)},
+		})
+}
+
+func (d *DB) QuotaDelete(scope, subject, kind string) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	return sqlitex.Execute(conn, "DELETE FROM quotas WHERE scope = ? AND subject = ? AND kind = ?", &sqlitex.ExecOptions{
+		Args: []interface{}{scope, subject, kind},
+	})
+}
+
+func scanQuota(stmt *sqlite.Stmt) *Quota {
+	return &Quota{
+		Scope:   stmt.GetText("scope"),
+		Subject: stmt.GetText("subject"),
+		Kind:    stmt.GetText("kind"),
+		Limit:   stmt.GetInt64("max_requests"),
+		Window:  time.Duration(stmt.GetInt64("window_seconds")) * time.Second,
+	}
+}
+
+func (d *DB) QuotaList() ([]*Quota, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	results := []*Quota{}
+	err = sqlitex.Execute(conn, "SELECT scope, subject, kind, max_requests, window_seconds FROM quotas ORDER BY scope, subject, kind", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			results = append(results, scanQuota(stmt))
+			return nil
+		},
+	})
+	return results, err
+}
+
+// QuotaFor resolves the quota that applies to a user.  A user quota wins over
+// role quotas, the most generous role quota wins over the default and nil is
+// returned when nothing applies.
+func (d *DB) QuotaFor(userID string, roles []string, kind string) (*Quota, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	var user, role, def *Quota
+	err = sqlitex.Execute(conn, "SELECT scope, subject, kind, max_requests, window_seconds FROM quotas WHERE kind = ?", &sqlitex.ExecOptions{
+		Args: []interface{}{kind},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			q := scanQuota(stmt)
+			switch q.Scope {
+			case QuotaScopeUser:
+				if q.Subject == userID {
+					user = q
+				}
+			case QuotaScopeRole:
+				for _, r := range roles {
+					if q.Subject == r && (role == nil || q.Limit > role.Limit) {
+						role = q
+					}
+				}
+			case QuotaScopeDefault:
+				def = q
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case user != nil:
+		return user, nil
+	case role != nil:
+		return role, nil
+	}
+	return def, nil
+}
+
+func (d *DB) RequestAdd(r *MediaRequest) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now()
+	}
+	err = sqlitex.Execute(conn, `INSERT INTO media_requests (user_id, guild_id, kind, title, external_id, override, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		&sqlitex.ExecOptions{
+			Args: []interface{}{r.UserID, r.GuildID, r.Kind, r.Title, r.ExternalID, FormatBool(r.Override), r.CreatedAt.Unix()},
+		})
+	if err != nil {
+		return err
+	}
+	r.ID = conn.LastInsertRowID()
+	return nil
+}
+
+// QuotaReset stops all of a user's previous requests of kind from counting
+// against their quota.  An empty kind resets every kind.
+func (d *DB) QuotaReset(userID, kind string) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	return sqlitex.Execute(conn, "UPDATE media_requests SET override = 1 WHERE user_id = ? AND (? = '' OR kind = ?)", &sqlitex.ExecOptions{
+		Args: []interface{}{userID, kind, kind},
+	})
+}
+
+// QuotaCheck returns how much of their quota a user has used at time now.
+func (d *DB) QuotaCheck(userID string, roles []string, kind string, now time.Time) (*QuotaStatus, error) {
+	q, err := d.QuotaFor(userID, roles, kind)
+	if err != nil {
+		return nil, err
+	}
+	status := &QuotaStatus{Quota: q}
+	if q == nil {
+		return status, nil
+	}
+
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	return status, countQuotaUsage(conn, status, userID, kind, now)
+}
+
+// countQuotaUsage counts the requests of a user against status.Quota.
+func countQuotaUsage(conn *sqlite.Conn, status *QuotaStatus, userID, kind string, now time.Time) error {
+	var oldest int64
+	q := status.Quota
+	since := now.Add(-q.Window).Unix()
+	err := sqlitex.Execute(conn, `SELECT count(*) AS used, min(created_at) AS oldest FROM media_requests
+		WHERE user_id = ? AND kind = ? AND override = 0 AND created_at > ?`, &sqlitex.ExecOptions{
+		Args: []interface{}{userID, kind, since},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			status.Used = stmt.GetInt64("used")
+			oldest = stmt.GetInt64("oldest")
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	status.Remaining = q.Limit - status.Used
+	if status.Remaining < 0 {
+		status.Remaining = 0
+	}
+	if status.Used > 0 {
+		status.ResetAt = time.Unix(oldest, 0).Add(q.Window)
+	}
+	return nil
+}
+
+// RequestReserve records r unless the user has used up their quota, the
+// count and the insert share a transaction so two adds at once can not both
+// take the last request.  Overrides are always recorded.  The status is the
+// quota before r.
+func (d *DB) RequestReserve(r *MediaRequest, roles []string) (status *QuotaStatus, reserved bool, err error) {
+	q, err := d.QuotaFor(r.UserID, roles, r.Kind)
+	if err != nil {
+		return nil, false, err
+	}
+	status = &QuotaStatus{Quota: q}
+
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, false, err
+	}
+	defer d.Pool.Put(conn)
+
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = time.Now()
+	}
+	doUpdate := func() (err error) {
+		defer sqlitex.Save(conn)(&err)
+		if q != nil && !r.Override {
+			if err := countQuotaUsage(conn, status, r.UserID, r.Kind, r.CreatedAt); err != nil {
+				return err
+			}
+			if status.Exhausted() {
+				return nil
+			}
+		}
+		err = sqlitex.Execute(conn, `INSERT INTO media_requests (user_id, guild_id, kind, title, external_id, override, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			&sqlitex.ExecOptions{
+				Args: []interface{}{r.UserID, r.GuildID, r.Kind, r.Title, r.ExternalID, FormatBool(r.Override), r.CreatedAt.Unix()},
+			})
+		if err != nil {
+			return err
+		}
+		r.ID = conn.LastInsertRowID()
+		reserved = true
+		return nil
+	}
+	err = doUpdate()
+	return status, reserved, err
+}
+
+// RequestDelete drops a request, used when the add it reserved fails.
+func (d *DB) RequestDelete(id int64) error {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return err
+	}
+	defer d.Pool.Put(conn)
+
+	return sqlitex.Execute(conn, "DELETE FROM media_requests WHERE id = ?", &sqlitex.ExecOptions{
+		Args: []interface{}{id},
+	})
+}
+
+// FormatQuotaStatus renders the remaining quota for a reply, it is empty when
+// the user is not limited.
+func FormatQuotaStatus(kind string, qs *QuotaStatus) string {
+	if qs == nil || qs.Quota == nil {
+		return ""
+	}
+	if qs.Exhausted() {
+		msg := fmt.Sprintf("You have used all %d %s requests for the last %s", qs.Quota.Limit, kind, FormatQuotaWindow(qs.Quota.Window))
+		if !qs.ResetAt.IsZero() {
+			msg += fmt.Sprintf(", your next request frees up <t:%d:R>", qs.ResetAt.Unix())
+		}
+		return msg
+	}
+	msg := fmt.Sprintf("%d of %d %s requests left", qs.Remaining, qs.Quota.Limit, kind)
+	if !qs.ResetAt.IsZero() {
+		msg += fmt.Sprintf(", next one frees up <t:%d:R>", qs.ResetAt.Unix())
+	}
+	return msg
+}
+
+func memberRoles(m *discordgo.MessageCreate) []string {
+	if m.Member == nil {
+		return nil
+	}
+	return m.Member.Roles
+}
+
+// RequestAllowed checks the author's quota for kind and tells them when it is
+// used up.  Admins are never limited and their requests are recorded as
+// overrides.
+func (srv *ArrServer) RequestAllowed(s *discordgo.Session, m *discordgo.MessageCreate, kind string) (override bool, ok bool) {
+	if srv.IsAdmin(m) {
+		return true, true
+	}
+	status, err := srv.DB.QuotaCheck(m.Author.ID, memberRoles(m), kind, time.Now())
+	if err != nil {
+		log.Error().Err(err).Str("user", m.Author.ID).Msg("Checking quota failed")
+		s.ChannelMessageSend(m.ChannelID, "Could not check your request quota, try again later")
+		return false, false
+	}
+	if status.Exhausted() {
+		s.ChannelMessageSend(m.ChannelID, FormatQuotaStatus(kind, status))
+		return false, false
+	}
+	return false, true
+}
+
+// ReserveRequest records an add before it is made so it counts against the
+// author's quota, and tells them when the quota is used up.  A reservation
+// must be released with ReleaseRequest when the add fails.
+func (srv *ArrServer) ReserveRequest(s *discordgo.Session, m *discordgo.MessageCreate, kind, title string, externalID int64, override bool) (*MediaRequest, bool) {
+	r := &MediaRequest{
+		UserID:     m.Author.ID,
+		GuildID:    m.GuildID,
+		Kind:       kind,
+		Title:      title,
+		ExternalID: externalID,
+		Override:   override,
+	}
+	status, reserved, err := srv.DB.RequestReserve(r, memberRoles(m))
+	if err != nil {
+		log.Error().Err(err).Str("user", m.Author.ID).Msg("Recording request failed")
+		s.ChannelMessageSend(m.ChannelID, "Could not check your request quota, try again later")
+		return nil, false
+	}
+	if !reserved {
+		s.ChannelMessageSend(m.ChannelID, FormatQuotaStatus(kind, status))
+		return nil, false
+	}
+	return r, true
+}
+
+// ReleaseRequest drops the reservation of an add that failed.
+func (srv *ArrServer) ReleaseRequest(r *MediaRequest) {
+	if err := srv.DB.RequestDelete(r.ID); err != nil {
+		log.Error().Err(err).Str("user", r.UserID).Int64("request", r.ID).Msg("Releasing request failed")
+	}
+}
+
+// RequestQuotaLine returns the quota line for the reply to a successful add.
+func (srv *ArrServer) RequestQuotaLine(m *discordgo.MessageCreate, r *MediaRequest) string {
+	if r.Override {
+		return ""
+	}
+	status, err := srv.DB.QuotaCheck(m.Author.ID, memberRoles(m), r.Kind, time.Now())
+	if err != nil {
+		log.Error().Err(err).Str("user", m.Author.ID).Msg("Checking quota failed")
+		return ""
+	}
+	return FormatQuotaStatus(r.Kind, status)
+}
+
+const quotaUsage = "usage: !quota | !quota list | !quota set <user|role|default> <id> <movie|series> <limit> <window> | !quota delete <user|role|default> <id> <movie|series> | !quota reset <user> [movie|series]"
+
+func (srv *ArrServer) HandleQuota(s *discordgo.Session, m *discordgo.MessageCreate) {
+	args := strings.Fields(strings.TrimPrefix(m.Content, "!quota"))
+	if len(args) == 0 {
+		var b bytes.Buffer
+		for _, kind := range []string{QuotaKindMovie, QuotaKindSeries} {
+			status, err := srv.DB.QuotaCheck(m.Author.ID, memberRoles(m), kind, time.Now())
+			if err != nil {
+				log.Error().Err(err).Str("user", m.Author.ID).Msg("Checking quota failed")
+				return
+			}
+			if status.Quota == nil {
+				b.WriteString(fmt.Sprintf("%s: unlimited\n", kind))
+				continue
+			}
+			b.WriteString(fmt.Sprintf("%s: %s\n", kind, FormatQuotaStatus(kind, status)))
+		}
+		s.ChannelMessageSend(m.ChannelID, b.String())
+		return
+	}
+
+	if !srv.IsAdmin(m) {
+		s.ChannelMessageSend(m.ChannelID, "Only admins can manage quotas")
+		return
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		var quotas []*Quota
+		quotas, err = srv.DB.QuotaList()
+		if err == nil {
+			var b bytes.Buffer
+			for _, q := range quotas {
+				b.WriteString(fmt.Sprintf("%s %s %s: %d per %s\n", q.Scope, q.Subject, q.Kind, q.Limit, FormatQuotaWindow(q.Window)))
+			}
+			if b.Len() == 0 {
+				b.WriteString("No quotas configured")
+			}
+			s.ChannelMessageSend(m.ChannelID, b.String())
+			return
+		}
+	case "set":
+		if len(args) != 6 {
+			break
+		}
+		q := &Quota{Scope: args[1], Subject: MentionID(args[2]), Kind: args[3]}
+		if err = validQuotaTarget(q.Scope, q.Kind); err != nil {
+			break
+		}
+		if q.Limit, err = strconv.ParseInt(args[4], 10, 64); err != nil {
+			break
+		}
+		if q.Window, err = ParseQuotaWindow(args[5]); err != nil {
+			break
+		}
+		if err = srv.DB.QuotaSet(q); err == nil {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Quota for %s %s set to %d %s requests per %s", q.Scope, q.Subject, q.Limit, q.Kind, FormatQuotaWindow(q.Window)))
+			return
+		}
+	case "delete":
+		if len(args) != 4 {
+			break
+		}
+		if err = validQuotaTarget(args[1], args[3]); err != nil {
+			break
+		}
+		if err = srv.DB.QuotaDelete(args[1], MentionID(args[2]), args[3]); err == nil {
+			s.ChannelMessageSend(m.ChannelID, "Quota deleted")
+			return
+		}
+	case "reset":
+		if len(args) < 2 || len(args) > 3 {
+			break
+		}
+		kind := ""
+		if len(args) == 3 {
+			kind = args[2]
+		}
+		if err = srv.DB.QuotaReset(MentionID(args[1]), kind); err == nil {
+			s.ChannelMessageSend(m.ChannelID, "Quota reset for <@"+MentionID(args[1])+">")
+			return
+		}
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("command", m.Content).Msg("Problem with quota command")
+		s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+		return
+	}
+	s.ChannelMessageSend(m.ChannelID, quotaUsage)
+}
+
+func validQuotaTarget(scope, kind string) error {
+	switch scope {
+	case QuotaScopeUser, QuotaScopeRole, QuotaScopeDefault:
+	default:
+		return fmt.Errorf("unknown quota scope %q", scope)
+	}
+	switch kind {
+	case QuotaKindMovie, QuotaKindSeries:
+	default:
+		return fmt.Errorf("unknown quota kind %q", kind)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQuotaWindow(t *testing.T) {
+	for in, expected := range map[string]time.Duration{
+		"12h": 12 * time.Hour,
+		"7d":  7 * 24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+		"90m": 90 * time.Minute,
+	} {
+		d, err := ParseQuotaWindow(in)
+		assert.NoError(t, err, in)
+		assert.Equal(t, expected, d, in)
+	}
+	_, err := ParseQuotaWindow("soon")
+	assert.Error(t, err, "unknown windows should error")
+	for _, in := range []string{"0d", "-1w", "0s", "-5m"} {
+		_, err = ParseQuotaWindow(in)
+		assert.Error(t, err, in)
+	}
+	assert.Equal(t, "7d", FormatQuotaWindow(7*24*time.Hour))
+}
+
+func TestDB_QuotaFor(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, _ := NewDB(dcfg)
+	defer db.Close()
+
+	q, err := db.QuotaFor("user-1", nil, QuotaKindMovie)
+	assert.NoError(t, err)
+	assert.Nil(t, q, "no quotas configured means unlimited")
+
+	assert.NoError(t, db.QuotaSet(&Quota{Scope: QuotaScopeDefault, Subject: "*", Kind: QuotaKindMovie, Limit: 1, Window: time.Hour}))
+	assert.NoError(t, db.QuotaSet(&Quota{Scope: QuotaScopeRole, Subject: "role-a", Kind: QuotaKindMovie, Limit: 5, Window: time.Hour}))
+	assert.NoError(t, db.QuotaSet(&Quota{Scope: QuotaScopeRole, Subject: "role-b", Kind: QuotaKindMovie, Limit: 10, Window: time.Hour}))
+	assert.NoError(t, db.QuotaSet(&Quota{Scope: QuotaScopeUser, Subject: "user-2", Kind: QuotaKindMovie, Limit: 2, Window: time.Hour}))
+	assert.Error(t, db.QuotaSet(&Quota{Scope: QuotaScopeUser, Subject: "user-3", Kind: QuotaKindMovie, Limit: -1, Window: time.Hour}))
+	assert.Error(t, db.QuotaSet(&Quota{Scope: QuotaScopeUser, Subject: "user-3", Kind: QuotaKindMovie, Limit: 1}))
+
+	q, err = db.QuotaFor("user-1", nil, QuotaKindMovie)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), q.Limit, "default applies without roles")
+
+	q, err = db.QuotaFor("user-1", []string{"role-a", "role-b"}, QuotaKindMovie)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), q.Limit, "most generous role wins")
+
+	q, err = db.QuotaFor("user-2", []string{"role-b"}, QuotaKindMovie)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), q.Limit, "user quota wins over roles")
+
+	q, err = db.QuotaFor("user-2", nil, QuotaKindSeries)
+	assert.NoError(t, err)
+	assert.Nil(t, q, "quotas are per kind")
+
+	quotas, err := db.QuotaList()
+	assert.NoError(t, err)
+	assert.Len(t, quotas, 4)
+
+	assert.NoError(t, db.QuotaDelete(QuotaScopeUser, "user-2", QuotaKindMovie))
+	q, err = db.QuotaFor("user-2", nil, QuotaKindMovie)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), q.Limit, "deleted user quota falls back to default")
+}
+
+func TestDB_QuotaCheck(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, _ := NewDB(dcfg)
+	defer db.Close()
+
+	now := time.Now()
+	assert.NoError(t, db.QuotaSet(&Quota{Scope: QuotaScopeDefault, Subject: "*", Kind: QuotaKindMovie, Limit: 2, Window: 24 * time.Hour}))
+
+	// Outside of the window and should not count
+	assert.NoError(t, db.RequestAdd(&MediaRequest{UserID: "user-1", Kind: QuotaKindMovie, CreatedAt: now.Add(-48 * time.Hour)}))
+	// Admin override and should not count
+	assert.NoError(t, db.RequestAdd(&MediaRequest{UserID: "user-1", Kind: QuotaKindMovie, Override: true, CreatedAt: now.Add(-time.Hour)}))
+
+	status, err := db.QuotaCheck("user-1", nil, QuotaKindMovie, now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), status.Used)
+	assert.False(t, status.Exhausted())
+
+	first := now.Add(-2 * time.Hour)
+	assert.NoError(t, db.RequestAdd(&MediaRequest{UserID: "user-1", Kind: QuotaKindMovie, CreatedAt: first}))
+	assert.NoError(t, db.RequestAdd(&MediaRequest{UserID: "user-1", Kind: QuotaKindMovie, CreatedAt: now.Add(-time.Hour)}))
+
+	status, err = db.QuotaCheck("user-1", nil, QuotaKindMovie, now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), status.Used)
+	assert.Equal(t, int64(0), status.Remaining)
+	assert.True(t, status.Exhausted())
+	assert.Equal(t, first.Add(24*time.Hour).Unix(), status.ResetAt.Unix(), "reset is when the oldest request leaves the window")
+
+	assert.NoError(t, db.QuotaReset("user-1", QuotaKindMovie))
+	status, err = db.QuotaCheck("user-1", nil, QuotaKindMovie, now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), status.Remaining, "reset requests no longer count")
+
+	blocked := &QuotaStatus{Quota: &Quota{Limit: 0, Window: 24 * time.Hour}}
+	assert.True(t, blocked.Exhausted())
+	assert.Equal(t, "You have used all 0 movie requests for the last 1d", FormatQuotaStatus(QuotaKindMovie, blocked), "no reset time without usage")
+}
+
+func TestDB_RequestReserve(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, _ := NewDB(dcfg)
+	defer db.Close()
+
+	assert.NoError(t, db.QuotaSet(&Quota{Scope: QuotaScopeDefault, Subject: "*", Kind: QuotaKindMovie, Limit: 1, Window: 24 * time.Hour}))
+
+	first := &MediaRequest{UserID: "user-1", Kind: QuotaKindMovie, Title: "Alien"}
+	status, reserved, err := db.RequestReserve(first, nil)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+	assert.Equal(t, int64(1), status.Remaining, "the status is from before the request")
+	assert.NotZero(t, first.ID)
+
+	status, reserved, err = db.RequestReserve(&MediaRequest{UserID: "user-1", Kind: QuotaKindMovie, Title: "Heat"}, nil)
+	assert.NoError(t, err)
+	assert.False(t, reserved, "the last request is already taken")
+	assert.True(t, status.Exhausted())
+
+	_, reserved, err = db.RequestReserve(&MediaRequest{UserID: "user-1", Kind: QuotaKindMovie, Title: "Heat", Override: true}, nil)
+	assert.NoError(t, err)
+	assert.True(t, reserved, "overrides are always recorded")
+
+	assert.NoError(t, db.RequestDelete(first.ID))
+	_, reserved, err = db.RequestReserve(&MediaRequest{UserID: "user-1", Kind: QuotaKindMovie, Title: "Dune"}, nil)
+	assert.NoError(t, err)
+	assert.True(t, reserved, "a released request frees its slot")
+}
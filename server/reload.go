@@ -0,0 +1,161 @@
+package server
+
+import (
+	"errors"
+	"github.com/go-co-op/gocron"
+	"github.com/rs/zerolog/log"
+	"strings"
+)
+
+// ConfigReload is what has to be rebuilt after the config keys changed.
+type ConfigReload struct {
+	Plex         bool
+	Discord      bool
+	SyncInterval bool
+	Starr        bool
+	// Intervals of the other scheduled jobs
+	PlexInterval   bool
+	DiskInterval   bool
+	HealthInterval bool
+	ReloadInterval bool
+}
+
+// Any reports if anything has to be rebuilt.
+func (r ConfigReload) Any() bool {
+	return r.Plex || r.Discord || r.SyncInterval || r.Starr ||
+		r.PlexInterval || r.DiskInterval || r.HealthInterval || r.ReloadInterval
+}
+
+// ConfigReloadFor maps changed keys to what has to be rebuilt.  Guild
+// overrides are read on every command so only the global keys matter, the
+// same goes for admins, quotas and the starr add defaults.  New interval
+// keys have to be added here so their jobs are rescheduled.
+func ConfigReloadFor(keys []string) ConfigReload {
+	r := ConfigReload{}
+	for _, k := range keys {
+		switch {
+		case BaseKey(k) != k:
+		case k == "plex.url" || k == "plex.token":
+			r.Plex = true
+		case k == "discord.token":
+			r.Discord = true
+		case k == "starr.sync_interval":
+			r.SyncInterval = true
+		case strings.HasPrefix(k, "starr.") && (strings.HasSuffix(k, ".url") || strings.HasSuffix(k, ".token")):
+			r.Starr = true
+		case k == "plex.scan_interval" || k == "plex.history_interval":
+			r.PlexInterval = true
+		case k == "disk.check_interval":
+			r.DiskInterval = true
+		case k == "health.check_interval":
+			r.HealthInterval = true
+		case k == "config.reload_interval":
+			r.ReloadInterval = true
+		}
+	}
+	return r
+}
+
+// WatchConfig polls config_history every config.reload_interval and applies
+// changes made while the server is running, including ones made by the
+// arrmate cli from another process.
+func (srv *ArrServer) WatchConfig() error {
+	latest, err := srv.DB.ConfigHistoryLatest()
+	if err != nil {
+		return err
+	}
+	srv.configVersion = latest
+	return srv.scheduleConfigReload()
+}
+
+// scheduleConfigReload schedules ReloadConfig every config.reload_interval.
+func (srv *ArrServer) scheduleConfigReload() error {
+	interval, err := srv.DB.ConfigDuration("config.reload_interval")
+	if err != nil {
+		return err
+	}
+	job, err := srv.Cron.Every(interval).Do(srv.ReloadConfig)
+	if err != nil {
+		return err
+	}
+	job.Tag("config")
+	return nil
+}
+
+// reschedule removes the jobs tagged tag and schedules them again with the
+// current intervals.
+func (srv *ArrServer) reschedule(tag string, setups ...func() error) {
+	err := srv.Cron.RemoveByTag(tag)
+	if err != nil && !errors.Is(err, gocron.ErrJobNotFoundWithTag) {
+		log.Error().Err(err).Str("src", "server.reload").Str("tag", tag).Msg("removing jobs failed")
+	}
+	for _, setup := range setups {
+		if err := setup(); err != nil {
+			log.Error().Err(err).Str("src", "server.reload").Str("tag", tag).Msg("rescheduling jobs failed")
+		}
+	}
+}
+
+// ReloadConfig applies the config changes since the last check.  Failures
+// are logged and the old clients are kept where possible.
+func (srv *ArrServer) ReloadConfig() {
+	keys, latest, err := srv.DB.ConfigChangedSince(srv.configVersion)
+	if err != nil {
+		log.Error().Err(err).Str("src", "server.reload").Msg("checking config history failed")
+		return
+	}
+	srv.configVersion = latest
+	r := ConfigReloadFor(keys)
+	if !r.Any() {
+		return
+	}
+	log.Info().Str("src", "server.reload").Strs("keys", keys).Msg("config changed, reloading")
+
+	if r.Plex {
+		if err := srv.ReconnectPlex(); err != nil {
+			log.Error().Err(err).Str("src", "server.reload").Msg("reconnecting plex failed")
+		}
+	}
+	if r.Discord {
+		if err := srv.ReconnectDiscord(); err != nil {
+			log.Error().Err(err).Str("src", "server.reload").Msg("logging in to discord failed")
+		}
+	}
+	if r.SyncInterval {
+		srv.reschedule("starr", srv.SetupStarr)
+	} else if r.Starr {
+		if err := srv.Cron.RunByTag("starr"); err != nil {
+			log.Error().Err(err).Str("src", "server.reload").Msg("resyncing starr failed")
+		}
+	}
+	// The plex jobs are only scheduled once plex is set up
+	if r.PlexInterval || r.Plex {
+		srv.reschedule("plex", srv.SetupPlexScan, srv.SetupPlexHistory)
+	}
+	if r.DiskInterval {
+		srv.reschedule("disk", srv.SetupDiskSpace)
+	}
+	if r.HealthInterval {
+		srv.reschedule("health", srv.SetupHealth)
+	}
+	if r.ReloadInterval {
+		srv.reschedule("config", srv.scheduleConfigReload)
+	}
+}
+
+// ReconnectDiscord logs in again with the current discord.token, the new
+// session replaces the old one once it is open and the old one is closed
+// after.
+func (srv *ArrServer) ReconnectDiscord() error {
+	s, err := srv.newDiscordSession()
+	if err != nil {
+		return err
+	}
+	if err := s.Open(); err != nil {
+		return err
+	}
+	if old := srv.session.Swap(s); old != nil {
+		return old.Close()
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-co-op/gocron"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigReloadFor(t *testing.T) {
+	assert.False(t, ConfigReloadFor(nil).Any())
+	assert.False(t, ConfigReloadFor([]string{"discord.admin.users", "starr.radarr.root_folder", GuildKey("1234", "starr.radarr.url")}).Any(),
+		"keys read on every command need no reload")
+	assert.Equal(t, ConfigReload{Plex: true}, ConfigReloadFor([]string{"plex.token"}))
+	assert.Equal(t, ConfigReload{Discord: true, Starr: true}, ConfigReloadFor([]string{"discord.token", "starr.sonarr.url"}))
+	assert.Equal(t, ConfigReload{SyncInterval: true}, ConfigReloadFor([]string{"starr.sync_interval"}))
+	assert.Equal(t, ConfigReload{PlexInterval: true, DiskInterval: true, HealthInterval: true, ReloadInterval: true},
+		ConfigReloadFor([]string{"plex.scan_interval", "plex.history_interval", "disk.check_interval", "health.check_interval", "config.reload_interval"}))
+}
+
+func TestArrServer_ReloadConfig_Reschedules(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	srv := &ArrServer{DB: db, Cron: gocron.NewScheduler(time.UTC)}
+	assert.NoError(t, srv.SetupDiskSpace())
+	assert.NoError(t, srv.SetupHealth())
+	assert.NoError(t, srv.WatchConfig())
+	before, err := srv.Cron.FindJobsByTag("disk")
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.ConfigSet("disk.check_interval", "1h"))
+	assert.NoError(t, db.ConfigSet("config.reload_interval", "1m"))
+	assert.NoError(t, db.ConfigSet("plex.scan_interval", "2h"))
+	srv.ReloadConfig()
+
+	after, err := srv.Cron.FindJobsByTag("disk")
+	assert.NoError(t, err)
+	assert.Len(t, after, 1, "the old job is removed")
+	assert.NotSame(t, before[0], after[0], "the job is scheduled again")
+	for _, tag := range []string{"health", "config"} {
+		jobs, err := srv.Cron.FindJobsByTag(tag)
+		assert.NoError(t, err)
+		assert.Len(t, jobs, 1, tag)
+	}
+	_, err = srv.Cron.FindJobsByTag("plex")
+	assert.Error(t, err, "plex jobs wait for plex to be set up")
+}
+
+func TestDB_ConfigChangedSince(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	latest, err := db.ConfigHistoryLatest()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), latest)
+
+	assert.NoError(t, db.ConfigSet("plex.url", "http://one:32400"))
+	latest, err = db.ConfigHistoryLatest()
+	assert.NoError(t, err)
+
+	assert.NoError(t, db.ConfigSet("plex.url", "http://two:32400"))
+	assert.NoError(t, db.ConfigSet("plex.url", "http://three:32400"))
+	assert.NoError(t, db.ConfigSet("starr.sync_interval", "1m"))
+
+	keys, newest, err := db.ConfigChangedSince(latest)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"plex.url", "starr.sync_interval"}, keys)
+	assert.Equal(t, latest+3, newest)
+
+	keys, same, err := db.ConfigChangedSince(newest)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.Equal(t, newest, same)
+}
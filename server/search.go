@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"strings"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// searchMaxResults caps the number of lines a search replies with.
+const searchMaxResults = 50
+
+// Kinds of search fields, they decide which values and operators a filter
+// accepts.
+const (
+	SearchText   = "text"
+	SearchNumber = "number"
+	SearchBool   = "bool"
+	SearchList   = "list"
+)
+
+// SearchField is a field:value filter on a column of a cache table.
+type SearchField struct {
+	Name   string
+	Column string
+	Kind   string
+	Help   string
+}
+
+// SearchFlag is a bare word standing for a fixed condition, like missing.
+type SearchFlag struct {
+	Name      string
+	Condition string
+	Help      string
+}
+
+// SearchTable describes how a search command queries a cache table.  Words
+// that are not a field or a flag match the title, unknown field:value pairs
+// included since titles have colons.  Format renders a row of Columns.
+type SearchTable struct {
+	Command string
+	Table   string
+	Columns string
+	Fields  []*SearchField
+	Flags   []*SearchFlag
+	Format  func(stmt *sqlite.Stmt) string
+}
+
+// RadarrSearch is the query language of !radarr search.
+var RadarrSearch = &SearchTable{
+	Command: "!radarr search",
+	Table:   "radarr",
+	Columns: "id, title, status, added, is_available, monitored, year, " + plexLinkColumn("radarr"),
+	Fields: []*SearchField{
+		{"title", "title", SearchText, "part of the title"},
+		{"year", "year", SearchNumber, "release year"},
+		{"genre", "genres", SearchList, "one of the genres"},
+		{"status", "status", SearchText, "released, inCinemas, announced"},
+		{"monitored", "monitored", SearchBool, "true or false"},
+		{"available", "is_available", SearchBool, "true or false"},
+		{"rating", "rating", SearchNumber, "rating out of 10"},
+		{"tag", "tags", SearchList, "tag id"},
+		{"profile", "quality_profile_id", SearchNumber, "quality profile id"},
+		{"certification", "certification", SearchText, "PG-13, R, ..."},
+		{"tmdb", "tmdb_id", SearchNumber, "tmdb id"},
+		{"imdb", "imdb_id", SearchText, "imdb id"},
+	},
+	Flags: []*SearchFlag{
+		{"missing", "coalesce(size_on_disk, 0) = 0", "no file on disk"},
+		{"downloaded", "size_on_disk > 0", "a file is on disk"},
+	},
+	Format: func(stmt *sqlite.Stmt) string {
+		return fmt.Sprintf("id=%d title=%s status=%s added=%s available=%s",
+			stmt.ColumnInt64(0), stmt.ColumnText(1), stmt.ColumnText(2), stmt.ColumnText(3), stmt.ColumnText(4)) + onPlex(stmt.ColumnText(7))
+	},
+}
+
+// SonarrSearch is the query language of !sonarr search.
+var SonarrSearch = &SearchTable{
+	Command: "!sonarr search",
+	Table:   "sonarr",
+	Columns: "id, title, status, previous_airing, added, seasons, monitored, " + plexLinkColumn("sonarr"),
+	Fields: []*SearchField{
+		{"title", "title", SearchText, "part of the title"},
+		{"year", "year", SearchNumber, "first aired year"},
+		{"genre", "genres", SearchList, "one of the genres"},
+		{"status", "status", SearchText, "continuing, ended, upcoming"},
+		{"network", "network", SearchText, "HBO, BBC One, ..."},
+		{"monitored", "monitored", SearchBool, "true or false"},
+		{"seasons", "seasons", SearchNumber, "number of seasons"},
+		{"rating", "rating", SearchNumber, "rating out of 10"},
+		{"tag", "tags", SearchList, "tag id"},
+		{"profile", "quality_profile_id", SearchNumber, "quality profile id"},
+		{"certification", "certification", SearchText, "TV-MA, TV-14, ..."},
+		{"tvdb", "tvdb_id", SearchNumber, "tvdb id"},
+		{"imdb", "imdb_id", SearchText, "imdb id"},
+	},
+	Flags: []*SearchFlag{
+		{"missing", `EXISTS (SELECT 1 FROM sonarr_episodes e WHERE e.series_id = sonarr.id AND e.has_file = 0
+			AND e.air_date != '' AND e.air_date <= date('now'))`, "aired episodes without a file"},
+		{"complete", `NOT EXISTS (SELECT 1 FROM sonarr_episodes e WHERE e.series_id = sonarr.id AND e.has_file = 0
+			AND e.air_date != '' AND e.air_date <= date('now'))`, "every aired episode has a file"},
+	},
+	Format: func(stmt *sqlite.Stmt) string {
+		return fmt.Sprintf("id=%d title=%s status=%s list=%s added=%s",
+			stmt.ColumnInt64(0), stmt.ColumnText(1), stmt.ColumnText(2), stmt.ColumnText(3), stmt.ColumnText(4)) + onPlex(stmt.ColumnText(7))
+	},
+}
+
+// Help lists the fields and flags of the search.
+func (t *SearchTable) Help() string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("usage: %s [words] [field:value] [flag], prefix a filter with - to negate it\n", t.Command))
+	b.WriteString("numbers take :>, :>=, :<, :<= or a range like year:2010..2015\n")
+	for _, f := range t.Fields {
+		b.WriteString(fmt.Sprintf("  %s:%s - %s\n", f.Name, f.Kind, f.Help))
+	}
+	for _, f := range t.Flags {
+		b.WriteString(fmt.Sprintf("  %s - %s\n", f.Name, f.Help))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (t *SearchTable) field(name string) *SearchField {
+	for _, f := range t.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func (t *SearchTable) flag(name string) *SearchFlag {
+	for _, f := range t.Flags {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// SearchTokens splits a query on spaces, double quotes keep spaces in a value
+// like network:"Adult Swim".
+func SearchTokens(q string) []string {
+	results := []string{}
+	var b strings.Builder
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if b.Len() > 0 {
+				results = append(results, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() > 0 {
+		results = append(results, b.String())
+	}
+	return results
+}
+
+// Parse turns a query into a WHERE clause with its arguments, every value
+// is passed as an argument.
+func (t *SearchTable) Parse(q string) (string, []interface{}, error) {
+	conditions := []string{}
+	args := []interface{}{}
+	for _, token := range SearchTokens(q) {
+		negate := false
+		if strings.HasPrefix(token, "-") && len(token) > 1 {
+			negate = true
+			token = token[1:]
+		}
+		var cond string
+		var condArgs []interface{}
+		var err error
+		if name, value, ok := strings.Cut(token, ":"); ok && t.field(strings.ToLower(name)) != nil {
+			cond, condArgs, err = t.field(strings.ToLower(name)).condition(value)
+		} else if f := t.flag(strings.ToLower(token)); f != nil {
+			cond = f.Condition
+		} else {
+			cond, condArgs = `title LIKE ? ESCAPE '\'`, []interface{}{"%" + likeEscape(token) + "%"}
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		// A NULL column fails both a filter and its negation, count it as
+		// not matching so -field:value keeps the rows without a value.
+		if negate {
+			cond = "NOT coalesce(" + cond + ", 0)"
+		}
+		conditions = append(conditions, "("+cond+")")
+		args = append(args, condArgs...)
+	}
+	if len(conditions) == 0 {
+		return "1", nil, nil
+	}
+	return strings.Join(conditions, " AND "), args, nil
+}
+
+// likeEscape escapes the LIKE wildcards in s for ESCAPE '\'.
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// condition is the SQL for one field:value filter.
+func (f *SearchField) condition(value string) (string, []interface{}, error) {
+	if value == "" {
+		return "", nil, fmt.Errorf("%s needs a value", f.Name)
+	}
+	switch f.Kind {
+	case SearchText:
+		if f.Name == "title" {
+			return f.Column + ` LIKE ? ESCAPE '\'`, []interface{}{"%" + likeEscape(value) + "%"}, nil
+		}
+		return f.Column + " = ? COLLATE NOCASE", []interface{}{value}, nil
+	case SearchList:
+		return "(',' || " + f.Column + ` || ',') LIKE ? ESCAPE '\'`, []interface{}{"%," + likeEscape(value) + ",%"}, nil
+	case SearchBool:
+		b, err := strconv.ParseBool(strings.NewReplacer("yes", "true", "no", "false").Replace(strings.ToLower(value)))
+		if err != nil {
+			return "", nil, fmt.Errorf("%s is true or false, not %q", f.Name, value)
+		}
+		return f.Column + " = ?", []interface{}{FormatBool(b)}, nil
+	case SearchNumber:
+		if low, high, ok := strings.Cut(value, ".."); ok {
+			l, err := strconv.ParseFloat(low, 64)
+			if err != nil {
+				return "", nil, fmt.Errorf("%s range %q is not a number", f.Name, value)
+			}
+			h, err := strconv.ParseFloat(high, 64)
+			if err != nil {
+				return "", nil, fmt.Errorf("%s range %q is not a number", f.Name, value)
+			}
+			return f.Column + " BETWEEN ? AND ?", []interface{}{l, h}, nil
+		}
+		op := "="
+		for _, o := range []string{">=", "<=", ">", "<", "="} {
+			if strings.HasPrefix(value, o) {
+				op, value = o, strings.TrimPrefix(value, o)
+				break
+			}
+		}
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s is a number, not %q", f.Name, value)
+		}
+		return f.Column + " " + op + " ?", []interface{}{n}, nil
+	}
+	return "", nil, fmt.Errorf("unknown search field kind %s", f.Kind)
+}
+
+// Search runs a query against the cache table of t and returns a formatted
+// line per match ordered by title.  More is set when there were more than
+// limit matches.
+func (d *DB) Search(t *SearchTable, q string, limit int) ([]string, bool, error) {
+	where, args, err := t.Parse(q)
+	if err != nil {
+		return nil, false, err
+	}
+
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, false, err
+	}
+	defer d.Pool.Put(conn)
+
+	results := []string{}
+	more := false
+	err = sqlitex.ExecuteTransient(conn, fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY title LIMIT %d", t.Columns, t.Table, where, limit+1), &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if len(results) == limit {
+				more = true
+				return nil
+			}
+			results = append(results, t.Format(stmt))
+			return nil
+		},
+	})
+	return results, more, err
+}
+
+// HandleSearch replies to a search command with the matches of the rest of
+// the message, or the help of t when it is empty or help.
+func (srv *ArrServer) HandleSearch(s *discordgo.Session, m *discordgo.MessageCreate, t *SearchTable) {
+	q := strings.TrimSpace(strings.TrimPrefix(m.Content, t.Command))
+	if q == "" || q == "help" {
+		s.ChannelMessageSend(m.ChannelID, "```\n"+t.Help()+"\n```")
+		return
+	}
+	log.Debug().Str("table", t.Table).Str("query", q).Msg("Search query log")
+
+	results, more, err := srv.DB.Search(t, q, searchMaxResults)
+	if err != nil {
+		log.Warn().Err(err).Str("search", q).Msg("Problem with user search")
+		s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error()+", see "+t.Command+" help")
+		return
+	}
+	if len(results) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "Could not find results with Search: "+q)
+		return
+	}
+	if more {
+		results = append(results, fmt.Sprintf("showing the first %d matches", searchMaxResults))
+	}
+	for _, msg := range ChunkMessage(strings.Join(results, "\n"), discordMessageLimit) {
+		if _, err := s.ChannelMessageSend(m.ChannelID, msg); err != nil {
+			log.Error().Err(err).Msg("Sending message failed")
+			return
+		}
+	}
+}
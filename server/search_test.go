@@ -0,0 +1,85 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golift.io/starr"
+	"golift.io/starr/radarr"
+	"golift.io/starr/sonarr"
+)
+
+func TestSearchTokens(t *testing.T) {
+	assert.Equal(t, []string{"status:continuing", "network:Adult Swim", "rick"}, SearchTokens(`status:continuing  network:"Adult Swim" rick`))
+	assert.Equal(t, []string{}, SearchTokens("  "))
+}
+
+func TestSearchTable_Parse(t *testing.T) {
+	where, args, err := RadarrSearch.Parse("alien year:>2015 genre:horror monitored:false -missing")
+	assert.NoError(t, err)
+	assert.Equal(t, `(title LIKE ? ESCAPE '\') AND (year > ?) AND ((',' || genres || ',') LIKE ? ESCAPE '\') AND (monitored = ?) AND (NOT coalesce(coalesce(size_on_disk, 0) = 0, 0))`, where)
+	assert.Equal(t, []interface{}{"%alien%", float64(2015), "%,horror,%", 0}, args)
+
+	where, args, err = SonarrSearch.Parse("year:2000..2010 Star:Wars")
+	assert.NoError(t, err)
+	assert.Equal(t, `(year BETWEEN ? AND ?) AND (title LIKE ? ESCAPE '\')`, where)
+	assert.Equal(t, []interface{}{float64(2000), float64(2010), "%Star:Wars%"}, args, "unknown fields are part of the title")
+
+	_, args, err = RadarrSearch.Parse(`100% title:a_b`)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{`%100\%%`, `%a\_b%`}, args, "LIKE wildcards are matched literally")
+
+	for _, q := range []string{"year:new", "monitored:maybe", "rating:", "year:1..x"} {
+		_, _, err = RadarrSearch.Parse(q)
+		assert.Error(t, err, q)
+	}
+}
+
+func TestDB_Search(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.CacheRadarr([]*radarr.Movie{
+		{ID: 1, Title: "Alien", Year: 1979, Genres: []string{"Horror", "Science Fiction"}, SizeOnDisk: 10, Monitored: true},
+		{ID: 2, Title: "Hereditary", Year: 2018, Genres: []string{"Horror"}, Ratings: &starr.Ratings{Value: 7.3}},
+		{ID: 3, Title: "Up", Year: 2009, Genres: []string{"Animation"}},
+	}))
+	assert.NoError(t, db.CacheSonarr([]*sonarr.Series{
+		{ID: 1, Title: "Rick and Morty", Status: "continuing", Network: "Adult Swim"},
+		{ID: 2, Title: "The Wire", Status: "ended", Network: "HBO"},
+	}))
+
+	results, more, err := db.Search(RadarrSearch, "year:>2015 genre:horror monitored:false missing", 10)
+	assert.NoError(t, err)
+	assert.False(t, more)
+	assert.Len(t, results, 1)
+	assert.Contains(t, results[0], "title=Hereditary")
+
+	results, _, err = db.Search(RadarrSearch, `genre:"science fiction"`, 10)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Contains(t, results[0], "title=Alien")
+
+	results, more, err = db.Search(RadarrSearch, "-genre:animation", 1)
+	assert.NoError(t, err)
+	assert.True(t, more)
+	assert.Len(t, results, 1)
+
+	results, _, err = db.Search(RadarrSearch, "-rating:>5", 10)
+	assert.NoError(t, err)
+	assert.Len(t, results, 2, "a negated filter keeps rows without a value")
+
+	results, _, err = db.Search(RadarrSearch, "_", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	results, _, err = db.Search(SonarrSearch, `status:continuing network:"adult swim"`, 10)
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Contains(t, results[0], "title=Rick and Morty")
+
+	_, _, err = db.Search(SonarrSearch, "seasons:many", 10)
+	assert.Error(t, err)
+}
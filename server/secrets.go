@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const (
+	// SecretKeyEnv holds a base64 encoded 32 byte key, generate one with
+	// `openssl rand -base64 32`.
+	SecretKeyEnv = "ARRMATE_SECRET_KEY"
+	// SecretKeyFileEnv names a file holding the base64 encoded key.
+	SecretKeyFileEnv = "ARRMATE_SECRET_KEY_FILE"
+
+	secretPrefix = "enc:v1:"
+	secretMask   = "********"
+)
+
+// IsSensitiveKey reports if the config key k holds a secret.  Guild
+// overrides of a secret are secrets as well.
+func IsSensitiveKey(k string) bool {
+	k = BaseKey(k)
+	switch k {
+	case "discord.token", "plex.token":
+		return true
+	}
+	return strings.HasPrefix(k, "starr.") && strings.HasSuffix(k, ".token")
+}
+
+// IsEncrypted reports if a stored config value was sealed by a SecretBox.
+func IsEncrypted(v string) bool {
+	return strings.HasPrefix(v, secretPrefix)
+}
+
+// MaskSecret hides the value of sensitive keys for display.
+func MaskSecret(k, v string) string {
+	if v == "" || !IsSensitiveKey(k) {
+		return v
+	}
+	return secretMask
+}
+
+// SecretBox encrypts config values with AES-256-GCM.  The config key is used
+// as additional data so a sealed value can not be moved to another key.
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+func NewSecretBox(key []byte) (*SecretBox, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("secret key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretBox{aead: aead}, nil
+}
+
+// LoadSecretBox reads the key from ARRMATE_SECRET_KEY or the file named by
+// ARRMATE_SECRET_KEY_FILE.  It returns nil when neither is set.
+func LoadSecretBox() (*SecretBox, error) {
+	encoded := os.Getenv(SecretKeyEnv)
+	if encoded == "" {
+		path := os.Getenv(SecretKeyFileEnv)
+		if path == "" {
+			return nil, nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", SecretKeyFileEnv, err)
+		}
+		encoded = string(b)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("secret key is not valid base64: %w", err)
+	}
+	return NewSecretBox(key)
+}
+
+func (b *SecretBox) Seal(k, v string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(v), []byte(k))
+	return secretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (b *SecretBox) Open(k, v string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, secretPrefix))
+	if err != nil {
+		return "", fmt.Errorf("config %s: %w", k, err)
+	}
+	if len(sealed) < b.aead.NonceSize() {
+		return "", fmt.Errorf("config %s: encrypted value is too short", k)
+	}
+	nonce, ciphertext := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	plain, err := b.aead.Open(nil, nonce, ciphertext, []byte(k))
+	if err != nil {
+		return "", fmt.Errorf("config %s: decrypting failed, wrong secret key?", k)
+	}
+	return string(plain), nil
+}
+
+// SealSecret encrypts v when k is sensitive.  Without a secret key the value
+// is stored in plaintext and a warning is logged.
+func (d *DB) SealSecret(k, v string) (string, error) {
+	if !IsSensitiveKey(k) {
+		return v, nil
+	}
+	if d.Secrets == nil {
+		d.Log.Warn().Str("key", k).Msgf("storing secret in plaintext, set %s or %s to encrypt it", SecretKeyEnv, SecretKeyFileEnv)
+		return v, nil
+	}
+	return d.Secrets.Seal(k, v)
+}
+
+// OpenSecret decrypts v when it was stored encrypted, plaintext values are
+// returned as they are.
+func (d *DB) OpenSecret(k, v string) (string, error) {
+	if !IsEncrypted(v) {
+		return v, nil
+	}
+	if d.Secrets == nil {
+		return "", fmt.Errorf("config %s is encrypted, set %s or %s", k, SecretKeyEnv, SecretKeyFileEnv)
+	}
+	return d.Secrets.Open(k, v)
+}
+
+// EncryptSecrets seals every sensitive value still stored in plaintext,
+// including the old and new values kept in config_history, and returns the
+// keys it changed.
+func (d *DB) EncryptSecrets() (changed []string, err error) {
+	if d.Secrets == nil {
+		return nil, fmt.Errorf("set %s or %s before encrypting secrets", SecretKeyEnv, SecretKeyFileEnv)
+	}
+	keys, err := d.ConfigList()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	defer sqlitex.Save(conn)(&err)
+	changed = []string{}
+	for _, k := range keys {
+		if !IsSensitiveKey(k) {
+			continue
+		}
+		found, v, err := d.RawConfigGet(nil, conn, k)
+		if err != nil {
+			return changed, err
+		}
+		if !found || IsEncrypted(v) {
+			continue
+		}
+		if v, err = d.Secrets.Seal(k, v); err != nil {
+			return changed, err
+		}
+		if err = d.RawConfigSet(nil, conn, k, v); err != nil {
+			return changed, err
+		}
+		changed = append(changed, k)
+	}
+	history, err := d.encryptHistory(conn)
+	if err != nil {
+		return changed, err
+	}
+	for _, k := range history {
+		if !slices.Contains(changed, k) {
+			changed = append(changed, k)
+		}
+	}
+	return changed, nil
+}
+
+// encryptHistory seals the plaintext secrets in config_history and returns
+// the keys it changed.
+func (d *DB) encryptHistory(conn *sqlite.Conn) ([]string, error) {
+	rows := []*ConfigHistory{}
+	err := sqlitex.Execute(conn, `SELECT id, key, old_value, new_value, actor, created_at FROM config_history ORDER BY id`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if h := scanConfigHistory(stmt); IsSensitiveKey(h.Key) {
+				rows = append(rows, h)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	seal := func(k, v string, set bool) (interface{}, bool, error) {
+		if !set || IsEncrypted(v) {
+			return nullable(v, set), false, nil
+		}
+		sealed, err := d.Secrets.Seal(k, v)
+		return sealed, true, err
+	}
+	changed := []string{}
+	for _, h := range rows {
+		old, oldSealed, err := seal(h.Key, h.Old, h.OldSet)
+		if err != nil {
+			return changed, err
+		}
+		v, newSealed, err := seal(h.Key, h.New, h.NewSet)
+		if err != nil {
+			return changed, err
+		}
+		if !oldSealed && !newSealed {
+			continue
+		}
+		err = sqlitex.Execute(conn, `UPDATE config_history SET old_value = ?, new_value = ? WHERE id = ?`, &sqlitex.ExecOptions{
+			Args: []interface{}{old, v, h.ID},
+		})
+		if err != nil {
+			return changed, fmt.Errorf("encrypting config history errored: %w", err)
+		}
+		if !slices.Contains(changed, h.Key) {
+			changed = append(changed, h.Key)
+		}
+	}
+	return changed, nil
+}
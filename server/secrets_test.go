@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsSensitiveKey(t *testing.T) {
+	for k, expected := range map[string]bool{
+		"discord.token":                  true,
+		"plex.token":                     true,
+		"starr.sonarr.token":             true,
+		"starr.radarr.token":             true,
+		"guild:1234:starr.radarr.token":  true,
+		"plex.url":                       false,
+		"starr.radarr.url":               false,
+		"discord.admin.users":            false,
+		"guild:1234:discord.admin.roles": false,
+	} {
+		assert.Equal(t, expected, IsSensitiveKey(k), k)
+	}
+	assert.Equal(t, secretMask, MaskSecret("plex.token", "abc"))
+	assert.Equal(t, "http://plex", MaskSecret("plex.url", "http://plex"))
+}
+
+func TestSecretBox(t *testing.T) {
+	box, err := NewSecretBox(make([]byte, 32))
+	assert.NoError(t, err)
+
+	sealed, err := box.Seal("plex.token", "hunter2")
+	assert.NoError(t, err)
+	assert.True(t, IsEncrypted(sealed))
+	assert.NotContains(t, sealed, "hunter2")
+
+	plain, err := box.Open("plex.token", sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", plain)
+
+	_, err = box.Open("discord.token", sealed)
+	assert.Error(t, err, "sealed values are bound to their key")
+
+	_, err = NewSecretBox(make([]byte, 16))
+	assert.Error(t, err, "only 32 byte keys are accepted")
+}
+
+func TestDB_ConfigSet_Encrypts_Secrets(t *testing.T) {
+	t.Setenv(SecretKeyEnv, base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.ConfigSet("plex.token", "hunter2"))
+	assert.NoError(t, db.ConfigSet("plex.url", "http://plex:32400"))
+
+	conn, err := db.Get(context.TODO())
+	assert.NoError(t, err)
+	_, raw, err := db.RawConfigGet(nil, conn, "plex.token")
+	assert.NoError(t, err)
+	assert.True(t, IsEncrypted(raw), "secrets are stored encrypted")
+	_, raw, err = db.RawConfigGet(nil, conn, "plex.url")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://plex:32400", raw, "other keys are stored in plaintext")
+
+	// Written before a key was configured
+	assert.NoError(t, db.RawConfigSet(nil, conn, "starr.sonarr.token", "plaintext"))
+	db.Put(conn)
+
+	found, v, err := db.ConfigGet("plex.token")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "hunter2", v, "ConfigGet decrypts transparently")
+
+	changed, err := db.EncryptSecrets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"starr.sonarr.token"}, changed)
+
+	found, v, err = db.ConfigGet("starr.sonarr.token")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "plaintext", v)
+
+	db.Secrets = nil
+	_, _, err = db.ConfigGet("plex.token")
+	assert.Error(t, err, "encrypted values need the secret key")
+}
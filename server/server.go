@@ -10,15 +10,22 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 type ArrServer struct {
-	Session  *discordgo.Session
-	PlexConn *plex.Plex
-	DB       *DB
-	Cron     *gocron.Scheduler
+	DB   *DB
+	Cron *gocron.Scheduler
+
+	// session and plexConn are swapped by ReloadConfig while commands and
+	// jobs use them, read them with Session and PlexConn.
+	session  atomic.Pointer[discordgo.Session]
+	plexConn atomic.Pointer[plex.Plex]
+
+	// configVersion is the newest config_history id applied by ReloadConfig.
+	configVersion int64
 }
 
 type ArrConfig struct {
@@ -55,19 +62,44 @@ func NewServer(ac DBConfig) (*ArrServer, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = as.SetupDiskSpace()
+	if err != nil {
+		return nil, err
+	}
+	err = as.SetupHealth()
+	if err != nil {
+		return nil, err
+	}
+	err = as.SetupPlexScan()
+	if err != nil {
+		return nil, err
+	}
+	err = as.SetupPlexHistory()
+	if err != nil {
+		return nil, err
+	}
+	err = as.WatchConfig()
+	if err != nil {
+		return nil, err
+	}
 
 	return as, nil
 }
 
-func NewClient(ac DBConfig) (*ArrServer, error) {
-	var err error
+// NewDBClient opens only the database, with the config overlay and secret
+// box, for commands that never talk to plex.
+func NewDBClient(ac DBConfig) (*ArrServer, error) {
 	db, err := NewDB(ac)
 	if err != nil {
 		return nil, err
 	}
+	return &ArrServer{DB: db}, nil
+}
 
-	as := &ArrServer{
-		DB: db,
+func NewClient(ac DBConfig) (*ArrServer, error) {
+	as, err := NewDBClient(ac)
+	if err != nil {
+		return nil, err
 	}
 	err = as.SetupPlex()
 	if err != nil {
@@ -77,71 +109,123 @@ func NewClient(ac DBConfig) (*ArrServer, error) {
 	return as, nil
 }
 
+// Session returns the current discord session, nil before SetupDiscord.
+func (srv *ArrServer) Session() *discordgo.Session {
+	return srv.session.Load()
+}
+
+// PlexConn returns the current plex client, nil when plex is not set up.
+func (srv *ArrServer) PlexConn() *plex.Plex {
+	return srv.plexConn.Load()
+}
+
+// SetPlexConn replaces the plex client.
+func (srv *ArrServer) SetPlexConn(p *plex.Plex) {
+	srv.plexConn.Store(p)
+}
+
+// SetupPlex connects to plex.url, a plex that does not answer yet is only
+// logged so the server still starts.
 func (srv *ArrServer) SetupPlex() error {
+	plexConn, result, err := srv.newPlexConn()
+	if err != nil {
+		return err
+	}
+	srv.SetPlexConn(plexConn)
+
+	if !result {
+		log.Warn().Str("src", "server.plex").Msg("plexConn.Test() did not return results")
+		return nil
+	}
+
+	log.Debug().Str("src", "server.plex").Msg("SetupPlex completed")
+	return nil
+}
+
+// ReconnectPlex connects to the current plex.url and only replaces the
+// current client once the new one answers, a failed reload keeps the old
+// client.
+func (srv *ArrServer) ReconnectPlex() error {
+	plexConn, result, err := srv.newPlexConn()
+	if err != nil {
+		return err
+	}
+	if !result {
+		return fmt.Errorf("plex at %s did not answer the connection test", plexConn.URL)
+	}
+	srv.SetPlexConn(plexConn)
+	return nil
+}
 
+// newPlexConn builds a client for plex.url and plex.token and reports if it
+// answered the connection test.
+func (srv *ArrServer) newPlexConn() (*plex.Plex, bool, error) {
 	found, plexServer, err := srv.DB.ConfigGet("plex.url")
 	if !found {
-		return fmt.Errorf("No config for plex.url")
+		return nil, false, fmt.Errorf("No config for plex.url")
 	} else if err != nil {
-		return err
+		return nil, false, err
 	}
 	found, plexToken, err := srv.DB.ConfigGet("plex.token")
 	if !found {
-		return fmt.Errorf("No config for plex.token")
+		return nil, false, fmt.Errorf("No config for plex.token")
 	} else if err != nil {
-		return err
+		return nil, false, err
 	}
 
 	plexConn, err := plex.New(plexServer, plexToken)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
-	srv.PlexConn = plexConn
 
-	result, err := srv.PlexConn.Test()
+	result, err := plexConn.Test()
 	if err != nil {
-		return err
+		return nil, false, err
 	}
+	return plexConn, result, nil
+}
 
-	if !result {
-		log.Warn().Str("src", "server.plex").Msg("plexConn.Test() did not return results")
-		return nil
+func (srv *ArrServer) SetupDiscord() error {
+	s, err := srv.newDiscordSession()
+	if err != nil {
+		return err
 	}
-
-	log.Debug().Str("src", "server.plex").Msg("SetupPlex completed")
+	srv.session.Store(s)
 	return nil
 }
 
-func (srv *ArrServer) SetupDiscord() error {
+// newDiscordSession builds a session for discord.token with the arrmate
+// handlers, it is not opened.
+func (srv *ArrServer) newDiscordSession() (*discordgo.Session, error) {
 	found, token, err := srv.DB.ConfigGet("discord.token")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !found {
-		return fmt.Errorf("discord.token must be set before starting the arrmate server")
+		return nil, fmt.Errorf("discord.token must be set before starting the arrmate server")
 	}
 
 	s, err := discordgo.New("Bot " + token)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	srv.Session = s
-	srv.Session.Identify.Intents = discordgo.IntentsGuildMessages
-	srv.Session.AddHandler(srv.OnReady)
-	srv.Session.AddHandler(srv.DiscordMessageHandler)
+	s.Identify.Intents = discordgo.IntentsGuildMessages
+	s.AddHandler(srv.OnReady)
+	s.AddHandler(srv.DiscordMessageHandler)
+	s.AddHandler(srv.DiscordInteractionHandler)
 
-	return nil
+	return s, nil
 
 }
 
 func (srv *ArrServer) Run() error {
-	err := srv.Session.Open()
+	err := srv.Session().Open()
 	if err != nil {
 		//return fmt.Println("Error opening Discord session: ", err)
 		return err
 	}
 
-	guilds, err := srv.Session.UserGuilds(100, "", "")
+	guilds, err := srv.Session().UserGuilds(100, "", "")
 	if len(guilds) == 0 {
 		fmt.Print("\t(none)")
 	}
@@ -158,7 +242,7 @@ func (srv *ArrServer) Run() error {
 	<-sc
 
 	// Cleanly close down the Discord session.
-	return srv.Session.Close()
+	return srv.Session().Close()
 }
 
 // OnReady handles the "ready" event from Discord
@@ -174,28 +258,16 @@ func (srv *ArrServer) DiscordMessageHandler(s *discordgo.Session, m *discordgo.M
 	}
 	//fmt.Println(m.Content)
 
-	// If the message is "ping" reply with "Pong!"
-	if m.Content == "ping" {
-		srv.HandlePing(s, m)
-	}
-	if strings.HasPrefix(m.Content, "!plex search ") {
-		srv.HandlePlexSearch(s, m)
-	}
-	if strings.HasPrefix(m.Content, "!sonarr search ") {
-		srv.HandleSonarrSearch(s, m)
+	route := MatchCommand(m.Content)
+	if route == nil {
+		return
 	}
-	if strings.HasPrefix(m.Content, "!radarr search ") {
-		srv.HandleRadarrSearch(s, m)
+	if !srv.CommandAllowed(s, m, route) {
+		return
 	}
+	route.Handler(srv, s, m)
 
 	/*
-			if strings.HasPrefix(m.Content, "!sql ") {
-				srv.HandleSQL(s, m)
-			}
-			if strings.HasPrefix(m.Content, "!config ") {
-				srv.HandleSQL(s, m)
-			}
-
 		if strings.HasPrefix(m.Content, "!plex ") {
 			srv.HandlePlex(s, m)
 		}
@@ -203,14 +275,175 @@ func (srv *ArrServer) DiscordMessageHandler(s *discordgo.Session, m *discordgo.M
 
 }
 
+// CommandRoute maps a message to its handler and the command group used to
+// restrict it to channels.
+type CommandRoute struct {
+	// Prefix is matched against the start of the message, when Exact is
+	// set the whole message must match instead.
+	Prefix  string
+	Exact   bool
+	Group   string
+	Handler func(srv *ArrServer, s *discordgo.Session, m *discordgo.MessageCreate)
+	// Always bypasses the channel allow-list.
+	Always bool
+}
+
+// CommandRoutes are checked in order and the first match handles the message.
+var CommandRoutes = []*CommandRoute{
+	{Prefix: "ping", Exact: true, Group: CommandGroupGeneral, Handler: (*ArrServer).HandlePing},
+	{Prefix: "!plex report", Exact: true, Group: CommandGroupGeneral, Handler: (*ArrServer).HandlePlexReport},
+	{Prefix: "!plex history", Exact: true, Group: CommandGroupAdmin, Handler: (*ArrServer).HandlePlexHistory},
+	{Prefix: "!plex history ", Group: CommandGroupAdmin, Handler: (*ArrServer).HandlePlexHistory},
+	{Prefix: "!plex top", Exact: true, Group: CommandGroupGeneral, Handler: (*ArrServer).HandlePlexTop},
+	{Prefix: "!plex unwatched", Exact: true, Group: CommandGroupGeneral, Handler: (*ArrServer).HandlePlexUnwatched},
+	{Prefix: "!plex unwatched ", Group: CommandGroupGeneral, Handler: (*ArrServer).HandlePlexUnwatched},
+	{Prefix: "!plex search ", Group: CommandGroupSearch, Handler: (*ArrServer).HandlePlexSearch},
+	{Prefix: "!sonarr search ", Group: CommandGroupSearch, Handler: (*ArrServer).HandleSonarrSearch},
+	{Prefix: "!sonarr episodes ", Group: CommandGroupSearch, Handler: (*ArrServer).HandleSonarrEpisodes},
+	{Prefix: "!radarr search ", Group: CommandGroupSearch, Handler: (*ArrServer).HandleRadarrSearch},
+	{Prefix: "!radarr add ", Group: CommandGroupRequest, Handler: (*ArrServer).HandleRadarrAdd},
+	{Prefix: "!sonarr add ", Group: CommandGroupRequest, Handler: (*ArrServer).HandleSonarrAdd},
+	{Prefix: "!radarr monitor ", Group: CommandGroupAdmin, Handler: (*ArrServer).HandleMediaAction},
+	{Prefix: "!radarr unmonitor ", Group: CommandGroupAdmin, Handler: (*ArrServer).HandleMediaAction},
+	{Prefix: "!radarr delete ", Group: CommandGroupAdmin, Handler: (*ArrServer).HandleMediaAction},
+	{Prefix: "!radarr grab ", Group: CommandGroupAdmin, Handler: (*ArrServer).HandleMediaAction},
+	{Prefix: "!sonarr monitor ", Group: CommandGroupAdmin, Handler: (*ArrServer).HandleMediaAction},
+	{Prefix: "!sonarr unmonitor ", Group: CommandGroupAdmin, Handler: (*ArrServer).HandleMediaAction},
+	{Prefix: "!sonarr delete ", Group: CommandGroupAdmin, Handler: (*ArrServer).HandleMediaAction},
+	{Prefix: "!sonarr grab ", Group: CommandGroupAdmin, Handler: (*ArrServer).HandleMediaAction},
+	{Prefix: "!cleanup", Exact: true, Group: CommandGroupAdmin, Handler: (*ArrServer).HandleCleanup},
+	{Prefix: "!stats", Exact: true, Group: CommandGroupGeneral, Handler: (*ArrServer).HandleStats},
+	{Prefix: "!health", Exact: true, Group: CommandGroupGeneral, Handler: (*ArrServer).HandleHealth},
+	{Prefix: "!disk", Exact: true, Group: CommandGroupGeneral, Handler: (*ArrServer).HandleDisk},
+	{Prefix: "!chart", Exact: true, Group: CommandGroupGeneral, Handler: (*ArrServer).HandleChart},
+	{Prefix: "!chart ", Group: CommandGroupGeneral, Handler: (*ArrServer).HandleChart},
+	{Prefix: "!quota", Exact: true, Group: CommandGroupRequest, Handler: (*ArrServer).HandleQuota},
+	{Prefix: "!quota ", Group: CommandGroupRequest, Handler: (*ArrServer).HandleQuota},
+	{Prefix: "!channels", Exact: true, Group: CommandGroupAdmin, Handler: (*ArrServer).HandleChannels, Always: true},
+	{Prefix: "!channels ", Group: CommandGroupAdmin, Handler: (*ArrServer).HandleChannels, Always: true},
+	{Prefix: "!sql ", Group: CommandGroupAdmin, Handler: (*ArrServer).HandleSQL},
+	{Prefix: "!config", Exact: true, Group: CommandGroupAdmin, Handler: (*ArrServer).HandleConfig},
+	{Prefix: "!config ", Group: CommandGroupAdmin, Handler: (*ArrServer).HandleConfig},
+}
+
+// MatchCommand returns the route handling content or nil.
+func MatchCommand(content string) *CommandRoute {
+	for _, r := range CommandRoutes {
+		if r.Exact && content == r.Prefix {
+			return r
+		}
+		if !r.Exact && strings.HasPrefix(content, r.Prefix) {
+			return r
+		}
+	}
+	return nil
+}
+
+// CommandAllowed checks the guild channel allow-list for the route, telling
+// the author where the command can be used when it is not allowed here.
+// Direct messages are not restricted.
+func (srv *ArrServer) CommandAllowed(s *discordgo.Session, m *discordgo.MessageCreate, route *CommandRoute) bool {
+	if route.Always || m.GuildID == "" {
+		return true
+	}
+	allowed, channels, err := srv.DB.GuildChannelAllowed(m.GuildID, route.Group, m.ChannelID)
+	if err != nil {
+		log.Error().Err(err).Str("guild", m.GuildID).Msg("Checking channel allow-list failed")
+		return false
+	}
+	if allowed {
+		return true
+	}
+	mentions := make([]string, len(channels))
+	for i, c := range channels {
+		mentions[i] = "<#" + c + ">"
+	}
+	s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s commands can only be used in %s", route.Group, strings.Join(mentions, ", ")))
+	return false
+}
+
+// ConfigValues returns a comma separated config value for a guild as a list,
+// missing keys are an empty list.
+func (srv *ArrServer) ConfigValues(guildID, k string) ([]string, error) {
+	found, v, err := srv.DB.ConfigGetGuild(guildID, k)
+	if err != nil || !found {
+		return nil, err
+	}
+	results := []string{}
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			results = append(results, item)
+		}
+	}
+	return results, nil
+}
+
+// IsAdmin reports if the author of m is listed in discord.admin.users or has a
+// role listed in discord.admin.roles, either may be overridden per guild.
+func (srv *ArrServer) IsAdmin(m *discordgo.MessageCreate) bool {
+	return srv.isAdmin(m.GuildID, m.Author.ID, memberRoles(m))
+}
+
+// IsGlobalAdmin is IsAdmin ignoring the guild overrides, for commands that
+// act on the global radarr and sonarr instances.
+func (srv *ArrServer) IsGlobalAdmin(m *discordgo.MessageCreate) bool {
+	return srv.isAdmin("", m.Author.ID, memberRoles(m))
+}
+
+// IsInteractionGlobalAdmin is IsGlobalAdmin for the user of a button click.
+func (srv *ArrServer) IsInteractionGlobalAdmin(i *discordgo.InteractionCreate) bool {
+	var roles []string
+	if i.Member != nil {
+		roles = i.Member.Roles
+	}
+	return srv.isAdmin("", interactionUserID(i), roles)
+}
+
+func (srv *ArrServer) isAdmin(guildID, userID string, memberRoles []string) bool {
+	users, err := srv.ConfigValues(guildID, "discord.admin.users")
+	if err != nil {
+		log.Error().Err(err).Msg("Reading discord.admin.users failed")
+		return false
+	}
+	for _, u := range users {
+		if u == userID {
+			return true
+		}
+	}
+	roles, err := srv.ConfigValues(guildID, "discord.admin.roles")
+	if err != nil {
+		log.Error().Err(err).Msg("Reading discord.admin.roles failed")
+		return false
+	}
+	for _, r := range roles {
+		for _, mr := range memberRoles {
+			if r == mr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MentionID strips the discord mention markup from a user, role or channel
+// mention so both "<@!1234>" and "1234" return "1234".
+func MentionID(v string) string {
+	v = strings.TrimPrefix(v, "<#")
+	v = strings.TrimPrefix(v, "<@")
+	v = strings.TrimPrefix(v, "!")
+	v = strings.TrimPrefix(v, "&")
+	return strings.TrimSuffix(v, ">")
+}
+
 func (srv *ArrServer) HandlePing(s *discordgo.Session, m *discordgo.MessageCreate) {
 	s.ChannelMessageSend(m.ChannelID, "Pong!")
 }
 func (srv *ArrServer) HandlePlexSearch(s *discordgo.Session, m *discordgo.MessageCreate) {
 	ss := strings.TrimPrefix(m.Content, "!plex search ")
 	//fmt.Println("--->" + ss + "<---")
-	//fmt.Println("--->" + srv.PlexConn.URL + "<---")
-	results, err := srv.PlexConn.Search(ss)
+	//fmt.Println("--->" + srv.PlexConn().URL + "<---")
+	results, err := srv.PlexConn().Search(ss)
 	if err != nil {
 		log.Warn().Err(err).Str("search", ss).Err(err).Msg("Problem with user search")
 		return
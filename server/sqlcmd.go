@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const (
+	sqlTimeout = 5 * time.Second
+	sqlMaxRows = 100
+)
+
+// SQLResult is the output of a read only query.  Truncated is set when the
+// query returned more rows than were kept.
+type SQLResult struct {
+	Columns   []string
+	Rows      [][]string
+	Truncated bool
+}
+
+// sqlHiddenColumns are returned as NULL by QueryReadOnly so secrets, even
+// encrypted ones, never end up in discord.
+var sqlHiddenColumns = map[string]bool{
+	"config.value":             true,
+	"config_history.old_value": true,
+	"config_history.new_value": true,
+}
+
+// readOnlyAuthorizer only lets a statement read tables and call functions.
+var readOnlyAuthorizer = sqlite.AuthorizeFunc(func(action sqlite.Action) sqlite.AuthResult {
+	switch action.Type() {
+	case sqlite.OpSelect, sqlite.OpFunction, sqlite.OpRecursive:
+		return sqlite.AuthResultOK
+	case sqlite.OpRead:
+		if sqlHiddenColumns[action.Table()+"."+action.Column()] {
+			return sqlite.AuthResultIgnore
+		}
+		return sqlite.AuthResultOK
+	}
+	return sqlite.AuthResultDeny
+})
+
+// QueryReadOnly runs a single SELECT with the connection in query_only mode,
+// anything but reading is refused when the statement is prepared.  The query
+// is interrupted after timeout and at most maxRows rows are kept.
+func (d *DB) QueryReadOnly(query string, timeout time.Duration, maxRows int) (*SQLResult, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// The authorizer hides config values from the live tables too, they get
+	// their config before it is set.
+	unpin, err := d.pinStarrTables(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	defer unpin()
+
+	if err = sqlitex.ExecuteTransient(conn, "PRAGMA query_only = ON;", nil); err != nil {
+		return nil, err
+	}
+	defer sqlitex.ExecuteTransient(conn, "PRAGMA query_only = OFF;", nil)
+	if err = conn.SetAuthorizer(readOnlyAuthorizer); err != nil {
+		return nil, err
+	}
+	defer conn.SetAuthorizer(nil)
+
+	conn.SetInterrupt(ctx.Done())
+	defer conn.SetInterrupt(nil)
+
+	s, trailing, err := conn.PrepareTransient(query)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, fmt.Errorf("empty query")
+	}
+	defer s.Finalize()
+	if rest := strings.Trim(query[len(query)-trailing:], " \t\r\n;"); rest != "" {
+		return nil, fmt.Errorf("only a single statement can be run")
+	}
+
+	result := &SQLResult{}
+	for i := 0; i < s.ColumnCount(); i++ {
+		result.Columns = append(result.Columns, s.ColumnName(i))
+	}
+	for {
+		found, err := s.Step()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("query took longer than %s", timeout)
+			}
+			return nil, err
+		}
+		if !found {
+			break
+		}
+		if len(result.Rows) == maxRows {
+			result.Truncated = true
+			break
+		}
+		row := make([]string, len(result.Columns))
+		for i := range row {
+			row[i] = s.ColumnText(i)
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	return result, nil
+}
+
+// Table renders the result as a fixed width table.
+func (r *SQLResult) Table() string {
+	widths := make([]int, len(r.Columns))
+	for i, c := range r.Columns {
+		widths[i] = len(c)
+	}
+	for _, row := range r.Rows {
+		for i, v := range row {
+			if len(v) > widths[i] {
+				widths[i] = len(v)
+			}
+		}
+	}
+	var b bytes.Buffer
+	line := func(values []string) {
+		padded := make([]string, len(values))
+		for i, v := range values {
+			padded[i] = v + strings.Repeat(" ", widths[i]-len(v))
+		}
+		b.WriteString(strings.TrimRight(strings.Join(padded, " | "), " ") + "\n")
+	}
+	line(r.Columns)
+	sep := make([]string, len(widths))
+	for i, w := range widths {
+		sep[i] = strings.Repeat("-", w)
+	}
+	line(sep)
+	for _, row := range r.Rows {
+		line(row)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// CSV renders the result with a header row.
+func (r *SQLResult) CSV() ([]byte, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write(r.Columns)
+	w.WriteAll(r.Rows)
+	return b.Bytes(), w.Error()
+}
+
+// Summary describes the number of rows returned.
+func (r *SQLResult) Summary() string {
+	if r.Truncated {
+		return fmt.Sprintf("first %d rows", len(r.Rows))
+	}
+	return fmt.Sprintf("%d rows", len(r.Rows))
+}
+
+// HandleSQL runs a read only query for admins.  Results that fit in a message
+// are shown as a table, bigger ones are attached as CSV.
+func (srv *ArrServer) HandleSQL(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if !srv.IsAdmin(m) {
+		s.ChannelMessageSend(m.ChannelID, "Only admins can run sql")
+		return
+	}
+	query := strings.TrimSpace(strings.TrimPrefix(m.Content, "!sql "))
+	query = strings.TrimSuffix(strings.TrimPrefix(query, "```sql"), "```")
+	query = strings.Trim(query, "`")
+
+	result, err := srv.DB.QueryReadOnly(query, sqlTimeout, sqlMaxRows)
+	if err != nil {
+		log.Warn().Err(err).Str("user", m.Author.ID).Str("query", query).Msg("Problem with sql command")
+		s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+		return
+	}
+
+	msg := "```\n" + result.Table() + "\n```" + result.Summary()
+	if len(msg) <= discordMessageLimit {
+		s.ChannelMessageSend(m.ChannelID, msg)
+		return
+	}
+	b, err := result.CSV()
+	if err != nil {
+		log.Error().Err(err).Msg("Writing sql result csv failed")
+		return
+	}
+	s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+		Content: result.Summary() + ", too big for a message",
+		Files:   []*discordgo.File{{Name: "result.csv", ContentType: "text/csv", Reader: bytes.NewReader(b)}},
+	})
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golift.io/starr/radarr"
+)
+
+func TestDB_QueryReadOnly(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.ConfigSet("plex.url", "http://plex:32400"))
+	assert.NoError(t, db.ConfigSet("plex.token", "secret-token"))
+
+	result, err := db.QueryReadOnly("SELECT key, value FROM config ORDER BY key;", time.Second, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"key", "value"}, result.Columns)
+	assert.Equal(t, [][]string{{"plex.token", ""}, {"plex.url", ""}}, result.Rows, "config values are hidden")
+
+	result, err = db.QueryReadOnly("WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM n WHERE i < 20) SELECT i FROM n", time.Second, 5)
+	assert.NoError(t, err)
+	assert.Len(t, result.Rows, 5)
+	assert.True(t, result.Truncated)
+	assert.Equal(t, "first 5 rows", result.Summary())
+
+	for _, query := range []string{
+		"DELETE FROM config",
+		"UPDATE config SET value = 'x'",
+		"INSERT INTO quotas VALUES ('user', '1', 'movie', 1, 1)",
+		"DROP TABLE config",
+		"PRAGMA query_only = OFF",
+		"ATTACH DATABASE '/tmp/other.sqlite' AS other",
+	} {
+		_, err = db.QueryReadOnly(query, time.Second, 10)
+		assert.Error(t, err, query)
+	}
+	_, err = db.QueryReadOnly("SELECT 1; DELETE FROM config", time.Second, 10)
+	assert.ErrorContains(t, err, "single statement")
+	_, err = db.QueryReadOnly("  ", time.Second, 10)
+	assert.Error(t, err)
+
+	_, err = db.QueryReadOnly("WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM n) SELECT count(*) FROM n", 50*time.Millisecond, 10)
+	assert.ErrorContains(t, err, "longer than")
+
+	found, v, err := db.ConfigGet("plex.url")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "http://plex:32400", v, "nothing was changed")
+	assert.NoError(t, db.ConfigSet("plex.url", "http://other:32400"), "connections are writable again afterwards")
+}
+
+func TestSQLResult_Table(t *testing.T) {
+	r := &SQLResult{Columns: []string{"id", "title"}, Rows: [][]string{{"1", "Alien"}, {"22", "Up"}}}
+	assert.Equal(t, "id | title\n-- | -----\n1  | Alien\n22 | Up", r.Table())
+	b, err := r.CSV()
+	assert.NoError(t, err)
+	assert.Equal(t, "id,title\n1,Alien\n22,Up\n", string(b))
+	assert.Equal(t, "2 rows", r.Summary())
+}
+
+func TestDB_QueryReadOnly_StarrTables(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]*radarr.Movie{{ID: 1, Title: "Alien", Year: 1979}, {ID: 2, Title: "Up", Year: 2009}})
+	}))
+	defer srv.Close()
+
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.QueryReadOnly("SELECT title FROM radarr_movies", time.Second, 10)
+	assert.ErrorContains(t, err, "starr.radarr.url")
+
+	assert.NoError(t, db.ConfigSet("starr.radarr.url", srv.URL))
+	assert.NoError(t, db.ConfigSet("starr.radarr.token", "token"))
+	result, err := db.QueryReadOnly("SELECT title FROM radarr_movies WHERE year > 2000", time.Second, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"Up"}}, result.Rows)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	assert.NoError(t, db.ConfigSet("starr.radarr.url", slow.URL))
+	start := time.Now()
+	_, err = db.QueryReadOnly("SELECT title FROM radarr_movies", 100*time.Millisecond, 10)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second, "the api call stops with the query timeout")
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"zombiezen.com/go/sqlite"
+)
+
+// sqlFunctions are registered on every connection by ConnPrepareFunc, they
+// are meant for ad-hoc reporting in config shell and !sql.
+var sqlFunctions = map[string]*sqlite.FunctionImpl{
+	"json_image": {
+		NArgs:         2,
+		Deterministic: true,
+		AllowIndirect: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			return textOrNull(JSONImage(args[0].Text(), args[1].Text())), nil
+		},
+	},
+	"tvdb_url": {
+		NArgs:         1,
+		Deterministic: true,
+		AllowIndirect: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Int64() == 0 {
+				return sqlite.Value{}, nil
+			}
+			return sqlite.TextValue(fmt.Sprintf("https://thetvdb.com/?tab=series&id=%d", args[0].Int64())), nil
+		},
+	},
+	"imdb_url": {
+		NArgs:         1,
+		Deterministic: true,
+		AllowIndirect: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Text() == "" {
+				return sqlite.Value{}, nil
+			}
+			return sqlite.TextValue("https://www.imdb.com/title/" + args[0].Text() + "/"), nil
+		},
+	},
+	"human_size": {
+		NArgs:         1,
+		Deterministic: true,
+		AllowIndirect: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			return sqlite.TextValue(HumanSize(args[0].Int64())), nil
+		},
+	},
+	"normalize_title": {
+		NArgs:         1,
+		Deterministic: true,
+		AllowIndirect: true,
+		Scalar: func(ctx sqlite.Context, args []sqlite.Value) (sqlite.Value, error) {
+			if args[0].Type() == sqlite.TypeNull {
+				return sqlite.Value{}, nil
+			}
+			return sqlite.TextValue(NormalizeTitle(args[0].Text())), nil
+		},
+	},
+}
+
+// RegisterFunctions adds sqlFunctions to conn.
+func RegisterFunctions(conn *sqlite.Conn) error {
+	for name, impl := range sqlFunctions {
+		if err := conn.CreateFunction(name, impl); err != nil {
+			return fmt.Errorf("registering sql function %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func textOrNull(s string) sqlite.Value {
+	if s == "" {
+		return sqlite.Value{}
+	}
+	return sqlite.TextValue(s)
+}
+
+// JSONImage returns the url of the image with coverType kind from the images
+// of a RAW column, the remote url is preferred.  Empty when there is none.
+func JSONImage(raw, kind string) string {
+	doc := struct {
+		Images []struct {
+			CoverType string `json:"coverType"`
+			URL       string `json:"url"`
+			RemoteURL string `json:"remoteUrl"`
+		} `json:"images"`
+	}{}
+	if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+		return ""
+	}
+	for _, i := range doc.Images {
+		if !strings.EqualFold(i.CoverType, kind) {
+			continue
+		}
+		if i.RemoteURL != "" {
+			return i.RemoteURL
+		}
+		return i.URL
+	}
+	return ""
+}
+
+// HumanSize formats a number of bytes with binary units, like 1.5 GiB.
+func HumanSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit && bytes > -unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	n := float64(bytes)
+	i := -1
+	for ; (n >= unit || n <= -unit) && i < 5; i++ {
+		n /= unit
+	}
+	return fmt.Sprintf("%.1f %ciB", n, "KMGTPE"[i])
+}
+
+// NormalizeTitle makes titles comparable: lower case, & spelled as and,
+// punctuation dropped, spaces collapsed and a leading "the" removed.
+func NormalizeTitle(t string) string {
+	t = strings.ReplaceAll(strings.ToLower(t), "&", " and ")
+	t = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r):
+			return r
+		case unicode.IsSpace(r), r == '-', r == '_', r == '.', r == ':', r == '/':
+			return ' '
+		}
+		return -1
+	}, t)
+	words := strings.Fields(t)
+	if len(words) > 1 && words[0] == "the" {
+		words = words[1:]
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHumanSize(t *testing.T) {
+	assert.Equal(t, "0 B", HumanSize(0))
+	assert.Equal(t, "1023 B", HumanSize(1023))
+	assert.Equal(t, "1.0 KiB", HumanSize(1024))
+	assert.Equal(t, "1.5 GiB", HumanSize(1610612736))
+	assert.Equal(t, "2.0 TiB", HumanSize(2<<40))
+}
+
+func TestNormalizeTitle(t *testing.T) {
+	assert.Equal(t, "office us", NormalizeTitle("The Office (US)"))
+	assert.Equal(t, "law and order svu", NormalizeTitle("Law & Order: SVU"))
+	assert.Equal(t, "spider man no way home", NormalizeTitle("Spider-Man: No Way Home"))
+	assert.Equal(t, "the", NormalizeTitle("The"))
+	assert.Equal(t, "amélie", NormalizeTitle("Amélie!"))
+}
+
+func TestJSONImage(t *testing.T) {
+	raw := `{"title":"Up","images":[{"coverType":"banner","url":"/b.jpg"},{"coverType":"poster","url":"/p.jpg","remoteUrl":"https://image.tmdb.org/p.jpg"}]}`
+	assert.Equal(t, "https://image.tmdb.org/p.jpg", JSONImage(raw, "poster"))
+	assert.Equal(t, "/b.jpg", JSONImage(raw, "banner"))
+	assert.Equal(t, "", JSONImage(raw, "fanart"))
+	assert.Equal(t, "", JSONImage("not json", "poster"))
+}
+
+func TestDB_SQLFunctions(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	result, err := db.QueryReadOnly(`SELECT json_image('{"images":[{"coverType":"poster","url":"/p.jpg"}]}', 'poster'),
+		tvdb_url(81189), imdb_url('tt0903747'), human_size(1048576), normalize_title('The Wire'),
+		tvdb_url(NULL), human_size(NULL)`, time.Second, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{
+		"/p.jpg", "https://thetvdb.com/?tab=series&id=81189", "https://www.imdb.com/title/tt0903747/",
+		"1.0 MiB", "wire", "", "",
+	}}, result.Rows)
+}
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -10,6 +9,7 @@ import (
 	"golift.io/starr"
 	"golift.io/starr/radarr"
 	"golift.io/starr/sonarr"
+	"jeremyrossi.com/go/arrmate/server/vtables"
 	"strconv"
 	"strings"
 	"zombiezen.com/go/sqlite"
@@ -17,14 +17,21 @@ import (
 )
 
 func (srv *ArrServer) SetupStarr() error {
-	/*
-		job_sonarr, err := srv.Cron.Every("5m").StartImmediately().Do(func() {
-			srv.BuildSonarr()
-		})
-		job_sonarr.Tag("sonarr", "starr")
-	*/
-
-	job_radarr, err := srv.Cron.Every("5m").StartImmediately().Do(func() {
+	interval, err := srv.DB.ConfigDuration("starr.sync_interval")
+	if err != nil {
+		return err
+	}
+	job_sonarr, err := srv.Cron.Every(interval).StartImmediately().Do(func() {
+		if err := srv.BuildSonarr(); err != nil {
+			log.Warn().Err(err).Msg("Syncing sonarr failed")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	job_sonarr.Tag("sonarr", "starr")
+
+	job_radarr, err := srv.Cron.Every(interval).StartImmediately().Do(func() {
 		srv.BuildRadarr()
 	})
 	job_radarr.Tag("radarr", "starr")
@@ -39,45 +46,216 @@ func FormatBool(b bool) int {
 	return 0
 }
 
-func (srv *ArrServer) BuildSonarr() error {
-	found, url, err := srv.DB.ConfigGet("starr.sonarr.url")
-	if !found {
-		return fmt.Errorf("No config for plex.url")
-	} else if err != nil {
-		return err
+// StarrConfig builds a starr client config from the starr.<app>.url and
+// starr.<app>.token config keys of a guild.  The cache sync uses an empty
+// guildID so it always follows the global instance.
+func (srv *ArrServer) StarrConfig(guildID, app string) (*starr.Config, error) {
+	return srv.DB.StarrConfig(guildID, app)
+}
+
+// StarrConfig reads the url and token of an instance from the same scope, a
+// guild that overrides the url needs its own token so the global token is
+// never sent to a guild's instance.
+func (d *DB) StarrConfig(guildID, app string) (*starr.Config, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
 	}
-	found, token, err := srv.DB.ConfigGet("starr.sonarr.token")
-	if !found {
-		return fmt.Errorf("No config for plex.token")
-	} else if err != nil {
-		return err
+	defer d.Pool.Put(conn)
+	return d.starrConfig(conn, guildID, app)
+}
+
+func (d *DB) starrConfig(conn *sqlite.Conn, guildID, app string) (*starr.Config, error) {
+	urlKey, tokenKey := "starr."+app+".url", "starr."+app+".token"
+	scope := "global"
+	if guildID != "" {
+		found, _, _, err := d.configLookup(nil, conn, GuildKey(guildID, urlKey))
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			urlKey, tokenKey = GuildKey(guildID, urlKey), GuildKey(guildID, tokenKey)
+			scope = "guild " + guildID
+		}
+	}
+	found, url, _, err := d.configLookup(nil, conn, urlKey)
+	if err != nil {
+		return nil, err
+	} else if !found {
+		return nil, fmt.Errorf("No config for %s", urlKey)
 	}
-	scfg := starr.New(token, url, 1000000000)
+	found, token, _, err := d.configLookup(nil, conn, tokenKey)
+	if err != nil {
+		return nil, err
+	} else if !found {
+		return nil, fmt.Errorf("No config for %s, the %s url needs a token of the same scope", tokenKey, scope)
+	}
+	scfg := starr.New(token, url, starr.DefaultTimeout)
 	scfg.Debugf = log.Debug().Msgf
+	return scfg, nil
+}
+
+// liveTables is the state of the live virtual tables of one connection.
+// Scans read the starr config on that connection, a query holding it can
+// not wait on the pool, unless it was pinned beforehand.
+type liveTables struct {
+	d      *DB
+	conn   *sqlite.Conn
+	ctx    context.Context
+	pinned map[string]*starr.Config
+}
+
+func (lt *liveTables) context() context.Context {
+	if lt.ctx != nil {
+		return lt.ctx
+	}
+	return context.Background()
+}
+
+func (lt *liveTables) config(app string) (*starr.Config, error) {
+	if lt.pinned != nil {
+		if scfg, ok := lt.pinned[app]; ok {
+			return scfg, nil
+		}
+		return nil, fmt.Errorf("No config for starr.%s.url", app)
+	}
+	return lt.d.starrConfig(lt.conn, "", app)
+}
 
-	s := sonarr.New(scfg)
+// StarrTables registers the sonarr_series, live_sonarr_episodes and
+// radarr_movies virtual tables over the global instances on conn.
+func (d *DB) StarrTables(conn *sqlite.Conn) error {
+	lt := &liveTables{d: d, conn: conn}
+	d.live.Store(conn, lt)
+	tables := vtables.Tables(
+		func() (*sonarr.Sonarr, error) {
+			scfg, err := lt.config("sonarr")
+			if err != nil {
+				return nil, err
+			}
+			return sonarr.New(scfg), nil
+		},
+		func() (*radarr.Radarr, error) {
+			scfg, err := lt.config("radarr")
+			if err != nil {
+				return nil, err
+			}
+			return radarr.New(scfg), nil
+		},
+	)
+	return vtables.Register(conn, tables, lt.context)
+}
+
+// pinStarrTables resolves the starr config of the live tables on conn now
+// and runs their scans with ctx until the returned func is called, for
+// queries that can not read the config table themselves.
+func (d *DB) pinStarrTables(ctx context.Context, conn *sqlite.Conn) (func(), error) {
+	v, ok := d.live.Load(conn)
+	if !ok {
+		return func() {}, nil
+	}
+	lt := v.(*liveTables)
+	pinned := map[string]*starr.Config{}
+	for _, app := range []string{"sonarr", "radarr"} {
+		found, _, _, err := d.configLookup(nil, conn, "starr."+app+".url")
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		if pinned[app], err = d.starrConfig(conn, "", app); err != nil {
+			return nil, err
+		}
+	}
+	lt.ctx, lt.pinned = ctx, pinned
+	return func() { lt.ctx, lt.pinned = nil, nil }, nil
+}
+
+func (srv *ArrServer) NewSonarr(guildID string) (*sonarr.Sonarr, error) {
+	scfg, err := srv.StarrConfig(guildID, "sonarr")
+	if err != nil {
+		return nil, err
+	}
+	return sonarr.New(scfg), nil
+}
+
+func (srv *ArrServer) NewRadarr(guildID string) (*radarr.Radarr, error) {
+	scfg, err := srv.StarrConfig(guildID, "radarr")
+	if err != nil {
+		return nil, err
+	}
+	return radarr.New(scfg), nil
+}
+
+// StarrClient returns the sonarr or radarr client of app, a bare
+// starr.Config lacks the api/ prefix they add to the url.
+func (srv *ArrServer) StarrClient(guildID, app string) (starr.APIer, error) {
+	switch app {
+	case "sonarr":
+		return srv.NewSonarr(guildID)
+	case "radarr":
+		return srv.NewRadarr(guildID)
+	}
+	return nil, fmt.Errorf("unknown starr app %q", app)
+}
+
+func (srv *ArrServer) BuildSonarr() error {
+	s, err := srv.NewSonarr("")
+	if err != nil {
+		return err
+	}
 
 	results, err := s.GetAllSeries()
 	if err != nil {
 		return err
 	}
 
-	conn, err := srv.DB.Pool.Get(context.TODO())
+	if err := srv.DB.CacheSonarr(results); err != nil {
+		return err
+	}
+	if err := srv.DB.RebuildPlexMap(); err != nil {
+		return err
+	}
+	return srv.SyncSonarrEpisodes(s, results)
+}
+
+// CacheSonarr replaces the sonarr table with series.
+func (d *DB) CacheSonarr(results []*sonarr.Series) error {
+	return d.cacheSonarr("DELETE from sonarr;", nil, results)
+}
+
+// UpdateCachedSeries replaces the cached row of a single series.
+func (d *DB) UpdateCachedSeries(s *sonarr.Series) error {
+	return d.cacheSonarr("DELETE FROM sonarr WHERE id = ?;", []interface{}{s.ID}, []*sonarr.Series{s})
+}
+
+// cacheSonarr runs the delete query and inserts results.
+func (d *DB) cacheSonarr(del string, args []interface{}, results []*sonarr.Series) error {
+	conn, err := d.Pool.Get(context.TODO())
 	if err != nil {
 		return err
 	}
+	defer d.Pool.Put(conn)
 
 	doUpdate := func() (err error) {
 		defer sqlitex.Save(conn)(&err)
 
-		err = sqlitex.Execute(conn, "DELETE from sonarr;", nil)
+		err = sqlitex.Execute(conn, del, &sqlitex.ExecOptions{Args: args})
 		if err != nil {
 			return fmt.Errorf("database: %w", err)
 		}
-		q := `INSERT INTO sonarr (id, title, status, overview, previous_airing, network, added, genres, seasons, monitored, RAW) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+		q := `INSERT INTO sonarr (id, title, status, overview, previous_airing, network, added, genres, seasons, monitored,
+			year, tvdb_id, imdb_id, path, size_on_disk, quality_profile_id, tags, rating, rating_votes, certification, RAW)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
 		for i, s := range results {
 			log.Debug().Int("range item", i).Msg("populating database item")
 			raw, _ := json.Marshal(s)
+			var size int64
+			if s.Statistics != nil {
+				size = s.Statistics.SizeOnDisk
+			}
+			rating, votes := ratingArgs(s.Ratings)
 			err = sqlitex.Execute(conn, q, &sqlitex.ExecOptions{
 				Args: []interface{}{
 					s.ID,
@@ -90,6 +268,16 @@ func (srv *ArrServer) BuildSonarr() error {
 					strings.Join(s.Genres, ","),
 					len(s.Seasons),
 					FormatBool(s.Monitored),
+					s.Year,
+					s.TvdbID,
+					s.ImdbID,
+					s.Path,
+					size,
+					s.QualityProfileID,
+					FormatTags(s.Tags),
+					rating,
+					votes,
+					s.Certification,
 					raw,
 				},
 			})
@@ -104,46 +292,54 @@ func (srv *ArrServer) BuildSonarr() error {
 }
 
 func (srv *ArrServer) BuildRadarr() error {
-
-	found, url, err := srv.DB.ConfigGet("starr.radarr.url")
-	if !found {
-		return fmt.Errorf("No config for plex.url")
-	} else if err != nil {
-		return err
-	}
-	found, token, err := srv.DB.ConfigGet("starr.radarr.token")
-	if !found {
-		return fmt.Errorf("No config for starr.radarr.token")
-	} else if err != nil {
+	s, err := srv.NewRadarr("")
+	if err != nil {
 		return err
 	}
-
-	scfg := starr.New(token, url, 100000000)
-	scfg.Debugf = log.Debug().Msgf
-
-	s := radarr.New(scfg)
 	//return s.Lookup(ss)
 	results, err := s.GetMovie(0)
 	if err != nil {
 		return err
 	}
 
-	conn, err := srv.DB.Pool.Get(context.TODO())
+	if err := srv.DB.CacheRadarr(results); err != nil {
+		return err
+	}
+	return srv.DB.RebuildPlexMap()
+}
+
+// CacheRadarr replaces the radarr table with movies.
+func (d *DB) CacheRadarr(results []*radarr.Movie) error {
+	return d.cacheRadarr("DELETE from radarr;", nil, results)
+}
+
+// UpdateCachedMovie replaces the cached row of a single movie.
+func (d *DB) UpdateCachedMovie(s *radarr.Movie) error {
+	return d.cacheRadarr("DELETE FROM radarr WHERE id = ?;", []interface{}{s.ID}, []*radarr.Movie{s})
+}
+
+// cacheRadarr runs the delete query and inserts results.
+func (d *DB) cacheRadarr(del string, args []interface{}, results []*radarr.Movie) error {
+	conn, err := d.Pool.Get(context.TODO())
 	if err != nil {
 		return err
 	}
+	defer d.Pool.Put(conn)
 
 	doUpdate := func() (err error) {
 		defer sqlitex.Save(conn)(&err)
 
-		err = sqlitex.Execute(conn, "DELETE from radarr;", nil)
+		err = sqlitex.Execute(conn, del, &sqlitex.ExecOptions{Args: args})
 		if err != nil {
 			return fmt.Errorf("database: %w", err)
 		}
-		q := `INSERT INTO radarr (id, title, status, overview, added, genres, is_available, monitored, RAW) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+		q := `INSERT INTO radarr (id, title, status, overview, added, genres, is_available, monitored,
+			year, tmdb_id, imdb_id, path, size_on_disk, quality_profile_id, tags, rating, rating_votes, certification, RAW)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
 		for i, s := range results {
 			log.Debug().Int("range item", i).Msg("populating database item")
 			raw, _ := json.Marshal(s)
+			rating, votes := ratingArgs(s.Ratings)
 			err = sqlitex.Execute(conn, q, &sqlitex.ExecOptions{
 				Args: []interface{}{
 					s.ID,
@@ -154,6 +350,16 @@ func (srv *ArrServer) BuildRadarr() error {
 					strings.Join(s.Genres, ","),
 					FormatBool(s.IsAvailable),
 					FormatBool(s.Monitored),
+					s.Year,
+					s.TmdbID,
+					s.ImdbID,
+					s.Path,
+					s.SizeOnDisk,
+					s.QualityProfileID,
+					FormatTags(s.Tags),
+					rating,
+					votes,
+					s.Certification,
 					raw,
 				},
 			})
@@ -167,116 +373,265 @@ func (srv *ArrServer) BuildRadarr() error {
 	return doUpdate()
 }
 
+// FormatTags stores tag ids comma separated like genres.
+func FormatTags(tags []int) string {
+	ids := make([]string, len(tags))
+	for i, t := range tags {
+		ids[i] = strconv.Itoa(t)
+	}
+	return strings.Join(ids, ",")
+}
+
+// ratingArgs are the rating and rating_votes columns, NULL without ratings.
+func ratingArgs(r *starr.Ratings) (interface{}, interface{}) {
+	if r == nil {
+		return nil, nil
+	}
+	return r.Value, r.Votes
+}
+
+// HandleRadarrSearch searches the radarr cache, see RadarrSearch.
 func (srv *ArrServer) HandleRadarrSearch(s *discordgo.Session, m *discordgo.MessageCreate) {
-	ss := strings.TrimPrefix(m.Content, "!radarr search ")
-	if !strings.HasPrefix(ss, "%") {
-		ss = fmt.Sprintf("%%%s", ss)
+	srv.HandleSearch(s, m, RadarrSearch)
+}
+
+// HandleSonarrSearch searches the sonarr cache, see SonarrSearch.
+func (srv *ArrServer) HandleSonarrSearch(s *discordgo.Session, m *discordgo.MessageCreate) {
+	srv.HandleSearch(s, m, SonarrSearch)
+}
+
+// radarrDefaults returns the root folder and quality profile new movies are
+// added with in a guild, starr.radarr.root_folder and
+// starr.radarr.quality_profile win over the first ones radarr reports.
+func (srv *ArrServer) radarrDefaults(guildID string, r *radarr.Radarr) (string, int64, error) {
+	found, root, err := srv.DB.ConfigGetGuild(guildID, "starr.radarr.root_folder")
+	if err != nil {
+		return "", 0, err
 	}
-	if !strings.HasSuffix(ss, "%") {
-		ss = fmt.Sprintf("%s%%", ss)
+	if !found {
+		folders, err := r.GetRootFolders()
+		if err != nil {
+			return "", 0, err
+		}
+		if len(folders) == 0 {
+			return "", 0, fmt.Errorf("radarr has no root folders")
+		}
+		root = folders[0].Path
+	}
+	found, v, err := srv.DB.ConfigGetGuild(guildID, "starr.radarr.quality_profile")
+	if err != nil {
+		return "", 0, err
 	}
-	log.Debug().Str("radarr", "search").Str("query", ss).Msg("Radarr Query log")
+	if found {
+		profile, err := strconv.ParseInt(v, 10, 64)
+		return root, profile, err
+	}
+	profiles, err := r.GetQualityProfiles()
+	if err != nil {
+		return "", 0, err
+	}
+	if len(profiles) == 0 {
+		return "", 0, fmt.Errorf("radarr has no quality profiles")
+	}
+	return root, profiles[0].ID, nil
+}
 
-	conn, err := srv.DB.Pool.Get(context.TODO())
+// sonarrDefaults is radarrDefaults for sonarr, it also resolves the language
+// profile from starr.sonarr.language_profile.
+func (srv *ArrServer) sonarrDefaults(guildID string, sc *sonarr.Sonarr) (string, int64, int64, error) {
+	found, root, err := srv.DB.ConfigGetGuild(guildID, "starr.sonarr.root_folder")
 	if err != nil {
-		log.Error().Err(err).Msg("Database could connected had a issue")
-		return
+		return "", 0, 0, err
+	}
+	if !found {
+		folders, err := sc.GetRootFolders()
+		if err != nil {
+			return "", 0, 0, err
+		}
+		if len(folders) == 0 {
+			return "", 0, 0, fmt.Errorf("sonarr has no root folders")
+		}
+		root = folders[0].Path
 	}
 
-	/*
-		q := "SELECT id, title, status,  added, is_available, monitored FROM radarr WHERE title LIKE ?"
-		outPutter := func(data string) error {
-			_, err := s.ChannelMessageSend(m.ChannelID, data)
-			if err != nil {
-				log.Error().Err(err).Msg("Sending message failed")
-				return err
-			}
-			return nil
+	var profile, language int64
+	found, v, err := srv.DB.ConfigGetGuild(guildID, "starr.sonarr.quality_profile")
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if found {
+		if profile, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return "", 0, 0, err
+		}
+	} else {
+		profiles, err := sc.GetQualityProfiles()
+		if err != nil {
+			return "", 0, 0, err
 		}
-	*/
+		if len(profiles) == 0 {
+			return "", 0, 0, fmt.Errorf("sonarr has no quality profiles")
+		}
+		profile = profiles[0].ID
+	}
 
-	var b bytes.Buffer
-	err = sqlitex.Execute(conn, "SELECT id, title, status,  added, is_available, monitored FROM radarr WHERE title LIKE ?", &sqlitex.ExecOptions{
-		Args: []interface{}{ss},
-		ResultFunc: func(stmt *sqlite.Stmt) error {
-			log.Debug().Int64("id", stmt.ColumnInt64(0)).Msg("ResultsFunc logging - entry found")
-			b.WriteString("id=")
-			b.WriteString(strconv.FormatInt(stmt.ColumnInt64(0), 10))
-			b.WriteString(" title=")
-			b.WriteString(stmt.ColumnText(1))
-			b.WriteString(" status=")
-			b.WriteString(stmt.ColumnText(2))
-			b.WriteString(" added=")
-			b.WriteString(stmt.ColumnText(3))
-			b.WriteString(" available=")
-			b.WriteString(stmt.ColumnText(4))
-			b.WriteString("\n")
-			if b.Len() >= 1500 {
-				_, err := s.ChannelMessageSend(m.ChannelID, b.String())
-				if err != nil {
-					log.Error().Err(err).Msg("Sending message failed")
-				}
-				b.Reset()
-			}
-			return nil
+	found, v, err = srv.DB.ConfigGetGuild(guildID, "starr.sonarr.language_profile")
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if found {
+		if language, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return "", 0, 0, err
+		}
+	} else {
+		languages, err := sc.GetLanguageProfiles()
+		if err != nil {
+			return "", 0, 0, err
+		}
+		if len(languages) == 0 {
+			return "", 0, 0, fmt.Errorf("sonarr has no language profiles")
+		}
+		language = languages[0].ID
+	}
+	return root, profile, language, nil
+}
 
-		},
+// HandleRadarrAdd adds a movie by tmdb id or title, counting it against the
+// author's movie quota.
+func (srv *ArrServer) HandleRadarrAdd(s *discordgo.Session, m *discordgo.MessageCreate) {
+	term := strings.TrimSpace(strings.TrimPrefix(m.Content, "!radarr add "))
+	override, ok := srv.RequestAllowed(s, m, QuotaKindMovie)
+	if !ok {
+		return
+	}
+
+	r, err := srv.NewRadarr(m.GuildID)
+	if err != nil {
+		log.Error().Err(err).Msg("Radarr client setup failed")
+		s.ChannelMessageSend(m.ChannelID, "Radarr is not configured")
+		return
+	}
+	if _, err := strconv.ParseInt(term, 10, 64); err == nil {
+		term = "tmdb:" + term
+	}
+	movies, err := r.Lookup(term)
+	if err != nil {
+		log.Warn().Err(err).Str("search", term).Msg("Problem with radarr lookup")
+		s.ChannelMessageSend(m.ChannelID, "Radarr lookup failed for: "+term)
+		return
+	}
+	if len(movies) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "Could not find results with Search: "+term)
+		return
+	}
+	movie := movies[0]
+	if movie.ID != 0 {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s (%d) is already in radarr", movie.Title, movie.Year))
+		return
+	}
+
+	root, profile, err := srv.radarrDefaults(m.GuildID, r)
+	if err != nil {
+		log.Error().Err(err).Msg("Radarr defaults lookup failed")
+		s.ChannelMessageSend(m.ChannelID, "Could not add "+movie.Title+": "+err.Error())
+		return
+	}
+	req, ok := srv.ReserveRequest(s, m, QuotaKindMovie, movie.Title, movie.TmdbID, override)
+	if !ok {
+		return
+	}
+	_, err = r.AddMovie(&radarr.AddMovieInput{
+		Title:               movie.Title,
+		TitleSlug:           movie.TitleSlug,
+		TmdbID:              movie.TmdbID,
+		Year:                movie.Year,
+		Images:              movie.Images,
+		RootFolderPath:      root,
+		QualityProfileID:    profile,
+		MinimumAvailability: "released",
+		Monitored:           true,
+		AddOptions:          &radarr.AddMovieOptions{SearchForMovie: true},
 	})
-	_, err = s.ChannelMessageSend(m.ChannelID, b.String())
 	if err != nil {
-		log.Error().Err(err).Msg("Sending message failed")
+		log.Error().Err(err).Int64("tmdb", movie.TmdbID).Msg("Radarr add failed")
+		srv.ReleaseRequest(req)
+		s.ChannelMessageSend(m.ChannelID, "Could not add "+movie.Title+": "+err.Error())
+		return
 	}
 
+	msg := fmt.Sprintf("Added %s (%d) to radarr", movie.Title, movie.Year)
+	if q := srv.RequestQuotaLine(m, req); q != "" {
+		msg += "\n" + q
+	}
+	s.ChannelMessageSend(m.ChannelID, msg)
 }
 
-func (srv *ArrServer) HandleSonarrSearch(s *discordgo.Session, m *discordgo.MessageCreate) {
-	ss := strings.TrimPrefix(m.Content, "!sonarr search ")
-	if !strings.HasPrefix(ss, "%") {
-		ss = fmt.Sprintf("%%%s", ss)
-	}
-	if !strings.HasSuffix(ss, "%") {
-		ss = fmt.Sprintf("%s%%", ss)
+// HandleSonarrAdd adds a series by tvdb id or title, counting it against the
+// author's series quota.
+func (srv *ArrServer) HandleSonarrAdd(s *discordgo.Session, m *discordgo.MessageCreate) {
+	term := strings.TrimSpace(strings.TrimPrefix(m.Content, "!sonarr add "))
+	override, ok := srv.RequestAllowed(s, m, QuotaKindSeries)
+	if !ok {
+		return
 	}
-	log.Debug().Str("sonarr", "search").Str("query", ss).Msg("Sonarr Query log")
 
-	conn, err := srv.DB.Pool.Get(context.TODO())
+	sc, err := srv.NewSonarr(m.GuildID)
 	if err != nil {
-		log.Error().Err(err).Msg("Database could connected had a issue")
+		log.Error().Err(err).Msg("Sonarr client setup failed")
+		s.ChannelMessageSend(m.ChannelID, "Sonarr is not configured")
+		return
+	}
+	if _, err := strconv.ParseInt(term, 10, 64); err == nil {
+		term = "tvdb:" + term
+	}
+	series, err := sc.Lookup(term)
+	if err != nil {
+		log.Warn().Err(err).Str("search", term).Msg("Problem with sonarr lookup")
+		s.ChannelMessageSend(m.ChannelID, "Sonarr lookup failed for: "+term)
+		return
+	}
+	if len(series) == 0 {
+		s.ChannelMessageSend(m.ChannelID, "Could not find results with Search: "+term)
+		return
+	}
+	show := series[0]
+	if show.ID != 0 {
+		s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s (%d) is already in sonarr", show.Title, show.Year))
 		return
 	}
 
-	var b bytes.Buffer
-	err = sqlitex.Execute(conn, "SELECT id, title, status, previous_airing, added, seasons, monitored FROM sonarr WHERE title LIKE ?", &sqlitex.ExecOptions{
-		Args: []interface{}{ss},
-		ResultFunc: func(stmt *sqlite.Stmt) error {
-			log.Debug().Int64("id", stmt.ColumnInt64(0)).Msg("ResultsFunc logging - entry found")
-			b.WriteString("id=")
-			b.WriteString(strconv.FormatInt(stmt.ColumnInt64(0), 10))
-			b.WriteString(" title=")
-			b.WriteString(stmt.ColumnText(1))
-			b.WriteString(" status=")
-			b.WriteString(stmt.ColumnText(2))
-			b.WriteString(" list=")
-			b.WriteString(stmt.ColumnText(3))
-			b.WriteString(" added=")
-			b.WriteString(stmt.ColumnText(4))
-			b.WriteString("\n")
-			if b.Len() >= 1500 {
-				_, err := s.ChannelMessageSend(m.ChannelID, b.String())
-				if err != nil {
-					log.Error().Err(err).Msg("Sending message failed")
-				}
-				b.Reset()
-			}
-			return nil
-
-		},
+	root, profile, language, err := srv.sonarrDefaults(m.GuildID, sc)
+	if err != nil {
+		log.Error().Err(err).Msg("Sonarr defaults lookup failed")
+		s.ChannelMessageSend(m.ChannelID, "Could not add "+show.Title+": "+err.Error())
+		return
+	}
+	req, ok := srv.ReserveRequest(s, m, QuotaKindSeries, show.Title, show.TvdbID, override)
+	if !ok {
+		return
+	}
+	_, err = sc.AddSeries(&sonarr.AddSeriesInput{
+		TvdbID:            show.TvdbID,
+		Title:             show.Title,
+		Seasons:           show.Seasons,
+		RootFolderPath:    root,
+		QualityProfileID:  profile,
+		LanguageProfileID: language,
+		SeasonFolder:      true,
+		Monitored:         true,
+		AddOptions:        &sonarr.AddSeriesOptions{SearchForMissingEpisodes: true},
 	})
-	_, err = s.ChannelMessageSend(m.ChannelID, b.String())
 	if err != nil {
-		log.Error().Err(err).Msg("Sending message failed")
+		log.Error().Err(err).Int64("tvdb", show.TvdbID).Msg("Sonarr add failed")
+		srv.ReleaseRequest(req)
+		s.ChannelMessageSend(m.ChannelID, "Could not add "+show.Title+": "+err.Error())
+		return
 	}
 
+	msg := fmt.Sprintf("Added %s (%d) to sonarr", show.Title, show.Year)
+	if q := srv.RequestQuotaLine(m, req); q != "" {
+		msg += "\n" + q
+	}
+	s.ChannelMessageSend(m.ChannelID, msg)
 }
 
 /*
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golift.io/starr"
+	"golift.io/starr/radarr"
+	"golift.io/starr/sonarr"
+)
+
+func TestDB_CacheSonarr(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.CacheSonarr([]*sonarr.Series{
+		{ID: 1, Title: "The Wire", Year: 2002, TvdbID: 79126, ImdbID: "tt0306414", Path: "/tv/The Wire",
+			QualityProfileID: 4, Tags: []int{1, 3}, Certification: "TV-MA",
+			Ratings: &starr.Ratings{Value: 9.3, Votes: 1200}, Statistics: &sonarr.Statistics{SizeOnDisk: 1 << 30}},
+		{ID: 2, Title: "Nothing Known"},
+	}))
+
+	result, err := db.QueryReadOnly(`SELECT title, year, tvdb_id, imdb_id, path, size_on_disk, quality_profile_id, tags, rating, rating_votes, certification
+		FROM sonarr ORDER BY id`, time.Second, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"The Wire", "2002", "79126", "tt0306414", "/tv/The Wire", "1073741824", "4", "1,3", "9.3", "1200", "TV-MA"},
+		{"Nothing Known", "0", "0", "", "", "0", "0", "", "", "", ""},
+	}, result.Rows)
+}
+
+func TestDB_CacheRadarr(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	movies := []*radarr.Movie{
+		{ID: 1, Title: "Alien", Year: 1979, TmdbID: 348, SizeOnDisk: 2048, Tags: []int{2}, Ratings: &starr.Ratings{Value: 8.1}},
+		{ID: 2, Title: "Up", Year: 2009, TmdbID: 14160, QualityProfileID: 1},
+	}
+	assert.NoError(t, db.CacheRadarr(movies))
+	assert.NoError(t, db.CacheRadarr(movies), "the table is replaced on every sync")
+
+	result, err := db.QueryReadOnly("SELECT title, tmdb_id, size_on_disk, tags, rating FROM radarr WHERE year < 2000", time.Second, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"Alien", "348", "2048", "2", "8.1"}}, result.Rows)
+
+	result, err = db.QueryReadOnly("SELECT count(*) FROM radarr WHERE quality_profile_id = 1", time.Second, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"1"}}, result.Rows)
+}
+
+func TestDB_StarrConfig(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, db.ConfigSet("starr.sonarr.url", "http://sonarr:8989/"))
+	assert.NoError(t, db.ConfigSet("starr.sonarr.token", "global"))
+
+	scfg, err := db.StarrConfig("1234", "sonarr")
+	assert.NoError(t, err)
+	assert.Equal(t, "global", scfg.APIKey, "guilds without an override use the global instance")
+
+	assert.NoError(t, db.ConfigSet(GuildKey("1234", "starr.sonarr.url"), "http://elsewhere:8989/"))
+	_, err = db.StarrConfig("1234", "sonarr")
+	assert.Error(t, err, "the global token is not sent to a guild's url")
+
+	assert.NoError(t, db.ConfigSet(GuildKey("1234", "starr.sonarr.token"), "guild"))
+	scfg, err = db.StarrConfig("1234", "sonarr")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://elsewhere:8989/", scfg.URL)
+	assert.Equal(t, "guild", scfg.APIKey)
+
+	scfg, err = db.StarrConfig("", "sonarr")
+	assert.NoError(t, err)
+	assert.Equal(t, "global", scfg.APIKey)
+}
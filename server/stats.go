@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// statsTop is how many genres and networks the stats list.
+const statsTop = 10
+
+// LibraryCount totals one of the cache tables.
+type LibraryCount struct {
+	Total       int64 `json:"total"`
+	Monitored   int64 `json:"monitored"`
+	Unmonitored int64 `json:"unmonitored"`
+	SizeOnDisk  int64 `json:"size_on_disk"`
+}
+
+// NamedCount is a count of items sharing a name, like a genre or a month.
+type NamedCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// FolderSize is the size on disk of everything under a root folder.
+type FolderSize struct {
+	Path  string `json:"path"`
+	Count int64  `json:"count"`
+	Size  int64  `json:"size"`
+}
+
+// Stats is the library overview of !stats and arrmate stats, built from the
+// cache tables and the plex library sections.
+type Stats struct {
+	Series       LibraryCount `json:"series"`
+	Movies       LibraryCount `json:"movies"`
+	RootFolders  []FolderSize `json:"root_folders"`
+	TopGenres    []NamedCount `json:"top_genres"`
+	TopNetworks  []NamedCount `json:"top_networks"`
+	AddedByMonth []NamedCount `json:"added_by_month"`
+	Plex         []NamedCount `json:"plex_libraries,omitempty"`
+	PlexError    string       `json:"plex_error,omitempty"`
+}
+
+// LibraryStats totals the sonarr and radarr cache tables, additions are
+// counted for the months since since.
+func (d *DB) LibraryStats(top int, since time.Time) (*Stats, error) {
+	conn, err := d.Pool.Get(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.Put(conn)
+
+	stats := &Stats{}
+	for table, count := range map[string]*LibraryCount{"sonarr": &stats.Series, "radarr": &stats.Movies} {
+		err = sqlitex.ExecuteTransient(conn, `SELECT count(*), coalesce(sum(monitored = 1), 0), coalesce(sum(size_on_disk), 0) FROM `+table, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				count.Total = stmt.ColumnInt64(0)
+				count.Monitored = stmt.ColumnInt64(1)
+				count.Unmonitored = count.Total - count.Monitored
+				count.SizeOnDisk = stmt.ColumnInt64(2)
+				return nil
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	folders := map[string]*FolderSize{}
+	genres := map[string]int64{}
+	err = sqlitex.ExecuteTransient(conn, `SELECT path, coalesce(size_on_disk, 0), genres FROM sonarr
+		UNION ALL SELECT path, coalesce(size_on_disk, 0), genres FROM radarr`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if p := stmt.ColumnText(0); p != "" {
+				root := path.Dir(strings.TrimSuffix(p, "/"))
+				if folders[root] == nil {
+					folders[root] = &FolderSize{Path: root}
+				}
+				folders[root].Count++
+				folders[root].Size += stmt.ColumnInt64(1)
+			}
+			for _, g := range strings.Split(stmt.ColumnText(2), ",") {
+				if g != "" {
+					genres[g]++
+				}
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats.RootFolders = []FolderSize{}
+	for _, f := range folders {
+		stats.RootFolders = append(stats.RootFolders, *f)
+	}
+	sort.Slice(stats.RootFolders, func(i, j int) bool { return stats.RootFolders[i].Path < stats.RootFolders[j].Path })
+	stats.TopGenres = topCounts(genres, top)
+
+	networks := map[string]int64{}
+	err = sqlitex.ExecuteTransient(conn, "SELECT network, count(*) FROM sonarr WHERE coalesce(network, '') != '' GROUP BY network", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			networks[stmt.ColumnText(0)] = stmt.ColumnInt64(1)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats.TopNetworks = topCounts(networks, top)
+
+	stats.AddedByMonth = []NamedCount{}
+	err = sqlitex.ExecuteTransient(conn, `SELECT substr(added, 1, 7) AS month, count(*) FROM
+		(SELECT added FROM sonarr UNION ALL SELECT added FROM radarr)
+		WHERE added >= ? GROUP BY month ORDER BY month`, &sqlitex.ExecOptions{
+		Args: []interface{}{since.Format("2006-01")},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			stats.AddedByMonth = append(stats.AddedByMonth, NamedCount{Name: stmt.ColumnText(0), Count: stmt.ColumnInt64(1)})
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// topCounts sorts counts from the highest, ties by name, and keeps top.
+func topCounts(counts map[string]int64, top int) []NamedCount {
+	results := []NamedCount{}
+	for name, count := range counts {
+		results = append(results, NamedCount{Name: name, Count: count})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Count != results[j].Count {
+			return results[i].Count > results[j].Count
+		}
+		return results[i].Name < results[j].Name
+	})
+	if len(results) > top {
+		results = results[:top]
+	}
+	return results
+}
+
+// PlexLibraryCounts returns the number of items in every plex library
+// section.  Only the totals are requested, not the items.
+func (srv *ArrServer) PlexLibraryCounts() ([]NamedCount, error) {
+	plexConn := srv.PlexConn()
+	if plexConn == nil {
+		return nil, fmt.Errorf("plex is not configured")
+	}
+	sections, err := plexConn.GetLibraries()
+	if err != nil {
+		return nil, err
+	}
+	results := []NamedCount{}
+	for _, d := range sections.MediaContainer.Directory {
+		var content struct {
+			MediaContainer struct {
+				TotalSize int64 `json:"totalSize"`
+			}
+		}
+		err := srv.PlexGet("/library/sections/"+d.Key+"/all", url.Values{
+			"X-Plex-Container-Start": {"0"},
+			"X-Plex-Container-Size":  {"0"},
+		}, &content)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, NamedCount{Name: d.Title, Count: content.MediaContainer.TotalSize})
+	}
+	return results, nil
+}
+
+// Stats builds the library stats for the last year, plex being unreachable
+// is reported in PlexError instead of failing.
+func (srv *ArrServer) Stats() (*Stats, error) {
+	stats, err := srv.DB.LibraryStats(statsTop, time.Now().AddDate(0, -11, 0))
+	if err != nil {
+		return nil, err
+	}
+	if stats.Plex, err = srv.PlexLibraryCounts(); err != nil {
+		stats.PlexError = err.Error()
+	}
+	return stats, nil
+}
+
+// Text renders the stats for discord.
+func (s *Stats) Text() string {
+	var b strings.Builder
+	count := func(name string, c LibraryCount) {
+		b.WriteString(fmt.Sprintf("%s: %d (%d monitored, %d unmonitored) %s\n", name, c.Total, c.Monitored, c.Unmonitored, HumanSize(c.SizeOnDisk)))
+	}
+	count("Series", s.Series)
+	count("Movies", s.Movies)
+	list := func(title string, items []NamedCount) {
+		if len(items) == 0 {
+			return
+		}
+		parts := make([]string, len(items))
+		for i, item := range items {
+			parts[i] = fmt.Sprintf("%s %d", item.Name, item.Count)
+		}
+		b.WriteString(fmt.Sprintf("%s: %s\n", title, strings.Join(parts, ", ")))
+	}
+	if len(s.RootFolders) > 0 {
+		b.WriteString("Root folders:\n")
+		for _, f := range s.RootFolders {
+			b.WriteString(fmt.Sprintf("  %s %d items %s\n", f.Path, f.Count, HumanSize(f.Size)))
+		}
+	}
+	list("Top genres", s.TopGenres)
+	list("Top networks", s.TopNetworks)
+	list("Added by month", s.AddedByMonth)
+	list("Plex", s.Plex)
+	if s.PlexError != "" {
+		b.WriteString("Plex: " + s.PlexError + "\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// HandleStats replies with the library stats.
+func (srv *ArrServer) HandleStats(s *discordgo.Session, m *discordgo.MessageCreate) {
+	stats, err := srv.Stats()
+	if err != nil {
+		log.Error().Err(err).Msg("Building stats failed")
+		s.ChannelMessageSend(m.ChannelID, "Error: "+err.Error())
+		return
+	}
+	for _, chunk := range ChunkMessage(stats.Text(), discordMessageLimit-8) {
+		if _, err := s.ChannelMessageSend(m.ChannelID, "```\n"+chunk+"\n```"); err != nil {
+			log.Error().Err(err).Msg("Sending message failed")
+			return
+		}
+	}
+}
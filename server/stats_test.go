@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jrudio/go-plex-client"
+	"github.com/stretchr/testify/assert"
+	"golift.io/starr/radarr"
+	"golift.io/starr/sonarr"
+)
+
+func TestDB_LibraryStats(t *testing.T) {
+	dcfg := makeDBConfig(t, "testing")
+	db, err := NewDB(dcfg)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	added := time.Date(2022, 5, 3, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, db.CacheSonarr([]*sonarr.Series{
+		{ID: 1, Title: "The Wire", Network: "HBO", Genres: []string{"Drama", "Crime"}, Path: "/tv/The Wire", Monitored: true,
+			Added: added, Statistics: &sonarr.Statistics{SizeOnDisk: 100}},
+		{ID: 2, Title: "Succession", Network: "HBO", Genres: []string{"Drama"}, Path: "/tv/Succession", Added: added.AddDate(0, 1, 0)},
+		{ID: 3, Title: "Bluey", Network: "ABC Kids", Genres: []string{"Animation"}, Path: "/kids/Bluey"},
+	}))
+	assert.NoError(t, db.CacheRadarr([]*radarr.Movie{
+		{ID: 1, Title: "Heat", Genres: []string{"Crime", "Drama"}, Path: "/movies/Heat (1995)", SizeOnDisk: 50, Monitored: true, Added: added},
+	}))
+
+	stats, err := db.LibraryStats(2, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, LibraryCount{Total: 3, Monitored: 1, Unmonitored: 2, SizeOnDisk: 100}, stats.Series)
+	assert.Equal(t, LibraryCount{Total: 1, Monitored: 1, Unmonitored: 0, SizeOnDisk: 50}, stats.Movies)
+	assert.Equal(t, []FolderSize{{"/kids", 1, 0}, {"/movies", 1, 50}, {"/tv", 2, 100}}, stats.RootFolders)
+	assert.Equal(t, []NamedCount{{"Drama", 3}, {"Crime", 2}}, stats.TopGenres)
+	assert.Equal(t, []NamedCount{{"HBO", 2}, {"ABC Kids", 1}}, stats.TopNetworks)
+	assert.Equal(t, []NamedCount{{"2022-05", 2}, {"2022-06", 1}}, stats.AddedByMonth, "items without an added date are not counted")
+
+	text := stats.Text()
+	assert.Contains(t, text, "Series: 3 (1 monitored, 2 unmonitored) 100 B")
+	assert.Contains(t, text, "Top networks: HBO 2, ABC Kids 1")
+}
+
+func TestArrServer_PlexLibraryCounts(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/library/sections":
+			w.Write([]byte(`{"MediaContainer": {"Directory": [
+				{"key": "1", "title": "Movies", "type": "movie"},
+				{"key": "2", "title": "TV Shows", "type": "show"}]}}`))
+		case "/library/sections/1/all":
+			assert.Equal(t, "0", r.URL.Query().Get("X-Plex-Container-Size"), "only the totals are requested")
+			w.Write([]byte(`{"MediaContainer": {"size": 0, "totalSize": 1234}}`))
+		case "/library/sections/2/all":
+			w.Write([]byte(`{"MediaContainer": {"size": 0, "totalSize": 56}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	srv := &ArrServer{}
+	_, err := srv.PlexLibraryCounts()
+	assert.Error(t, err, "plex is not configured")
+
+	plexConn, err := plex.New(api.URL, "token")
+	assert.NoError(t, err)
+	srv.SetPlexConn(plexConn)
+	counts, err := srv.PlexLibraryCounts()
+	assert.NoError(t, err)
+	assert.Equal(t, []NamedCount{{Name: "Movies", Count: 1234}, {Name: "TV Shows", Count: 56}}, counts)
+}
@@ -0,0 +1,127 @@
+package vtables
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"zombiezen.com/go/sqlite"
+)
+
+// Register adds the tables to conn as eponymous virtual tables, they can be
+// queried without a CREATE VIRTUAL TABLE.  Scans run with the context ctx
+// returns at the time, so the api calls stop with the query they belong to.
+func Register(conn *sqlite.Conn, tables []*Table, ctx func() context.Context) error {
+	for _, t := range tables {
+		t := t
+		err := conn.SetModule(t.Name, &sqlite.Module{
+			Connect: func(*sqlite.Conn, *sqlite.VTableConnectOptions) (sqlite.VTable, *sqlite.VTableConfig, error) {
+				return &vtab{table: t, ctx: ctx}, &sqlite.VTableConfig{Declaration: t.Declaration()}, nil
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("registering %s: %w", t.Name, err)
+		}
+	}
+	return nil
+}
+
+type vtab struct {
+	table *Table
+	ctx   func() context.Context
+}
+
+// BestIndex uses every usable equality constraint on a pushdown column, the
+// names of the columns are passed to Filter in the index id in argument
+// order.
+func (v *vtab) BestIndex(inputs *sqlite.IndexInputs) (*sqlite.IndexOutputs, error) {
+	usage := make([]sqlite.IndexConstraintUsage, len(inputs.Constraints))
+	names := []string{}
+	seen := map[int]bool{}
+	for i, c := range inputs.Constraints {
+		if !c.Usable || c.Op != sqlite.IndexConstraintEq || !v.table.CanPushdown(c.Column) || seen[c.Column] {
+			continue
+		}
+		seen[c.Column] = true
+		names = append(names, v.table.Columns[c.Column].Name)
+		usage[i] = sqlite.IndexConstraintUsage{ArgvIndex: len(names), Omit: true}
+	}
+	cost := 1000000.0
+	if len(names) > 0 {
+		cost = 10
+	}
+	return &sqlite.IndexOutputs{
+		ConstraintUsage: usage,
+		ID:              sqlite.IndexID{String: strings.Join(names, ",")},
+		EstimatedCost:   cost,
+	}, nil
+}
+
+func (v *vtab) Open() (sqlite.VTableCursor, error) {
+	return &cursor{table: v.table, ctx: v.ctx}, nil
+}
+
+func (v *vtab) Disconnect() error { return nil }
+
+func (v *vtab) Destroy() error { return nil }
+
+type cursor struct {
+	table *Table
+	ctx   func() context.Context
+	rows  [][]interface{}
+	pos   int
+}
+
+func (c *cursor) Filter(id sqlite.IndexID, argv []sqlite.Value) error {
+	constraints := map[string]interface{}{}
+	if id.String != "" {
+		for i, name := range strings.Split(id.String, ",") {
+			switch argv[i].Type() {
+			case sqlite.TypeInteger:
+				constraints[name] = argv[i].Int64()
+			case sqlite.TypeFloat:
+				constraints[name] = argv[i].Float()
+			default:
+				constraints[name] = argv[i].Text()
+			}
+		}
+	}
+	rows, err := c.table.Rows(c.ctx(), constraints)
+	if err != nil {
+		return fmt.Errorf("%s: %w", c.table.Name, err)
+	}
+	c.rows, c.pos = rows, 0
+	return nil
+}
+
+func (c *cursor) Next() error {
+	c.pos++
+	return nil
+}
+
+func (c *cursor) EOF() bool {
+	return c.pos >= len(c.rows)
+}
+
+func (c *cursor) Column(i int, noChange bool) (sqlite.Value, error) {
+	switch v := c.rows[c.pos][i].(type) {
+	case nil:
+		return sqlite.Value{}, nil
+	case int64:
+		return sqlite.IntegerValue(v), nil
+	case float64:
+		return sqlite.FloatValue(v), nil
+	case string:
+		return sqlite.TextValue(v), nil
+	default:
+		return sqlite.TextValue(fmt.Sprint(v)), nil
+	}
+}
+
+func (c *cursor) RowID() (int64, error) {
+	return int64(c.pos), nil
+}
+
+func (c *cursor) Close() error {
+	c.rows = nil
+	return nil
+}
@@ -0,0 +1,59 @@
+package vtables
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golift.io/starr/radarr"
+	"golift.io/starr/sonarr"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestRegister(t *testing.T) {
+	cfg, requests := fakeStarr(t, map[string]interface{}{
+		"/api/v3/movie":   []*radarr.Movie{{ID: 1, Title: "Alien", Year: 1979}, {ID: 2, Title: "Up", Year: 2009}},
+		"/api/v3/movie/2": &radarr.Movie{ID: 2, Title: "Up", Year: 2009},
+	})
+	noSonarr := func() (*sonarr.Sonarr, error) { return nil, fmt.Errorf("No config for starr.sonarr.url") }
+
+	conn, err := sqlite.OpenConn(":memory:")
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, Register(conn, Tables(noSonarr, radarrClient(cfg)), context.Background))
+
+	var count int64
+	err = sqlitex.ExecuteTransient(conn, "SELECT count(*) FROM radarr_movies WHERE year > 2000", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			count = stmt.ColumnInt64(0)
+			return nil
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	var title string
+	err = sqlitex.ExecuteTransient(conn, "SELECT title FROM radarr_movies WHERE id = 2", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			title = stmt.ColumnText(0)
+			return nil
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Up", title)
+	assert.Equal(t, "/api/v3/movie/2", (*requests)[len(*requests)-1], "id is pushed down to the api")
+
+	err = sqlitex.ExecuteTransient(conn, "SELECT * FROM sonarr_series", nil)
+	assert.ErrorContains(t, err, "starr.sonarr.url", "client errors are returned by the query")
+
+	stopped, err := sqlite.OpenConn(":memory:")
+	assert.NoError(t, err)
+	defer stopped.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, Register(stopped, Tables(noSonarr, radarrClient(cfg)), func() context.Context { return ctx }))
+	err = sqlitex.ExecuteTransient(stopped, "SELECT * FROM radarr_movies", nil)
+	assert.ErrorContains(t, err, "context canceled", "scans stop with the query context")
+}
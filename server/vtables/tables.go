@@ -0,0 +1,312 @@
+// Package vtables exposes the live sonarr and radarr APIs as sqlite virtual
+// tables.
+package vtables
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golift.io/starr"
+	"golift.io/starr/radarr"
+	"golift.io/starr/sonarr"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Column is a column of a virtual table, Type is the sqlite type used in the
+// table declaration.
+type Column struct {
+	Name string
+	Type string
+}
+
+// Table is a virtual table over a starr API.  Rows is called for every scan
+// with the context of the query and the equality constraints sqlite pushed
+// down, keyed by column name.
+// Only columns listed in Pushdown are ever passed and Rows must return
+// exactly the matching rows.
+type Table struct {
+	Name     string
+	Columns  []Column
+	Pushdown []string
+	Rows     func(ctx context.Context, constraints map[string]interface{}) ([][]interface{}, error)
+}
+
+// Declaration is the CREATE TABLE statement declaring the table to sqlite.
+func (t *Table) Declaration() string {
+	cols := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		cols[i] = c.Name + " " + c.Type
+	}
+	return fmt.Sprintf("CREATE TABLE %s (%s)", t.Name, strings.Join(cols, ", "))
+}
+
+// ColumnIndex returns the position of a column, -1 when t has no such column.
+func (t *Table) ColumnIndex(name string) int {
+	for i, c := range t.Columns {
+		if c.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// CanPushdown reports if equality constraints on the column at index i can be
+// handled by Rows.
+func (t *Table) CanPushdown(i int) bool {
+	if i < 0 || i >= len(t.Columns) {
+		return false
+	}
+	for _, name := range t.Pushdown {
+		if t.Columns[i].Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SonarrClient and RadarrClient are called on every scan so the tables follow
+// config changes.
+type (
+	SonarrClient func() (*sonarr.Sonarr, error)
+	RadarrClient func() (*radarr.Radarr, error)
+)
+
+// Tables returns every virtual table.
+func Tables(s SonarrClient, r RadarrClient) []*Table {
+	return []*Table{SonarrSeries(s), SonarrEpisodes(s), RadarrMovies(r)}
+}
+
+// SonarrSeries is the sonarr_series table, id is pushed down.  The api
+// has no exact title lookup so titles are left for sqlite to filter.
+func SonarrSeries(client SonarrClient) *Table {
+	return &Table{
+		Name: "sonarr_series",
+		Columns: []Column{
+			{"id", "INT"}, {"title", "TEXT"}, {"status", "TEXT"}, {"overview", "TEXT"},
+			{"network", "TEXT"}, {"year", "INT"}, {"path", "TEXT"}, {"tvdb_id", "INT"},
+			{"imdb_id", "TEXT"}, {"title_slug", "TEXT"}, {"series_type", "TEXT"}, {"genres", "TEXT"},
+			{"monitored", "INT"}, {"ended", "INT"}, {"added", "TEXT"}, {"previous_airing", "TEXT"},
+			{"next_airing", "TEXT"}, {"season_count", "INT"}, {"episode_count", "INT"},
+			{"episode_file_count", "INT"}, {"size_on_disk", "INT"}, {"raw", "TEXT"},
+		},
+		Pushdown: []string{"id"},
+		Rows: func(ctx context.Context, constraints map[string]interface{}) ([][]interface{}, error) {
+			s, err := client()
+			if err != nil {
+				return nil, err
+			}
+			var series []*sonarr.Series
+			if v, ok := constraints["id"]; ok {
+				id, valid := ID(v)
+				if !valid {
+					return [][]interface{}{}, nil
+				}
+				one, err := s.GetSeriesByIDContext(ctx, id)
+				if NotFound(err) {
+					return [][]interface{}{}, nil
+				} else if err != nil {
+					return nil, err
+				}
+				series = []*sonarr.Series{one}
+			} else {
+				all, err := s.GetAllSeriesContext(ctx)
+				if err != nil {
+					return nil, err
+				}
+				series = all
+			}
+			rows := [][]interface{}{}
+			for _, se := range series {
+				stats := se.Statistics
+				if stats == nil {
+					stats = &sonarr.Statistics{}
+				}
+				rows = append(rows, []interface{}{
+					se.ID, se.Title, se.Status, se.Overview,
+					se.Network, int64(se.Year), se.Path, se.TvdbID,
+					se.ImdbID, se.TitleSlug, se.SeriesType, strings.Join(se.Genres, ","),
+					Bool(se.Monitored), Bool(se.Ended), Time(se.Added), Time(stats.PreviousAiring),
+					Time(se.NextAiring), int64(stats.SeasonCount), int64(stats.EpisodeCount),
+					int64(stats.EpisodeFileCount), stats.SizeOnDisk, Raw(se),
+				})
+			}
+			return rows, nil
+		},
+	}
+}
+
+// SonarrEpisodes is the live_sonarr_episodes table.  Scans without a
+// series_id constraint fetch the episodes of every series.
+func SonarrEpisodes(client SonarrClient) *Table {
+	return &Table{
+		Name: "live_sonarr_episodes",
+		Columns: []Column{
+			{"id", "INT"}, {"series_id", "INT"}, {"season_number", "INT"}, {"episode_number", "INT"},
+			{"absolute_episode_number", "INT"}, {"title", "TEXT"}, {"overview", "TEXT"},
+			{"air_date", "TEXT"}, {"air_date_utc", "TEXT"}, {"has_file", "INT"},
+			{"episode_file_id", "INT"}, {"monitored", "INT"}, {"raw", "TEXT"},
+		},
+		Pushdown: []string{"series_id"},
+		Rows: func(ctx context.Context, constraints map[string]interface{}) ([][]interface{}, error) {
+			s, err := client()
+			if err != nil {
+				return nil, err
+			}
+			seriesIDs := []int64{}
+			if v, ok := constraints["series_id"]; ok {
+				id, valid := ID(v)
+				if !valid {
+					return [][]interface{}{}, nil
+				}
+				seriesIDs = append(seriesIDs, id)
+			} else {
+				all, err := s.GetAllSeriesContext(ctx)
+				if err != nil {
+					return nil, err
+				}
+				for _, se := range all {
+					seriesIDs = append(seriesIDs, se.ID)
+				}
+			}
+			rows := [][]interface{}{}
+			for _, id := range seriesIDs {
+				episodes, err := s.GetSeriesEpisodesContext(ctx, id)
+				if NotFound(err) {
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+				for _, e := range episodes {
+					rows = append(rows, []interface{}{
+						e.ID, e.SeriesID, e.SeasonNumber, e.EpisodeNumber,
+						e.AbsoluteEpisodeNumber, e.Title, e.Overview,
+						e.AirDate, Time(e.AirDateUtc), Bool(e.HasFile),
+						e.EpisodeFileID, Bool(e.Monitored), Raw(e),
+					})
+				}
+			}
+			return rows, nil
+		},
+	}
+}
+
+// RadarrMovies is the radarr_movies table, id and tmdb_id are pushed
+// down.
+func RadarrMovies(client RadarrClient) *Table {
+	return &Table{
+		Name: "radarr_movies",
+		Columns: []Column{
+			{"id", "INT"}, {"title", "TEXT"}, {"original_title", "TEXT"}, {"status", "TEXT"},
+			{"overview", "TEXT"}, {"year", "INT"}, {"path", "TEXT"}, {"tmdb_id", "INT"},
+			{"imdb_id", "TEXT"}, {"title_slug", "TEXT"}, {"studio", "TEXT"}, {"certification", "TEXT"},
+			{"runtime", "INT"}, {"genres", "TEXT"}, {"has_file", "INT"}, {"is_available", "INT"},
+			{"monitored", "INT"}, {"size_on_disk", "INT"}, {"added", "TEXT"}, {"in_cinemas", "TEXT"},
+			{"digital_release", "TEXT"}, {"raw", "TEXT"},
+		},
+		Pushdown: []string{"id", "tmdb_id"},
+		Rows: func(ctx context.Context, constraints map[string]interface{}) ([][]interface{}, error) {
+			r, err := client()
+			if err != nil {
+				return nil, err
+			}
+			var movies []*radarr.Movie
+			id, hasID := constraints["id"]
+			tmdbID, hasTmdbID := constraints["tmdb_id"]
+			wantID, validID := ID(id)
+			wantTmdbID, validTmdbID := ID(tmdbID)
+			if (hasID && !validID) || (hasTmdbID && !validTmdbID) {
+				return [][]interface{}{}, nil
+			}
+			if hasID {
+				var one *radarr.Movie
+				if one, err = r.GetMovieByIDContext(ctx, wantID); err == nil {
+					movies = []*radarr.Movie{one}
+				}
+			} else {
+				movies, err = r.GetMovieContext(ctx, wantTmdbID)
+			}
+			if NotFound(err) {
+				return [][]interface{}{}, nil
+			} else if err != nil {
+				return nil, err
+			}
+			rows := [][]interface{}{}
+			for _, m := range movies {
+				if hasTmdbID && m.TmdbID != wantTmdbID {
+					continue
+				}
+				rows = append(rows, []interface{}{
+					m.ID, m.Title, m.OriginalTitle, m.Status,
+					m.Overview, int64(m.Year), m.Path, m.TmdbID,
+					m.ImdbID, m.TitleSlug, m.Studio, m.Certification,
+					int64(m.Runtime), strings.Join(m.Genres, ","), Bool(m.HasFile), Bool(m.IsAvailable),
+					Bool(m.Monitored), m.SizeOnDisk, Time(m.Added), Time(m.InCinemas),
+					Time(m.DigitalRelease), Raw(m),
+				})
+			}
+			return rows, nil
+		},
+	}
+}
+
+// Int64 converts a constraint value from sqlite to an id, values that are
+// not numbers are 0.
+func Int64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	case string:
+		i, _ := strconv.ParseInt(n, 10, 64)
+		return i
+	case []byte:
+		i, _ := strconv.ParseInt(string(n), 10, 64)
+		return i
+	}
+	return 0
+}
+
+// ID converts a constraint value from sqlite to an api id, ok is false
+// when the value can not match one because it is not a positive integer.
+func ID(v interface{}) (int64, bool) {
+	if f, isFloat := v.(float64); isFloat && f != float64(int64(f)) {
+		return 0, false
+	}
+	id := Int64(v)
+	return id, id > 0
+}
+
+// NotFound reports if err is the api answering 404, an id that does not
+// exist.
+func NotFound(err error) bool {
+	return errors.Is(err, starr.ErrInvalidStatusCode) && strings.Contains(err.Error(), "(status: 404")
+}
+
+// Bool is how booleans are stored in sqlite.
+func Bool(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Time formats t as RFC 3339, the zero time is NULL.
+func Time(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Raw is the API object as JSON, like the RAW column of the cache tables.
+func Raw(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return string(b)
+}
@@ -0,0 +1,123 @@
+package vtables
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golift.io/starr"
+	"golift.io/starr/radarr"
+	"golift.io/starr/sonarr"
+)
+
+// fakeStarr serves canned JSON by path and records the requests made.
+func fakeStarr(t *testing.T, responses map[string]interface{}) (*starr.Config, *[]string) {
+	requests := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RequestURI())
+		body, ok := responses[r.URL.RequestURI()]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(srv.Close)
+	return starr.New("key", srv.URL, starr.DefaultTimeout), &requests
+}
+
+func sonarrClient(cfg *starr.Config) SonarrClient {
+	return func() (*sonarr.Sonarr, error) { return sonarr.New(cfg), nil }
+}
+
+func radarrClient(cfg *starr.Config) RadarrClient {
+	return func() (*radarr.Radarr, error) { return radarr.New(cfg), nil }
+}
+
+func TestSonarrSeries(t *testing.T) {
+	cfg, requests := fakeStarr(t, map[string]interface{}{
+		"/api/v3/series":   []*sonarr.Series{{ID: 1, Title: "Andor", Year: 2022}, {ID: 2, Title: "Severance"}},
+		"/api/v3/series/2": &sonarr.Series{ID: 2, Title: "Severance"},
+	})
+	table := SonarrSeries(sonarrClient(cfg))
+	assert.Equal(t, "raw", table.Columns[len(table.Columns)-1].Name)
+	assert.True(t, table.CanPushdown(table.ColumnIndex("id")))
+	assert.False(t, table.CanPushdown(table.ColumnIndex("title")), "title would need every series")
+
+	rows, err := table.Rows(context.Background(), map[string]interface{}{})
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, int64(2022), rows[0][table.ColumnIndex("year")])
+	assert.Len(t, rows[0], len(table.Columns))
+
+	rows, err = table.Rows(context.Background(), map[string]interface{}{"id": int64(2)})
+	assert.NoError(t, err)
+	assert.Len(t, rows, 1)
+	assert.Equal(t, "/api/v3/series/2", (*requests)[len(*requests)-1], "id is looked up directly")
+
+	rows, err = table.Rows(context.Background(), map[string]interface{}{"id": int64(3)})
+	assert.NoError(t, err)
+	assert.Empty(t, rows, "a missing id is no rows")
+
+	count := len(*requests)
+	for _, id := range []interface{}{nil, "abc", int64(0), int64(-1), 2.5} {
+		rows, err = table.Rows(context.Background(), map[string]interface{}{"id": id})
+		assert.NoError(t, err)
+		assert.Empty(t, rows, id)
+	}
+	assert.Len(t, *requests, count, "values that are not ids are not looked up")
+}
+
+func TestSonarrEpisodes(t *testing.T) {
+	cfg, requests := fakeStarr(t, map[string]interface{}{
+		"/api/v3/series":             []*sonarr.Series{{ID: 1}, {ID: 2}},
+		"/api/v3/episode?seriesId=1": []*sonarr.Episode{{ID: 10, SeriesID: 1, HasFile: true}},
+		"/api/v3/episode?seriesId=2": []*sonarr.Episode{{ID: 20, SeriesID: 2}, {ID: 21, SeriesID: 2}},
+	})
+	table := SonarrEpisodes(sonarrClient(cfg))
+
+	rows, err := table.Rows(context.Background(), map[string]interface{}{"series_id": "2"})
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, []string{"/api/v3/episode?seriesId=2"}, *requests)
+
+	rows, err = table.Rows(context.Background(), map[string]interface{}{})
+	assert.NoError(t, err)
+	assert.Len(t, rows, 3)
+	assert.Equal(t, int64(1), rows[0][table.ColumnIndex("has_file")])
+}
+
+func TestRadarrMovies(t *testing.T) {
+	cfg, _ := fakeStarr(t, map[string]interface{}{
+		"/api/v3/movie":            []*radarr.Movie{{ID: 1, Title: "Alien", TmdbID: 348}, {ID: 2, Title: "Up", TmdbID: 14160}},
+		"/api/v3/movie?tmdbId=348": []*radarr.Movie{{ID: 1, Title: "Alien", TmdbID: 348}},
+		"/api/v3/movie/2":          &radarr.Movie{ID: 2, Title: "Up", TmdbID: 14160},
+	})
+	table := RadarrMovies(radarrClient(cfg))
+
+	rows, err := table.Rows(context.Background(), map[string]interface{}{})
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+	assert.Nil(t, rows[0][table.ColumnIndex("added")], "zero times are NULL")
+
+	rows, err = table.Rows(context.Background(), map[string]interface{}{"tmdb_id": int64(348)})
+	assert.NoError(t, err)
+	assert.Len(t, rows, 1)
+
+	rows, err = table.Rows(context.Background(), map[string]interface{}{"id": int64(2), "tmdb_id": int64(348)})
+	assert.NoError(t, err)
+	assert.Empty(t, rows, "every pushed down constraint must match")
+
+	rows, err = table.Rows(context.Background(), map[string]interface{}{"id": int64(3)})
+	assert.NoError(t, err)
+	assert.Empty(t, rows, "a missing id is no rows")
+	rows, err = table.Rows(context.Background(), map[string]interface{}{"tmdb_id": "abc"})
+	assert.NoError(t, err)
+	assert.Empty(t, rows)
+	assert.False(t, table.CanPushdown(table.ColumnIndex("title")))
+
+	assert.Equal(t, "CREATE TABLE radarr_movies (id INT, title TEXT", table.Declaration()[:46])
+}